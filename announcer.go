@@ -0,0 +1,452 @@
+package gotrnt
+
+import (
+	"code.google.com/p/bencode-go"
+	"errors"
+	"log"
+	"math/rand"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Tracker announce events
+const (
+	AnnounceEventNone      = ""
+	AnnounceEventStarted   = "started"
+	AnnounceEventStopped   = "stopped"
+	AnnounceEventCompleted = "completed"
+)
+
+// Data sent to tracker in an announce
+type AnnounceRequest struct {
+	InfoHash   string // Torrent infohash, raw 20 bytes
+	PeerId     string // Our peer id
+	Port       uint16 // Our listening port
+	Uploaded   uint64 // Bytes uploaded so far
+	Downloaded uint64 // Bytes downloaded so far
+	Left       uint64 // Bytes left to download
+	Event      string // One of AnnounceEventXXX
+	TrackerId  string // Tracker id got in an earlier announce
+}
+
+// Data got from tracker in response to an announce
+type AnnounceResponse struct {
+	Interval    time.Duration // Time to wait before next announce
+	MinInterval time.Duration // Tracker doesn't want announces more often than this
+	TrackerId   string        // To be sent back in next announce
+	Seeders     int64         // Number of peers having complete torrent
+	Leechers    int64         // Number of peers still downloading
+	Peers       []string      // List of ip:port of peers
+}
+
+// State of a tracker, as of last announce to it
+type TrackerInfo struct {
+	Url          string    // Announce URL
+	LastError    string    // Error in last announce, empty if it went through
+	NextAnnounce time.Time // When tracker is due for next announce
+	Seeders      int64     // Number of seeders, as per last response
+	Leechers     int64     // Number of leechers, as per last response
+	NumPeers     int       // Number of peers got in last response
+	trackerId    string    // Tracker id got from tracker, sent back in announces
+	isStarted    bool      // Tracker got started event, so it must get stopped event too
+}
+
+// Announces our progress to trackers periodically, and feeds peers returned
+// by trackers to peermgr. Trackers are in tiers, as per announce-list. Tiers
+// are tried in order till a tier responds, or all tiers are announced to in
+// parallel if so configured. Within a tier, trackers are tried in order, and
+// the one that responds moves to front of its tier.
+type Announcer struct {
+	Tiers         [][]*TrackerInfo // Tiers of trackers
+	mutex         sync.Mutex       // Guards Tiers
+	completedChan chan bool        // Signals that download got completed
+	quit          chan bool        // Closed to stop announcer
+	done          chan bool        // Closed once stopped event is sent
+}
+
+// Start announcer, sends started event right away
+func (announcer *Announcer) Start(sessionInfo *TrntSessionInfo) bool {
+	// Sanity checks
+	if sessionInfo == nil {
+		log.Println(DebugGetFuncName(), "Invalid param")
+		return false
+	}
+
+	debugPrintln(sessionInfo.cfg.DebugOutput, DebugGetFuncName(), "Announcer")
+
+	// Trackers from announce-list, or announce URL if there's no list.
+	// Trackers within a tier are shuffled.
+	announceList := sessionInfo.metaInfo.AnnounceList
+	if len(announceList) == 0 {
+		announceList = [][]string{{sessionInfo.metaInfo.Announce}}
+	}
+	announcer.mutex.Lock()
+	announcer.Tiers = nil
+	for _, val := range announceList {
+		var tier []*TrackerInfo
+		for _, announceUrl := range val {
+			if len(announceUrl) > 0 {
+				trackerInfo := new(TrackerInfo)
+				trackerInfo.Url = announceUrl
+				tier = append(tier, trackerInfo)
+			}
+		}
+		rand.Shuffle(len(tier), func(i, j int) {
+			tier[i], tier[j] = tier[j], tier[i]
+		})
+		if len(tier) > 0 {
+			announcer.Tiers = append(announcer.Tiers, tier)
+		}
+	}
+	announcer.mutex.Unlock()
+
+	announcer.completedChan = make(chan bool, 1)
+	announcer.quit = make(chan bool)
+	announcer.done = make(chan bool)
+	go announcer.run(sessionInfo)
+	return true
+}
+
+// Stop announcer, waits till stopped event is sent to trackers
+func (announcer *Announcer) Stop() bool {
+	if announcer.quit == nil {
+		return false
+	}
+	close(announcer.quit)
+	<-announcer.done
+	announcer.quit = nil
+	return true
+}
+
+// Let trackers know that we've got all pieces
+func (announcer *Announcer) Completed() {
+	select {
+	case announcer.completedChan <- true:
+	default:
+	}
+}
+
+// Get a snapshot of state of all trackers, tier by tier
+func (announcer *Announcer) GetTrackers() []TrackerInfo {
+	announcer.mutex.Lock()
+	defer announcer.mutex.Unlock()
+	var trackers []TrackerInfo
+	for _, tier := range announcer.Tiers {
+		for _, val := range tier {
+			trackers = append(trackers, *val)
+		}
+	}
+	return trackers
+}
+
+// Announce whenever trackers are due, and whenever an event happens
+func (announcer *Announcer) run(sessionInfo *TrntSessionInfo) {
+	defer close(announcer.done)
+	if len(announcer.Tiers) == 0 {
+		// Magnet link without tracker, peers come from elsewhere
+		<-announcer.quit
+		return
+	}
+
+	event := AnnounceEventStarted
+	for {
+		peers, nextAnnounce, ok := announcer.announceTiers(sessionInfo, event)
+		sessionInfo.peerMgr.AddPeers(sessionInfo, peers)
+		if ok {
+			// Event is sent again if no tracker got it
+			event = AnnounceEventNone
+		}
+
+		select {
+		case <-time.After(time.Until(nextAnnounce)):
+		case <-announcer.completedChan:
+			event = AnnounceEventCompleted
+		case <-announcer.quit:
+			announcer.announceStopped(sessionInfo)
+			return
+		}
+	}
+}
+
+// Announce to tiers, one after another till a tier responds, or all of them
+// in parallel. An event is sent right away, otherwise only trackers that are
+// due get announced to. Returns peers got from all trackers that responded,
+// when trackers are due next, and whether any tier responded.
+func (announcer *Announcer) announceTiers(sessionInfo *TrntSessionInfo,
+	event string) ([]string, time.Time, bool) {
+	numTiers := len(announcer.Tiers)
+	tierPeers := make([][]string, numTiers)
+	tierOk := make([]bool, numTiers)
+	numTiersDone := numTiers
+	if sessionInfo.cfg.AnnounceParallel {
+		var wg sync.WaitGroup
+		for i := 0; i < numTiers; i++ {
+			wg.Add(1)
+			go func(tierIdx int) {
+				defer wg.Done()
+				tierPeers[tierIdx], tierOk[tierIdx] = announcer.announceTier(sessionInfo,
+					tierIdx, event)
+			}(i)
+		}
+		wg.Wait()
+	} else {
+		for i := 0; i < numTiers; i++ {
+			tierPeers[i], tierOk[i] = announcer.announceTier(sessionInfo, i, event)
+			if tierOk[i] {
+				numTiersDone = i + 1
+				break
+			}
+		}
+	}
+
+	// Merge peers got from trackers
+	peerSet := make(map[string]bool)
+	var peers []string
+	ok := false
+	for i, val := range tierPeers {
+		ok = ok || tierOk[i]
+		for _, peer := range val {
+			if !peerSet[peer] {
+				peerSet[peer] = true
+				peers = append(peers, peer)
+			}
+		}
+	}
+
+	// Next announce is when first tracker of a tier that we used is due
+	nextAnnounce := time.Now().Add(sessionInfo.cfg.AnnounceRetryWait)
+	announcer.mutex.Lock()
+	for _, tier := range announcer.Tiers[:numTiersDone] {
+		if tier[0].NextAnnounce.Before(nextAnnounce) {
+			nextAnnounce = tier[0].NextAnnounce
+		}
+	}
+	announcer.mutex.Unlock()
+	return peers, nextAnnounce, ok
+}
+
+// Announce to trackers of a tier, one after another till one responds. The
+// one that responds moves to front of tier. Returns peers got, and whether
+// tier responded or wasn't due yet.
+func (announcer *Announcer) announceTier(sessionInfo *TrntSessionInfo, tierIdx int,
+	event string) ([]string, bool) {
+	announcer.mutex.Lock()
+	tier := announcer.Tiers[tierIdx]
+	isDue := (event != AnnounceEventNone) || !time.Now().Before(tier[0].NextAnnounce)
+	announcer.mutex.Unlock()
+	if !isDue {
+		return nil, true
+	}
+
+	for i, trackerInfo := range tier {
+		resp, er := announcer.announce(sessionInfo, trackerInfo, event)
+		if er != nil {
+			continue
+		}
+		announcer.mutex.Lock()
+		copy(tier[1:i+1], tier[0:i])
+		tier[0] = trackerInfo
+		announcer.mutex.Unlock()
+		return resp.Peers, true
+	}
+	return nil, false
+}
+
+// Send stopped event to all trackers that got started event, in parallel
+func (announcer *Announcer) announceStopped(sessionInfo *TrntSessionInfo) {
+	var wg sync.WaitGroup
+	announcer.mutex.Lock()
+	for _, tier := range announcer.Tiers {
+		for _, val := range tier {
+			if !val.isStarted {
+				continue
+			}
+			wg.Add(1)
+			go func(trackerInfo *TrackerInfo) {
+				defer wg.Done()
+				announcer.announce(sessionInfo, trackerInfo, AnnounceEventStopped)
+			}(val)
+		}
+	}
+	announcer.mutex.Unlock()
+	wg.Wait()
+}
+
+// Send an announce with current transfer stats of session to a tracker, and
+// update tracker state from response
+func (announcer *Announcer) announce(sessionInfo *TrntSessionInfo,
+	trackerInfo *TrackerInfo, event string) (AnnounceResponse, error) {
+	var req AnnounceRequest
+	req.InfoHash = sessionInfo.metaInfo.InfoHash
+	req.PeerId = sessionInfo.cfg.PeerId
+	req.Port = sessionInfo.cfg.Port
+	req.Uploaded = atomic.LoadUint64(&sessionInfo.Uploaded)
+	req.Downloaded = atomic.LoadUint64(&sessionInfo.Downloaded)
+	req.Left = sessionInfo.getBytesLeft()
+	req.Event = event
+	announcer.mutex.Lock()
+	if (event == AnnounceEventNone) && !trackerInfo.isStarted {
+		// Tracker didn't get started event yet
+		req.Event = AnnounceEventStarted
+	}
+	req.TrackerId = trackerInfo.trackerId
+	announcer.mutex.Unlock()
+	debugPrintln(sessionInfo.cfg.DebugOutput,
+		DebugGetFuncName(), "Announce:", trackerInfo.Url, ", event:", req.Event,
+		", uploaded:", req.Uploaded, ", downloaded:", req.Downloaded, ", left:", req.Left)
+
+	// Stop cuts short an announce, except for stopped event that's sent
+	// after it
+	quit := announcer.quit
+	if event == AnnounceEventStopped {
+		quit = nil
+	}
+	resp, er := announceTracker(sessionInfo.cfg, &sessionInfo.client.udpConnIds,
+		trackerInfo.Url, req, quit)
+
+	announcer.mutex.Lock()
+	defer announcer.mutex.Unlock()
+	if (er != nil) && isClosed(quit) {
+		// Tracker isn't to blame for an announce that we gave up on
+		return resp, er
+	} else if er != nil {
+		log.Println(DebugGetFuncName(), er)
+		trackerInfo.LastError = er.Error()
+		trackerInfo.NextAnnounce = time.Now().Add(sessionInfo.cfg.AnnounceRetryWait)
+		return resp, er
+	}
+	trackerInfo.LastError = ""
+	waitTime := resp.Interval
+	if waitTime < resp.MinInterval {
+		waitTime = resp.MinInterval
+	}
+	trackerInfo.NextAnnounce = time.Now().Add(waitTime)
+	trackerInfo.Seeders = resp.Seeders
+	trackerInfo.Leechers = resp.Leechers
+	trackerInfo.NumPeers = len(resp.Peers)
+	if len(resp.TrackerId) > 0 {
+		trackerInfo.trackerId = resp.TrackerId
+	}
+	trackerInfo.isStarted = req.Event != AnnounceEventStopped
+	return resp, nil
+}
+
+// Send announce to tracker, using the protocol in announce URL. Closing quit
+// cuts it short, it may be nil.
+func announceTracker(cfg *GoTorrentCfg, connIds *udpConnIdCache, announceUrl string,
+	req AnnounceRequest, quit chan bool) (AnnounceResponse, error) {
+	switch {
+	case strings.HasPrefix(announceUrl, "udp://"):
+		return announceUdp(cfg, connIds, announceUrl, req, quit)
+	case strings.HasPrefix(announceUrl, "http://"), strings.HasPrefix(announceUrl, "https://"):
+		return announceHttp(cfg, announceUrl, req, quit)
+	}
+	return AnnounceResponse{}, errors.New("unsupported tracker: " + announceUrl)
+}
+
+// Send announce to an HTTP tracker. Closing quit cuts it short, it may be
+// nil.
+func announceHttp(cfg *GoTorrentCfg, announceUrl string,
+	req AnnounceRequest, quit chan bool) (AnnounceResponse, error) {
+	var resp AnnounceResponse
+
+	// Build announce URL
+	params := url.Values{}
+	params.Set("info_hash", req.InfoHash)
+	params.Set("peer_id", req.PeerId)
+	params.Set("port", strconv.Itoa(int(req.Port)))
+	params.Set("uploaded", strconv.FormatUint(req.Uploaded, 10))
+	params.Set("downloaded", strconv.FormatUint(req.Downloaded, 10))
+	params.Set("left", strconv.FormatUint(req.Left, 10))
+	params.Set("compact", "1")
+	if len(req.Event) > 0 {
+		params.Set("event", req.Event)
+	}
+	if len(req.TrackerId) > 0 {
+		params.Set("trackerid", req.TrackerId)
+	}
+	sep := "?"
+	if strings.Contains(announceUrl, "?") {
+		sep = "&"
+	}
+
+	// Send request and decode response
+	ctx, cancel := getQuitContext(quit)
+	defer cancel()
+	httpReq, er := http.NewRequestWithContext(ctx, "GET", announceUrl+sep+params.Encode(), nil)
+	if er != nil {
+		return resp, er
+	}
+	client := http.Client{Timeout: cfg.TrackerTimeout}
+	httpResp, er := client.Do(httpReq)
+	if er != nil {
+		return resp, er
+	}
+	defer httpResp.Body.Close()
+	data, er := bencode.Decode(httpResp.Body)
+	if er != nil {
+		return resp, er
+	}
+	dict, ok := data.(map[string]interface{})
+	if !ok {
+		return resp, errors.New("invalid tracker response")
+	}
+	if failure, ok := dict["failure reason"].(string); ok {
+		return resp, errors.New("tracker failure: " + failure)
+	}
+	if warning, ok := dict["warning message"].(string); ok {
+		log.Println(DebugGetFuncName(), "Tracker warning:", warning)
+	}
+
+	resp.Interval = cfg.AnnounceInterval
+	if interval, ok := dict["interval"].(int64); ok && (interval > 0) {
+		resp.Interval = time.Duration(interval) * time.Second
+	}
+	if minInterval, ok := dict["min interval"].(int64); ok && (minInterval > 0) {
+		resp.MinInterval = time.Duration(minInterval) * time.Second
+	}
+	resp.TrackerId, _ = dict["tracker id"].(string)
+	resp.Seeders, _ = dict["complete"].(int64)
+	resp.Leechers, _ = dict["incomplete"].(int64)
+
+	// Peers can be in compact form or a list of dictionaries
+	switch peers := dict["peers"].(type) {
+	case string:
+		resp.Peers = append(resp.Peers, parseCompactPeers(peers, net.IPv4len)...)
+	case []interface{}:
+		for _, val := range peers {
+			peerDict, ok := val.(map[string]interface{})
+			if !ok {
+				continue
+			}
+			ip, _ := peerDict["ip"].(string)
+			port, _ := peerDict["port"].(int64)
+			if (len(ip) > 0) && (port > 0) && (port <= 0xffff) {
+				resp.Peers = append(resp.Peers, net.JoinHostPort(ip, strconv.Itoa(int(port))))
+			}
+		}
+	}
+	if peers6, ok := dict["peers6"].(string); ok {
+		resp.Peers = append(resp.Peers, parseCompactPeers(peers6, net.IPv6len)...)
+	}
+	return resp, nil
+}
+
+// Get list of ip:port from compact peers format, each peer is an IP address
+// followed by 2 byte port in network byte order
+func parseCompactPeers(peers string, ipLen int) []string {
+	var peerList []string
+	entryLen := ipLen + 2
+	for i := 0; i+entryLen <= len(peers); i += entryLen {
+		ip := net.IP([]byte(peers[i : i+ipLen]))
+		port := getUint16FromBytes([]byte(peers[i+ipLen : i+entryLen]))
+		peerList = append(peerList, net.JoinHostPort(ip.String(), strconv.Itoa(int(port))))
+	}
+	return peerList
+}
@@ -0,0 +1,38 @@
+package gotrnt
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestAnnouncerStop(t *testing.T) {
+	cfg := DefaultGoTorrentCfg(6881)
+	cfg.TrackerTimeout = time.Minute
+	hangingTracker := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter,
+		r *http.Request) {
+		<-r.Context().Done()
+	}))
+	defer hangingTracker.Close()
+
+	// Tracker never responds, Stop doesn't wait for it
+	sessionInfo := new(TrntSessionInfo)
+	sessionInfo.client = NewClient(cfg)
+	sessionInfo.cfg = &cfg
+	sessionInfo.metaInfo.Announce = hangingTracker.URL + "/announce"
+	sessionInfo.metaInfo.InfoHash = strings.Repeat("a", 20)
+	if !sessionInfo.announcer.Start(sessionInfo) {
+		t.Fatal("Failed to start announcer")
+	}
+	time.Sleep(100 * time.Millisecond)
+	start := time.Now()
+	sessionInfo.announcer.Stop()
+	if time.Since(start) > 10*time.Second {
+		t.Fatal("Stop waited for announce:", time.Since(start))
+	}
+	if trackers := sessionInfo.announcer.GetTrackers(); len(trackers[0].LastError) > 0 {
+		t.Fatal("Tracker blamed for cancelled announce:", trackers[0].LastError)
+	}
+}
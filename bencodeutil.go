@@ -0,0 +1,96 @@
+package gotrnt
+
+import (
+	"bytes"
+	"code.google.com/p/bencode-go"
+	"log"
+	"strconv"
+)
+
+// Encode a value, built out of strings, int64s, lists and dictionaries
+func encodeBencode(val interface{}) ([]byte, bool) {
+	var buf bytes.Buffer
+	if er := bencode.Marshal(&buf, val); er != nil {
+		log.Println(DebugGetFuncName(), er)
+		return nil, false
+	}
+	return buf.Bytes(), true
+}
+
+// Decode a bencoded dictionary
+func decodeBencodeDict(buf []byte) (map[string]interface{}, bool) {
+	data, er := bencode.Decode(bytes.NewReader(buf))
+	if er != nil {
+		return nil, false
+	}
+	dict, ok := data.(map[string]interface{})
+	return dict, ok
+}
+
+// Get length of bencoded value at start of buf, so that any data that
+// follows the value can be found
+func getBencodeLength(buf []byte) (int, bool) {
+	if len(buf) == 0 {
+		return 0, false
+	}
+	switch {
+	case buf[0] == 'i':
+		end := bytes.IndexByte(buf, 'e')
+		if end < 0 {
+			return 0, false
+		}
+		return end + 1, true
+
+	case (buf[0] == 'l') || (buf[0] == 'd'):
+		offset := 1
+		for offset < len(buf) {
+			if buf[offset] == 'e' {
+				return offset + 1, true
+			}
+			valLen, ok := getBencodeLength(buf[offset:])
+			if !ok {
+				return 0, false
+			}
+			offset += valLen
+		}
+		return 0, false
+
+	case (buf[0] >= '0') && (buf[0] <= '9'):
+		colon := bytes.IndexByte(buf, ':')
+		if colon < 0 {
+			return 0, false
+		}
+		strLen, er := strconv.Atoi(string(buf[:colon]))
+		if (er != nil) || (strLen < 0) || (colon+1+strLen > len(buf)) {
+			return 0, false
+		}
+		return colon + 1 + strLen, true
+	}
+	return 0, false
+}
+
+// Get raw bencoded value of a key, in dictionary at start of buf. Value is
+// as is, such as info dictionary whose hash is the infohash.
+func getBencodeDictValue(buf []byte, key string) ([]byte, bool) {
+	if (len(buf) == 0) || (buf[0] != 'd') {
+		return nil, false
+	}
+	offset := 1
+	for (offset < len(buf)) && (buf[offset] != 'e') {
+		keyLen, ok := getBencodeLength(buf[offset:])
+		if !ok || (buf[offset] < '0') || (buf[offset] > '9') {
+			return nil, false
+		}
+		keyBuf := buf[offset : offset+keyLen]
+		offset += keyLen
+		valLen, ok := getBencodeLength(buf[offset:])
+		if !ok {
+			return nil, false
+		}
+		if string(keyBuf[bytes.IndexByte(keyBuf, ':')+1:]) == key {
+			return buf[offset : offset+valLen], true
+		}
+		offset += valLen
+	}
+	return nil, false
+}
@@ -0,0 +1,149 @@
+package gotrnt
+
+import (
+	"math/bits"
+	"sync"
+)
+
+// Fixed length bitfield of pieces. Bits are stored in wire order, that is
+// piece 0 is the most significant bit of first byte.
+type Bitfield struct {
+	bits   []byte       // Bitfield bytes, in wire order
+	length uint32       // Number of pieces
+	mutex  sync.RWMutex // Guards bits
+}
+
+// Create a bitfield with all bits cleared
+func NewBitfield(length uint32) *Bitfield {
+	bitField := new(Bitfield)
+	bitField.bits = make([]byte, (length+7)/8)
+	bitField.length = length
+	return bitField
+}
+
+// Number of pieces in bitfield
+func (bitField *Bitfield) Len() uint32 {
+	return bitField.length
+}
+
+// Mark a piece as available
+func (bitField *Bitfield) Set(pieceIdx uint32) {
+	if pieceIdx >= bitField.length {
+		return
+	}
+	bitField.mutex.Lock()
+	bitField.bits[pieceIdx/8] |= 0x80 >> (pieceIdx % 8)
+	bitField.mutex.Unlock()
+}
+
+// Mark a piece as not available
+func (bitField *Bitfield) Clear(pieceIdx uint32) {
+	if pieceIdx >= bitField.length {
+		return
+	}
+	bitField.mutex.Lock()
+	bitField.bits[pieceIdx/8] &^= 0x80 >> (pieceIdx % 8)
+	bitField.mutex.Unlock()
+}
+
+// Check if a piece is available
+func (bitField *Bitfield) Get(pieceIdx uint32) bool {
+	if pieceIdx >= bitField.length {
+		return false
+	}
+	bitField.mutex.RLock()
+	defer bitField.mutex.RUnlock()
+	return (bitField.bits[pieceIdx/8] & (0x80 >> (pieceIdx % 8))) != 0
+}
+
+// Number of available pieces
+func (bitField *Bitfield) Count() uint32 {
+	bitField.mutex.RLock()
+	defer bitField.mutex.RUnlock()
+	count := 0
+	for _, b := range bitField.bits {
+		count += bits.OnesCount8(b)
+	}
+	return uint32(count)
+}
+
+// Check if all pieces are available
+func (bitField *Bitfield) IsComplete() bool {
+	return bitField.Count() == bitField.length
+}
+
+// Call fn for each available piece, in increasing order of piece index.
+// Iteration stops if fn returns false.
+func (bitField *Bitfield) ForEach(fn func(pieceIdx uint32) bool) {
+	buf := bitField.Bytes()
+	for i, b := range buf {
+		for b != 0 {
+			bit := uint32(bits.LeadingZeros8(b))
+			if !fn(uint32(i)*8 + bit) {
+				return
+			}
+			b &^= 0x80 >> bit
+		}
+	}
+}
+
+// Get a bitfield having pieces that are available in both bitfields
+func (bitField *Bitfield) And(other *Bitfield) *Bitfield {
+	result := bitField.Copy()
+	otherBits := other.Bytes()
+	for i := range result.bits {
+		if i < len(otherBits) {
+			result.bits[i] &= otherBits[i]
+		} else {
+			result.bits[i] = 0
+		}
+	}
+	return result
+}
+
+// Get a bitfield having pieces that are available in this bitfield, but
+// not in other
+func (bitField *Bitfield) AndNot(other *Bitfield) *Bitfield {
+	result := bitField.Copy()
+	otherBits := other.Bytes()
+	for i := range result.bits {
+		if i < len(otherBits) {
+			result.bits[i] &^= otherBits[i]
+		}
+	}
+	return result
+}
+
+// Get a copy of bitfield
+func (bitField *Bitfield) Copy() *Bitfield {
+	result := new(Bitfield)
+	result.bits = bitField.Bytes()
+	result.length = bitField.length
+	return result
+}
+
+// Get bitfield in wire format, as sent in bitfield message
+func (bitField *Bitfield) Bytes() []byte {
+	bitField.mutex.RLock()
+	defer bitField.mutex.RUnlock()
+	buf := make([]byte, len(bitField.bits))
+	copy(buf, bitField.bits)
+	return buf
+}
+
+// Set bitfield from wire format, as received in bitfield message. Returns
+// false, leaving bitfield unchanged, if length of buf doesn't match number
+// of pieces or if any of the spare bits at the end are set.
+func (bitField *Bitfield) SetBytes(buf []byte) bool {
+	if len(buf) != len(bitField.bits) {
+		return false
+	}
+	if spareBits := uint32(len(buf))*8 - bitField.length; (spareBits > 0) &&
+		(buf[len(buf)-1]&byte((1<<spareBits)-1) != 0) {
+		return false
+	}
+	bitField.mutex.Lock()
+	copy(bitField.bits, buf)
+	bitField.mutex.Unlock()
+	return true
+}
@@ -0,0 +1,81 @@
+package gotrnt
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestBitfieldWireFormat(t *testing.T) {
+	tests := []struct {
+		length uint32
+		pieces []uint32
+		wire   []byte
+	}{
+		{0, nil, []byte{}},
+		{1, []uint32{0}, []byte{0x80}},
+		{8, []uint32{0, 7}, []byte{0x81}},
+		{9, []uint32{8}, []byte{0x00, 0x80}},
+		{12, []uint32{1, 3, 10, 11}, []byte{0x50, 0x30}},
+		{16, []uint32{0, 8, 15}, []byte{0x80, 0x81}},
+		{20, []uint32{19}, []byte{0x00, 0x00, 0x10}},
+	}
+	for _, test := range tests {
+		bitField := newTestBitfield(test.length, test.pieces...)
+		if buf := bitField.Bytes(); !bytes.Equal(buf, test.wire) {
+			t.Fatalf("Length: %d, pieces: %v, wire: %x", test.length, test.pieces, buf)
+		}
+
+		// Bitfield read back from wire has the same pieces, and no others
+		readBack := NewBitfield(test.length)
+		if !readBack.SetBytes(test.wire) {
+			t.Fatal("Wire format rejected, length:", test.length)
+		}
+		var pieces []uint32
+		readBack.ForEach(func(pieceIdx uint32) bool {
+			pieces = append(pieces, pieceIdx)
+			return true
+		})
+		if (len(pieces) != len(test.pieces)) || (readBack.Count() != uint32(len(test.pieces))) {
+			t.Fatal("Length:", test.length, ", pieces:", pieces)
+		}
+		for i, val := range test.pieces {
+			if (pieces[i] != val) || !readBack.Get(val) {
+				t.Fatal("Length:", test.length, ", pieces:", pieces)
+			}
+		}
+	}
+}
+
+func TestBitfieldRejectsBadWireFormat(t *testing.T) {
+	tests := []struct {
+		length uint32
+		wire   []byte
+	}{
+		{1, []byte{0x40}},        // Spare bit set
+		{1, []byte{0x01}},        // Last spare bit set
+		{12, []byte{0x00, 0x08}}, // First spare bit set
+		{12, []byte{0xff, 0xff}}, // All spare bits set
+		{12, []byte{0xff}},       // Too short
+		{12, []byte{0, 0, 0}},    // Too long
+		{8, []byte{}},            // Empty
+	}
+	for _, test := range tests {
+		bitField := newTestBitfield(test.length, 0)
+		if bitField.SetBytes(test.wire) {
+			t.Fatalf("Wire format accepted, length: %d, wire: %x", test.length, test.wire)
+		}
+
+		// Rejected bitfield is left unchanged
+		if !bitField.Get(0) || (bitField.Count() != 1) {
+			t.Fatal("Bitfield changed, length:", test.length)
+		}
+	}
+
+	// Spare bits can't be set through Set either
+	bitField := NewBitfield(12)
+	bitField.Set(12)
+	bitField.Set(15)
+	if !bytes.Equal(bitField.Bytes(), []byte{0, 0}) || bitField.Get(12) {
+		t.Fatal("Spare bit set")
+	}
+}
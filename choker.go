@@ -0,0 +1,131 @@
+package gotrnt
+
+import (
+	"github.com/swatkat/gotrntmessages"
+	"math/rand"
+	"sort"
+	"sync/atomic"
+	"time"
+)
+
+// Decides which peers get to download from us. Interested peers that give
+// us the best download rate are unchoked (tit-for-tat), or peers that we
+// upload fastest to when we're seeding. One more peer is unchoked at random,
+// and is rotated periodically, so that new peers get a chance to prove
+// themselves.
+type Choker struct {
+	optimisticPeer *PeerInfo // Peer in optimistic unchoke slot
+	round          int       // Number of rechoke rounds so far
+	quit           chan bool // Closed to stop choker
+}
+
+// Start choker
+func (choker *Choker) Start(sessionInfo *TrntSessionInfo) bool {
+	debugPrintln(sessionInfo.cfg.DebugOutput, DebugGetFuncName(), "Choker")
+	choker.quit = make(chan bool)
+	go choker.run(sessionInfo, choker.quit)
+	return true
+}
+
+// Stop choker
+func (choker *Choker) Stop() bool {
+	if choker.quit != nil {
+		close(choker.quit)
+		choker.quit = nil
+	}
+	return true
+}
+
+// Rechoke peers periodically
+func (choker *Choker) run(sessionInfo *TrntSessionInfo, quit chan bool) {
+	ticker := time.NewTicker(sessionInfo.cfg.ChokeInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			choker.rechoke(sessionInfo)
+		case <-quit:
+			return
+		}
+	}
+}
+
+// Pick peers to unchoke, and send choke/unchoke msgs to peers whose state
+// changes
+func (choker *Choker) rechoke(sessionInfo *TrntSessionInfo) {
+	isSeeding := sessionInfo.peerMgr.myInfo.BitField.IsComplete()
+	interval := sessionInfo.cfg.ChokeInterval.Seconds()
+
+	// Update transfer rates and find interested peers
+	var candidates []*PeerInfo
+	peers := sessionInfo.peerMgr.getPeers()
+	for _, val := range peers {
+		val.updateRates(interval)
+		if val.isConnected() && val.isInterested() {
+			candidates = append(candidates, val)
+		}
+	}
+
+	// Fastest peers get the regular upload slots. While downloading, snubbed
+	// peers don't, as there's nothing to reciprocate.
+	sort.Slice(candidates, func(i, j int) bool {
+		if isSeeding {
+			return candidates[i].UploadRate > candidates[j].UploadRate
+		}
+		return candidates[i].DownloadRate > candidates[j].DownloadRate
+	})
+	unchoke := make(map[*PeerInfo]bool)
+	for _, val := range candidates {
+		if len(unchoke) >= sessionInfo.cfg.UploadSlots {
+			break
+		}
+		if !isSeeding && val.isSnubbed() {
+			continue
+		}
+		unchoke[val] = true
+	}
+
+	// Rotate optimistic unchoke slot, among peers that didn't get a regular
+	// slot
+	optimisticRounds := int(sessionInfo.cfg.OptimisticInterval / sessionInfo.cfg.ChokeInterval)
+	if (choker.optimisticPeer == nil) || !choker.optimisticPeer.isInterested() ||
+		(optimisticRounds <= 1) || (choker.round%optimisticRounds == 0) {
+		choker.optimisticPeer = nil
+		var others []*PeerInfo
+		for _, val := range candidates {
+			if !unchoke[val] {
+				others = append(others, val)
+			}
+		}
+		if len(others) > 0 {
+			choker.optimisticPeer = others[rand.Intn(len(others))]
+		}
+	}
+	if choker.optimisticPeer != nil {
+		unchoke[choker.optimisticPeer] = true
+	}
+	choker.round++
+
+	// Send choke/unchoke msgs
+	for _, val := range peers {
+		if !val.isConnected() {
+			continue
+		}
+		if unchoke[val] && val.amChoking() {
+			val.SendMsg(sessionInfo, gotrntmessages.MsgTypeUnchoke)
+		} else if !unchoke[val] && !val.amChoking() {
+			val.SendMsg(sessionInfo, gotrntmessages.MsgTypeChoke)
+		}
+	}
+}
+
+// Compute transfer rates with peer since last call, interval is in seconds
+func (peerInfo *PeerInfo) updateRates(interval float64) {
+	downloaded := atomic.LoadUint64(&peerInfo.Downloaded)
+	uploaded := atomic.LoadUint64(&peerInfo.Uploaded)
+	peerInfo.DownloadRate = float64(downloaded-peerInfo.lastDownloaded) / interval
+	peerInfo.UploadRate = float64(uploaded-peerInfo.lastUploaded) / interval
+	peerInfo.lastDownloaded = downloaded
+	peerInfo.lastUploaded = uploaded
+	atomic.StoreUint64(&peerInfo.downloadBps, uint64(peerInfo.DownloadRate))
+}
@@ -0,0 +1,476 @@
+package gotrnt
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+)
+
+// A BitTorrent client, having its own config, peer listener and DHT node.
+// Several clients can run in one process, each on its own port. Torrents of
+// a client share its listener and peer id, and its limits on connections
+// and active torrents.
+type Client struct {
+	cfg          GoTorrentCfg                // Client config
+	listener     *net.TCPListener            // Accepts connections from peers
+	listenerDone chan bool                   // Closed once listener stops
+	dhtNode      DhtNode                     // Our DHT node, shared by all torrents
+	sessionMap   map[string]*TrntSessionInfo // Map of infohash -> started session, for incoming peers
+	sessionMutex sync.RWMutex                // Guards sessionMap
+	torrents     []*Torrent                  // Torrents added to client
+	mutex        sync.Mutex                  // Guards torrents
+	numConns     int32                       // Number of peer connections of all torrents, updated atomically
+	halfOpen     chan bool                   // Holds a value for each dial in progress, nil if there's no limit
+	queueSeq     uint64                      // Last queue position handed out
+	queueMutex   sync.Mutex                  // Serializes starting, pausing and queueing of torrents
+	extensions   []Extension                 // Extensions that we support, msg id of an extension is its index + 1
+	extMutex     sync.RWMutex                // Guards extensions
+	udpConnIds   udpConnIdCache              // Connection ids of UDP trackers, shared by all torrents
+}
+
+// A torrent added to a client
+type Torrent struct {
+	client   *Client          // Client that torrent belongs to
+	session  *TrntSessionInfo // Torrent session
+	running  bool             // Torrent is started
+	queued   bool             // Torrent waits in queue for a download or seed slot
+	queuedAt uint64           // Position in queue, torrents queued earlier start first
+	removed  chan bool        // Closed once torrent is removed from client
+	mutex    sync.Mutex       // Guards running, queued and removed
+}
+
+// Transfer stats of a torrent
+type TorrentStats struct {
+	Name        string        // Torrent name
+	InfoHash    string        // Infohash, raw 20 bytes
+	HasMetadata bool          // Info dictionary is known, it isn't till fetched for a magnet link
+	Running     bool          // Torrent is started
+	Queued      bool          // Torrent waits in queue for a download or seed slot
+	Completed   bool          // All pieces are in
+	TotalLength int64         // Total length of files
+	BytesLeft   uint64        // Bytes yet to be downloaded
+	Uploaded    uint64        // Bytes uploaded in this session
+	Downloaded  uint64        // Bytes downloaded in this session
+	Endgame     bool          // Last blocks are requested from several peers at once
+	DupRequests uint64        // Requests for blocks already requested from other peers, in endgame
+	WastedBytes uint64        // Bytes of blocks received that we already had, the cost of duplicate requests
+	NumPieces   uint32        // Number of pieces
+	PiecesDone  uint32        // Number of pieces that we have
+	NumPeers    int           // Number of connected peers
+	NumSnubbed  int           // Number of connected peers that sent us nothing for a while
+	Swarm       ScrapeInfo    // Swarm stats, as of last scrape
+	Trackers    []TrackerInfo // State of trackers, tier by tier
+}
+
+// A file of torrent
+type TorrentFile struct {
+	Path      string // Path relative to download directory
+	Length    int64  // File length
+	Completed int64  // Bytes of file that lie in pieces that we have
+}
+
+// Create a client with given config. Client doesn't talk to anyone till
+// started.
+func NewClient(cfg GoTorrentCfg) *Client {
+	client := new(Client)
+	client.cfg = cfg
+	client.sessionMap = make(map[string]*TrntSessionInfo)
+	if cfg.MaxHalfOpen > 0 {
+		client.halfOpen = make(chan bool, cfg.MaxHalfOpen)
+	}
+
+	// Peers send ut_metadata and ut_pex msgs to us with the ids that they get
+	// here. Peer exchange (BEP 11) is turned off for private torrents.
+	client.RegisterExtension("ut_metadata", processMetadataMsg)
+	client.RegisterPublicExtension("ut_pex", processPexMsg)
+	return client
+}
+
+// Start listening for peers, and join DHT if it's configured
+func (client *Client) Start() bool {
+	if !client.startListener() {
+		return false
+	}
+	if client.cfg.DhtAddr != nil {
+		client.dhtNode.Addr = client.cfg.DhtAddr
+		client.dhtNode.Bootstrap = client.cfg.DhtBootstrap
+		client.dhtNode.NodesFile = client.cfg.DhtNodesFile
+		client.dhtNode.Timeout = client.cfg.DhtTimeout
+		client.dhtNode.DebugOutput = client.cfg.DebugOutput
+		client.dhtNode.Start()
+	}
+	return true
+}
+
+// Stop all torrents, and stop listening for peers. DHT routing table is
+// saved for next run.
+func (client *Client) Stop() bool {
+	client.queueMutex.Lock()
+	for _, val := range client.Torrents() {
+		val.pause()
+	}
+	client.queueMutex.Unlock()
+	client.stopListener()
+	client.dhtNode.Stop()
+	return true
+}
+
+// Get client config
+func (client *Client) Config() GoTorrentCfg {
+	return client.cfg
+}
+
+// Get address on which client listens for peers, nil if it isn't started
+func (client *Client) ListenAddr() net.Addr {
+	if client.listener == nil {
+		return nil
+	}
+	return client.listener.Addr()
+}
+
+// Add a torrent from a .torrent file
+func (client *Client) AddTorrentFile(fileNameWithPath string) (*Torrent, bool) {
+	return client.addTorrent(func(sessionInfo *TrntSessionInfo) bool {
+		return sessionInfo.Init(fileNameWithPath)
+	})
+}
+
+// Add a torrent from contents of a .torrent file
+func (client *Client) AddTorrentBytes(buf []byte) (*Torrent, bool) {
+	return client.addTorrent(func(sessionInfo *TrntSessionInfo) bool {
+		return sessionInfo.InitBytes(buf)
+	})
+}
+
+// Add a torrent from a magnet link, its metadata is fetched from peers once
+// it's started
+func (client *Client) AddMagnet(uri string) (*Torrent, bool) {
+	return client.addTorrent(func(sessionInfo *TrntSessionInfo) bool {
+		return sessionInfo.InitMagnet(uri)
+	})
+}
+
+// Get torrents added to client
+func (client *Client) Torrents() []*Torrent {
+	client.mutex.Lock()
+	defer client.mutex.Unlock()
+	return append([]*Torrent(nil), client.torrents...)
+}
+
+// Get stats of torrents from a tracker, with client's tracker timeouts and
+// UDP tracker connection ids
+func (client *Client) ScrapeTracker(announceUrl string,
+	infoHashes []string) (map[string]ScrapeInfo, error) {
+	return scrapeTracker(&client.cfg, &client.udpConnIds, announceUrl, infoHashes, nil)
+}
+
+// Make a session, init it and add it to client, unless client already has
+// a torrent with same infohash
+func (client *Client) addTorrent(initSession func(*TrntSessionInfo) bool) (*Torrent, bool) {
+	sessionInfo := new(TrntSessionInfo)
+	sessionInfo.cfg = &client.cfg
+	sessionInfo.client = client
+	sessionInfo.dataDir = client.cfg.DownloadDir
+	sessionInfo.done = make(chan bool)
+	if !initSession(sessionInfo) {
+		return nil, false
+	}
+
+	client.mutex.Lock()
+	defer client.mutex.Unlock()
+	for _, val := range client.torrents {
+		if val.session.metaInfo.InfoHash == sessionInfo.metaInfo.InfoHash {
+			log.Println(DebugGetFuncName(), "Torrent already added")
+			return nil, false
+		}
+	}
+	torrent := new(Torrent)
+	torrent.client = client
+	torrent.session = sessionInfo
+	torrent.removed = make(chan bool)
+	client.torrents = append(client.torrents, torrent)
+	return torrent, true
+}
+
+// Get infohash of torrent, raw 20 bytes
+func (torrent *Torrent) InfoHash() string {
+	return torrent.session.metaInfo.InfoHash
+}
+
+// Get name of torrent, which may be empty for a magnet link till metadata
+// is fetched
+func (torrent *Torrent) Name() string {
+	return torrent.session.getName()
+}
+
+// Start torrenting, or resume it after a pause. Torrent waits in queue if
+// client already has as many active downloads or seeds as it may.
+func (torrent *Torrent) Start() bool {
+	client := torrent.client
+	client.queueMutex.Lock()
+	defer client.queueMutex.Unlock()
+	if torrent.running || torrent.queued || torrent.isRemoved() {
+		return false
+	}
+	client.queueSeq++
+	torrent.mutex.Lock()
+	torrent.queued = true
+	torrent.queuedAt = client.queueSeq
+	torrent.mutex.Unlock()
+
+	client.scheduleTorrentsLocked()
+	return torrent.running || torrent.queued
+}
+
+// Stop torrenting, torrent stays in client and can be started again. Its
+// slot goes to next torrent in queue.
+func (torrent *Torrent) Pause() bool {
+	client := torrent.client
+	client.queueMutex.Lock()
+	defer client.queueMutex.Unlock()
+	if !torrent.pause() {
+		return false
+	}
+	client.scheduleTorrentsLocked()
+	return true
+}
+
+// Stop torrenting, and remove torrent from client. Downloaded data is left
+// as is.
+func (torrent *Torrent) Remove() bool {
+	client := torrent.client
+	client.queueMutex.Lock()
+	defer client.queueMutex.Unlock()
+	if torrent.isRemoved() {
+		return false
+	}
+	torrent.pause()
+	torrent.mutex.Lock()
+	close(torrent.removed)
+	torrent.mutex.Unlock()
+
+	client.mutex.Lock()
+	for i, val := range client.torrents {
+		if val == torrent {
+			client.torrents = append(client.torrents[:i], client.torrents[i+1:]...)
+			break
+		}
+	}
+	client.mutex.Unlock()
+	client.scheduleTorrentsLocked()
+	return true
+}
+
+// Move downloaded data of torrent to another directory. A running torrent is
+// stopped for the move, and started again.
+func (torrent *Torrent) Move(dir string) bool {
+	client := torrent.client
+	client.queueMutex.Lock()
+	defer client.queueMutex.Unlock()
+	if torrent.isRemoved() {
+		return false
+	}
+	if torrent.running {
+		torrent.session.Stop()
+	}
+	ok := torrent.session.moveStorage(dir)
+	if torrent.running && !torrent.session.Start() {
+		torrent.mutex.Lock()
+		torrent.running = false
+		torrent.mutex.Unlock()
+		client.scheduleTorrentsLocked()
+		return false
+	}
+	return ok
+}
+
+// Check torrent data on disk against piece hashes, hashing numWorkers pieces
+// at once, or as many as there are CPUs if 0. Resume state is rebuilt from
+// result. A running torrent is stopped for the check, and started again.
+func (torrent *Torrent) Verify(numWorkers int) (VerifyResult, bool) {
+	client := torrent.client
+	client.queueMutex.Lock()
+	defer client.queueMutex.Unlock()
+	if torrent.isRemoved() {
+		return VerifyResult{}, false
+	}
+	if torrent.running {
+		torrent.session.Stop()
+	}
+	result, ok := torrent.session.verify(numWorkers)
+	if torrent.running && !torrent.session.Start() {
+		torrent.mutex.Lock()
+		torrent.running = false
+		torrent.mutex.Unlock()
+		client.scheduleTorrentsLocked()
+	}
+	return result, ok
+}
+
+// Switch a torrent that fetched its metadata over to downloading, unless it
+// was paused or removed meanwhile. A torrent that fails to switch is stopped,
+// and its slot goes to next torrent in queue.
+func (client *Client) switchToDownload(sessionInfo *TrntSessionInfo) bool {
+	client.queueMutex.Lock()
+	defer client.queueMutex.Unlock()
+	var torrent *Torrent
+	for _, val := range client.Torrents() {
+		if val.session == sessionInfo {
+			torrent = val
+			break
+		}
+	}
+	if (torrent == nil) || !torrent.running {
+		debugPrintln(client.cfg.DebugOutput,
+			DebugGetFuncName(), "Torrent isn't running, not switching to download")
+		return false
+	}
+	if sessionInfo.startDownload() {
+		return true
+	}
+	log.Println(DebugGetFuncName(), "Failed to start download:", torrent.Name())
+	torrent.pause()
+	client.scheduleTorrentsLocked()
+	return false
+}
+
+// Stop session if it's running, and take torrent out of queue. Returns false
+// if torrent was neither. queueMutex must be held.
+func (torrent *Torrent) pause() bool {
+	if !torrent.running && !torrent.queued {
+		return false
+	}
+	if torrent.running {
+		torrent.session.Stop()
+	}
+	torrent.mutex.Lock()
+	torrent.running = false
+	torrent.queued = false
+	torrent.mutex.Unlock()
+	return true
+}
+
+// Wait till all pieces are in. Returns error if torrent is removed or
+// context is done first.
+func (torrent *Torrent) Wait(ctx context.Context) error {
+	select {
+	case <-torrent.session.done:
+		return nil
+	case <-torrent.removed:
+		return errors.New("torrent removed")
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Get transfer stats of torrent
+func (torrent *Torrent) Stats() TorrentStats {
+	sessionInfo := torrent.session
+	var stats TorrentStats
+	stats.Name = sessionInfo.getName()
+	stats.InfoHash = sessionInfo.metaInfo.InfoHash
+	stats.HasMetadata = sessionInfo.hasMetaInfo()
+	torrent.mutex.Lock()
+	stats.Running = torrent.running
+	stats.Queued = torrent.queued
+	torrent.mutex.Unlock()
+	stats.Completed = sessionInfo.isCompleted()
+	stats.Uploaded = atomic.LoadUint64(&sessionInfo.Uploaded)
+	stats.Downloaded = atomic.LoadUint64(&sessionInfo.Downloaded)
+	stats.Endgame = sessionInfo.pieceMgr.isEndgame()
+	stats.DupRequests = atomic.LoadUint64(&sessionInfo.Duplicates)
+	stats.WastedBytes = atomic.LoadUint64(&sessionInfo.Wasted)
+	stats.Swarm = sessionInfo.GetSwarmInfo()
+	stats.Trackers = sessionInfo.announcer.GetTrackers()
+	if stats.Running {
+		peers := sessionInfo.peerMgr.getPeers()
+		stats.NumPeers = len(peers)
+		for _, val := range peers {
+			if val.isSnubbed() {
+				stats.NumSnubbed++
+			}
+		}
+	}
+	if stats.HasMetadata {
+		stats.TotalLength = sessionInfo.getTotalLength()
+		stats.NumPieces = sessionInfo.getNumPieces()
+		stats.BytesLeft = uint64(stats.TotalLength)
+		if bitField := sessionInfo.peerMgr.myInfo.BitField; bitField != nil {
+			stats.PiecesDone = bitField.Count()
+			stats.BytesLeft = sessionInfo.getBytesLeft()
+		}
+	}
+	return stats
+}
+
+// Get files of torrent, along with how much of each file we have. There are
+// no files till metadata is known.
+func (torrent *Torrent) Files() []TorrentFile {
+	sessionInfo := torrent.session
+	if !sessionInfo.hasMetaInfo() {
+		return nil
+	}
+	sessionInfo.infoMutex.RLock()
+	info := sessionInfo.metaInfo.Info
+	sessionInfo.infoMutex.RUnlock()
+	var files []TorrentFile
+	if len(info.Files) == 0 {
+		files = append(files, TorrentFile{Path: info.Name, Length: info.Length})
+	}
+	for _, val := range info.Files {
+		pathElems := append([]string{info.Name}, val.Path...)
+		files = append(files, TorrentFile{Path: filepath.Join(pathElems...), Length: val.Length})
+	}
+
+	// Bytes of each file in pieces that we have
+	bitField := sessionInfo.peerMgr.myInfo.BitField
+	if bitField == nil {
+		return files
+	}
+	pieceLen := info.PieceLength
+	fileOffset := int64(0)
+	for i := range files {
+		fileEnd := fileOffset + files[i].Length
+		for pieceIdx := fileOffset / pieceLen; pieceIdx*pieceLen < fileEnd; pieceIdx++ {
+			if !bitField.Get(uint32(pieceIdx)) {
+				continue
+			}
+			begin := pieceIdx * pieceLen
+			end := begin + int64(sessionInfo.getPieceLength(uint32(pieceIdx)))
+			if begin < fileOffset {
+				begin = fileOffset
+			}
+			if end > fileEnd {
+				end = fileEnd
+			}
+			files[i].Completed += end - begin
+		}
+		fileOffset = fileEnd
+	}
+	return files
+}
+
+// Scrape trackers of torrent, swarm stats in Stats are updated from this.
+// Returns stats got from each tracker, keyed by announce URL.
+func (torrent *Torrent) Scrape() map[string]ScrapeInfo {
+	return torrent.session.Scrape()
+}
+
+// Get announce URLs of trackers of torrent
+func (torrent *Torrent) Trackers() []string {
+	return torrent.session.getTrackerUrls()
+}
+
+// Check if torrent is removed from client
+func (torrent *Torrent) isRemoved() bool {
+	select {
+	case <-torrent.removed:
+		return true
+	default:
+		return false
+	}
+}
@@ -0,0 +1,266 @@
+package main
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"github.com/swatkat/gotrnt"
+	"log"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// Port on which we listen for peers and DHT nodes
+const goTrntPort = 6882
+
+func main() {
+	if len(os.Args) < 2 {
+		fmt.Println(gotrnt.DebugGetFuncName(), "Usage:gotrnt file.torrent|magnet-link...")
+		fmt.Println(gotrnt.DebugGetFuncName(), "      gotrnt scrape file.torrent")
+		fmt.Println(gotrnt.DebugGetFuncName(), "      gotrnt tracker [whitelist-file]")
+		fmt.Println(gotrnt.DebugGetFuncName(), "      gotrnt create [options] file|dir")
+		fmt.Println(gotrnt.DebugGetFuncName(), "      gotrnt verify file.torrent --dir path [--json]")
+		return
+	}
+
+	// Subcommands
+	switch os.Args[1] {
+	case "scrape":
+		scrapeMain(os.Args[2:])
+		return
+	case "tracker":
+		trackerMain(os.Args[2:])
+		return
+	case "create":
+		createMain(os.Args[2:])
+		return
+	case "verify":
+		verifyMain(os.Args[2:])
+		return
+	}
+
+	// Start listener, and join DHT to find peers without tracker
+	client := gotrnt.NewClient(gotrnt.DefaultGoTorrentCfg(goTrntPort))
+	if !client.Start() {
+		return
+	}
+
+	// Read torrent files and magnet links. Torrents beyond client's limits on
+	// active downloads and seeds wait in queue.
+	numTorrents := 0
+	for _, val := range os.Args[1:] {
+		var torrent *gotrnt.Torrent
+		var ok bool
+		if strings.HasPrefix(val, "magnet:") {
+			torrent, ok = client.AddMagnet(val)
+		} else {
+			torrent, ok = client.AddTorrentFile(val)
+		}
+		if !ok {
+			continue
+		}
+
+		// Connect to peers
+		torrent.Start()
+		numTorrents++
+	}
+
+	// Keep going till interrupted
+	if numTorrents > 0 {
+		waitForInterrupt()
+	}
+
+	// Close all peer connections, and save DHT routing table for next run
+	client.Stop()
+}
+
+// Print swarm stats of a torrent got from its trackers, without downloading
+func scrapeMain(args []string) {
+	if len(args) < 1 {
+		fmt.Println(gotrnt.DebugGetFuncName(), "Usage:gotrnt scrape file.torrent")
+		return
+	}
+	client := gotrnt.NewClient(gotrnt.DefaultGoTorrentCfg(goTrntPort))
+	torrent, ok := client.AddTorrentFile(args[0])
+	if !ok {
+		return
+	}
+
+	trackerStats := torrent.Scrape()
+	for _, announceUrl := range torrent.Trackers() {
+		if scrapeInfo, ok := trackerStats[announceUrl]; ok {
+			fmt.Printf("%s: complete %d, incomplete %d, downloaded %d\n", announceUrl,
+				scrapeInfo.Seeders, scrapeInfo.Leechers, scrapeInfo.Completed)
+		} else {
+			fmt.Printf("%s: scrape failed\n", announceUrl)
+		}
+	}
+	swarmInfo := torrent.Stats().Swarm
+	fmt.Printf("Swarm: complete %d, incomplete %d, downloaded %d\n", swarmInfo.Seeders,
+		swarmInfo.Leechers, swarmInfo.Completed)
+}
+
+// Run as HTTP tracker, till interrupted. Torrents are limited to the ones in
+// whitelist file, if given.
+func trackerMain(args []string) {
+	var trackerServer gotrnt.TrackerServer
+
+	trntCfg := gotrnt.DefaultGoTorrentCfg(goTrntPort)
+	trackerServer.Addr = trntCfg.TrackerAddr
+	trackerServer.Interval = trntCfg.TrackerInterval
+	trackerServer.MinInterval = trntCfg.TrackerMinInterval
+	trackerServer.PeerExpiry = trntCfg.TrackerPeerExpiry
+	if len(args) > 0 {
+		whitelist, ok := gotrnt.LoadTrackerWhitelist(args[0])
+		if !ok {
+			return
+		}
+		trackerServer.Whitelist = whitelist
+	}
+	if !trackerServer.Start() {
+		return
+	}
+
+	waitForInterrupt()
+	trackerServer.Stop()
+}
+
+// Flag that may be given more than once
+type stringListFlag []string
+
+func (list *stringListFlag) String() string {
+	return strings.Join(*list, ",")
+}
+
+func (list *stringListFlag) Set(val string) error {
+	*list = append(*list, val)
+	return nil
+}
+
+// Create a .torrent file of a file or directory
+func createMain(args []string) {
+	var opts gotrnt.CreateTorrentOpts
+	var trackers, webSeeds stringListFlag
+
+	flags := flag.NewFlagSet("create", flag.ContinueOnError)
+	outFile := flags.String("o", "", "Output .torrent file, <name>.torrent by default")
+	flags.Var(&trackers, "a", "Tracker URLs of a tier, comma separated; repeat for more tiers")
+	flags.Int64Var(&opts.PieceLength, "l", 0, "Piece length in bytes, a power of 2; automatic if 0")
+	flags.StringVar(&opts.Comment, "c", "", "Comment")
+	flags.BoolVar(&opts.Private, "p", false, "Private torrent")
+	flags.Var(&webSeeds, "w", "Web seed URL; repeat for more web seeds")
+	flags.BoolVar(&opts.PadFiles, "pad", false, "Add padding files, so that files start on piece boundaries")
+	noDate := flags.Bool("no-date", false, "Leave out creation date")
+	if (flags.Parse(args) != nil) || (flags.NArg() != 1) {
+		fmt.Println(gotrnt.DebugGetFuncName(), "Usage:gotrnt create [options] file|dir")
+		flags.PrintDefaults()
+		return
+	}
+
+	opts.Path = flags.Arg(0)
+	for _, val := range trackers {
+		opts.AnnounceList = append(opts.AnnounceList, strings.Split(val, ","))
+	}
+	opts.UrlList = webSeeds
+	opts.CreatedBy = gotrnt.GoTrntClientName
+	if !*noDate {
+		opts.CreationDate = time.Now()
+	}
+	if len(*outFile) == 0 {
+		absPath, er := filepath.Abs(opts.Path)
+		if er != nil {
+			log.Println(gotrnt.DebugGetFuncName(), er)
+			return
+		}
+		*outFile = filepath.Base(absPath) + ".torrent"
+	}
+
+	infoHash, ok := gotrnt.CreateTorrentFile(opts, *outFile)
+	if !ok {
+		return
+	}
+	fmt.Printf("Created %s, infohash %s\n", *outFile, hex.EncodeToString([]byte(infoHash)))
+}
+
+// Check torrent data on disk against piece hashes, and rebuild resume state.
+// Exits with status 1 if any piece is bad.
+func verifyMain(args []string) {
+	flags := flag.NewFlagSet("verify", flag.ContinueOnError)
+	dir := flags.String("dir", ".", "Directory in which torrent data is stored")
+	jsonOut := flags.Bool("json", false, "Print result as JSON")
+	numWorkers := flags.Int("w", 0, "Number of pieces hashed in parallel, number of CPUs if 0")
+
+	// Torrent file may come before flags
+	var torrentFile string
+	if (len(args) > 0) && !strings.HasPrefix(args[0], "-") {
+		torrentFile = args[0]
+		args = args[1:]
+	}
+	if (flags.Parse(args) != nil) || (len(torrentFile) == 0 && flags.NArg() != 1) ||
+		(len(torrentFile) > 0 && flags.NArg() != 0) {
+		fmt.Println(gotrnt.DebugGetFuncName(), "Usage:gotrnt verify file.torrent --dir path [--json]")
+		flags.PrintDefaults()
+		return
+	}
+	if len(torrentFile) == 0 {
+		torrentFile = flags.Arg(0)
+	}
+
+	buf, er := os.ReadFile(torrentFile)
+	if er != nil {
+		log.Println(gotrnt.DebugGetFuncName(), er)
+		os.Exit(1)
+	}
+	trntCfg := gotrnt.DefaultGoTorrentCfg(goTrntPort)
+	trntCfg.DownloadDir = *dir
+	if *jsonOut {
+		// Debug output goes to stderr, so that stdout has JSON only
+		trntCfg.DebugOutput = os.Stderr
+	}
+	client := gotrnt.NewClient(trntCfg)
+	torrent, ok := client.AddTorrentBytes(buf)
+	if !ok {
+		os.Exit(1)
+	}
+	result, ok := torrent.Verify(*numWorkers)
+	if !ok {
+		os.Exit(1)
+	}
+
+	if *jsonOut {
+		out, er := json.MarshalIndent(result, "", "  ")
+		if er != nil {
+			log.Println(gotrnt.DebugGetFuncName(), er)
+			os.Exit(1)
+		}
+		fmt.Println(string(out))
+	} else {
+		fmt.Printf("%s (%s) in %s\n", result.Name, result.InfoHash, result.Dir)
+		for _, val := range result.MissingFiles {
+			fmt.Printf("Missing file: %s\n", val)
+		}
+		for _, val := range result.SizeMismatches {
+			fmt.Printf("Size mismatch: %s, expected %d, found %d\n", val.Path, val.Length, val.Size)
+		}
+		fmt.Printf("Pieces: %d good, %d bad, %d total\n", result.GoodPieces, result.BadPieces,
+			result.NumPieces)
+		if result.ResumeSaved {
+			fmt.Println("Resume state rebuilt")
+		}
+	}
+	if result.BadPieces > 0 {
+		os.Exit(1)
+	}
+}
+
+// Wait till we're asked to quit
+func waitForInterrupt() {
+	interrupt := make(chan os.Signal, 1)
+	signal.Notify(interrupt, os.Interrupt, syscall.SIGTERM)
+	<-interrupt
+}
@@ -0,0 +1,396 @@
+package gotrnt
+
+import (
+	"crypto/sha1"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Piece length limits, automatic piece length aims for no more than
+// CreateTargetPieces pieces
+const (
+	CreateMinPieceLength = 0x4000
+	CreateMaxPieceLength = 0x1000000
+	CreateTargetPieces   = 1500
+)
+
+// Options for creating a torrent
+type CreateTorrentOpts struct {
+	Path         string     // File or directory to make torrent of
+	PieceLength  int64      // Piece length, a power of 2; picked as per total size if 0
+	AnnounceList [][]string // Tiers of tracker URLs, first URL is also the announce URL
+	Comment      string     // Free form comment
+	CreatedBy    string     // Program that created torrent
+	CreationDate time.Time  // Creation time, left out if zero
+	Private      bool       // Torrent is private, peers come from its tracker only
+	UrlList      []string   // Web seed URLs
+	PadFiles     bool       // Add padding files so that each file starts on a piece boundary
+	NumWorkers   int        // Number of pieces hashed in parallel, number of CPUs if 0
+	DebugOutput  io.Writer  // Hashing progress goes here, stdout if nil
+}
+
+// A file in torrent being created
+type createFile struct {
+	DiskPath string   // Path on disk, empty for padding files
+	Path     []string // Path within torrent
+	Length   int64    // File length
+}
+
+// Create a torrent from a file or directory. Files of a directory are sorted
+// by path, so that same input always gives same infohash. Returns bencoded
+// torrent and its infohash.
+func CreateTorrent(opts CreateTorrentOpts) ([]byte, string, bool) {
+	// Sanity checks
+	if (opts.PieceLength != 0) && ((opts.PieceLength < CreateMinPieceLength) ||
+		(opts.PieceLength > CreateMaxPieceLength) ||
+		(opts.PieceLength&(opts.PieceLength-1) != 0)) {
+		log.Println(DebugGetFuncName(), "Invalid piece length:", opts.PieceLength)
+		return nil, "", false
+	}
+
+	fileInfo, er := os.Stat(opts.Path)
+	if er != nil {
+		log.Println(DebugGetFuncName(), er)
+		return nil, "", false
+	}
+	absPath, er := filepath.Abs(opts.Path)
+	if er != nil {
+		log.Println(DebugGetFuncName(), er)
+		return nil, "", false
+	}
+	name := filepath.Base(absPath)
+	if !isValidPathElement(name) {
+		log.Println(DebugGetFuncName(), "Invalid torrent name:", name)
+		return nil, "", false
+	}
+
+	var files []createFile
+	isDir := fileInfo.IsDir()
+	if isDir {
+		var ok bool
+		if files, ok = getCreateFiles(absPath); !ok {
+			return nil, "", false
+		}
+	} else {
+		var file createFile
+		file.DiskPath = absPath
+		file.Path = []string{name}
+		file.Length = fileInfo.Size()
+		files = append(files, file)
+	}
+	totalLen := int64(0)
+	for _, val := range files {
+		totalLen += val.Length
+	}
+	if totalLen == 0 {
+		log.Println(DebugGetFuncName(), "Nothing to make torrent of")
+		return nil, "", false
+	}
+
+	pieceLen := opts.PieceLength
+	if pieceLen == 0 {
+		pieceLen = getAutoPieceLength(totalLen)
+	}
+	if isDir && opts.PadFiles {
+		files = addPadFiles(files, pieceLen)
+	}
+
+	pieces, ok := hashCreateFiles(files, pieceLen, opts.NumWorkers, opts.DebugOutput)
+	if !ok {
+		return nil, "", false
+	}
+
+	// Info dictionary
+	info := make(map[string]interface{})
+	info["name"] = name
+	info["piece length"] = pieceLen
+	info["pieces"] = pieces
+	if opts.Private {
+		info["private"] = int64(1)
+	}
+	if isDir {
+		var fileList []interface{}
+		for _, val := range files {
+			fileDict := make(map[string]interface{})
+			fileDict["length"] = val.Length
+			var pathList []interface{}
+			for _, elem := range val.Path {
+				pathList = append(pathList, elem)
+			}
+			fileDict["path"] = pathList
+			if len(val.DiskPath) == 0 {
+				fileDict["attr"] = "p"
+			}
+			fileList = append(fileList, fileDict)
+		}
+		info["files"] = fileList
+	} else {
+		info["length"] = totalLen
+	}
+	infoBytes, ok := encodeBencode(info)
+	if !ok {
+		return nil, "", false
+	}
+	infoHash := sha1.Sum(infoBytes)
+
+	// Torrent dictionary
+	torrent := make(map[string]interface{})
+	torrent["info"] = info
+	var tiers []interface{}
+	for _, tier := range opts.AnnounceList {
+		var urls []interface{}
+		for _, val := range tier {
+			if len(val) > 0 {
+				urls = append(urls, val)
+			}
+		}
+		if len(urls) > 0 {
+			tiers = append(tiers, urls)
+		}
+	}
+	if len(tiers) > 0 {
+		torrent["announce"] = tiers[0].([]interface{})[0]
+		torrent["announce-list"] = tiers
+	}
+	if len(opts.Comment) > 0 {
+		torrent["comment"] = opts.Comment
+	}
+	if len(opts.CreatedBy) > 0 {
+		torrent["created by"] = opts.CreatedBy
+	}
+	if !opts.CreationDate.IsZero() {
+		torrent["creation date"] = opts.CreationDate.Unix()
+	}
+	if len(opts.UrlList) > 0 {
+		var urls []interface{}
+		for _, val := range opts.UrlList {
+			urls = append(urls, val)
+		}
+		torrent["url-list"] = urls
+	}
+	torrentBytes, ok := encodeBencode(torrent)
+	if !ok {
+		return nil, "", false
+	}
+	return torrentBytes, string(infoHash[:]), true
+}
+
+// Create a torrent and save it as a .torrent file
+func CreateTorrentFile(opts CreateTorrentOpts, fileNameWithPath string) (string, bool) {
+	torrentBytes, infoHash, ok := CreateTorrent(opts)
+	if !ok {
+		return "", false
+	}
+	if er := os.WriteFile(fileNameWithPath, torrentBytes, 0644); er != nil {
+		log.Println(DebugGetFuncName(), er)
+		return "", false
+	}
+	return infoHash, true
+}
+
+// Get regular files under a directory, sorted by path. Symlinks and other
+// special files are skipped.
+func getCreateFiles(dir string) ([]createFile, bool) {
+	var files []createFile
+	er := filepath.Walk(dir, func(path string, fileInfo os.FileInfo, er error) error {
+		if er != nil {
+			return er
+		}
+		if !fileInfo.Mode().IsRegular() {
+			return nil
+		}
+		relPath, er := filepath.Rel(dir, path)
+		if er != nil {
+			return er
+		}
+		var file createFile
+		file.DiskPath = path
+		file.Path = strings.Split(filepath.ToSlash(relPath), "/")
+		file.Length = fileInfo.Size()
+		files = append(files, file)
+		return nil
+	})
+	if er != nil {
+		log.Println(DebugGetFuncName(), er)
+		return nil, false
+	}
+
+	// Walk goes in lexical order within each directory, which is the same as
+	// sorting by path elements
+	return files, true
+}
+
+// Add a padding file (BEP 47) after each file that doesn't end on a piece
+// boundary, except the last file
+func addPadFiles(files []createFile, pieceLen int64) []createFile {
+	var paddedFiles []createFile
+	for i, val := range files {
+		paddedFiles = append(paddedFiles, val)
+		padLen := (pieceLen - (val.Length % pieceLen)) % pieceLen
+		if (i == len(files)-1) || (padLen == 0) {
+			continue
+		}
+		var padFile createFile
+		padFile.Path = []string{".pad", strconv.FormatInt(padLen, 10)}
+		padFile.Length = padLen
+		paddedFiles = append(paddedFiles, padFile)
+	}
+	return paddedFiles
+}
+
+// Pick a piece length as per total size, so that torrent has a reasonable
+// number of pieces
+func getAutoPieceLength(totalLen int64) int64 {
+	pieceLen := int64(CreateMinPieceLength)
+	for (pieceLen < CreateMaxPieceLength) && (totalLen/pieceLen > CreateTargetPieces) {
+		pieceLen *= 2
+	}
+	return pieceLen
+}
+
+// Hash files into pieces, several pieces at once. Returns concatenated piece
+// hashes.
+func hashCreateFiles(files []createFile, pieceLen int64, numWorkers int,
+	debugOutput io.Writer) (string, bool) {
+	totalLen := int64(0)
+	for _, val := range files {
+		totalLen += val.Length
+	}
+	numPieces := int((totalLen + pieceLen - 1) / pieceLen)
+	pieces := make([]byte, numPieces*sha1.Size)
+	failed := false
+	var failedOnce sync.Once
+	hashPieces(files, pieceLen, numWorkers, debugOutput,
+		func(pieceIdx int, hash []byte, er error) {
+			if er != nil {
+				failedOnce.Do(func() {
+					log.Println(DebugGetFuncName(), er)
+					failed = true
+				})
+				return
+			}
+			copy(pieces[pieceIdx*sha1.Size:], hash)
+		})
+	return string(pieces), !failed
+}
+
+// Hash pieces of files, several pieces at once. Hash of each piece, or error
+// if piece couldn't be read, is handed to handlePiece; it's called from
+// several goroutines. Progress goes to debugOutput.
+func hashPieces(files []createFile, pieceLen int64, numWorkers int, debugOutput io.Writer,
+	handlePiece func(pieceIdx int, hash []byte, er error)) {
+	totalLen := int64(0)
+	for _, val := range files {
+		totalLen += val.Length
+	}
+	numPieces := int((totalLen + pieceLen - 1) / pieceLen)
+	if numWorkers <= 0 {
+		numWorkers = runtime.NumCPU()
+	}
+	if numWorkers > numPieces {
+		numWorkers = numPieces
+	}
+
+	pieceIdxChan := make(chan int)
+	var wg sync.WaitGroup
+	for i := 0; i < numWorkers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			var reader createFileReader
+			defer reader.Close()
+			buf := make([]byte, pieceLen)
+			for pieceIdx := range pieceIdxChan {
+				offset := int64(pieceIdx) * pieceLen
+				length := pieceLen
+				if offset+length > totalLen {
+					length = totalLen - offset
+				}
+				if er := reader.ReadAt(files, buf[:length], offset); er != nil {
+					handlePiece(pieceIdx, nil, er)
+					continue
+				}
+				hash := sha1.Sum(buf[:length])
+				handlePiece(pieceIdx, hash[:], nil)
+			}
+		}()
+	}
+	for i := 0; i < numPieces; i++ {
+		pieceIdxChan <- i
+		if (i+1)%1000 == 0 {
+			debugPrintln(debugOutput, DebugGetFuncName(), "Hashed pieces:", i+1, "/", numPieces)
+		}
+	}
+	close(pieceIdxChan)
+	wg.Wait()
+}
+
+// Reads torrent byte ranges from files being made into a torrent. Last file
+// read from is kept open, as pieces mostly come from the same file.
+type createFileReader struct {
+	path   string   // Path of open file
+	handle *os.File // Open file
+}
+
+// Read a torrent byte range, it may span several files. Padding files read
+// as zeros.
+func (reader *createFileReader) ReadAt(files []createFile, buf []byte, offset int64) error {
+	fileOffset := int64(0)
+	bytesRead := 0
+	for _, val := range files {
+		if bytesRead == len(buf) {
+			break
+		}
+		if offset >= fileOffset+val.Length {
+			fileOffset += val.Length
+			continue
+		}
+		segOffset := offset - fileOffset
+		segLen := val.Length - segOffset
+		if segLen > int64(len(buf)-bytesRead) {
+			segLen = int64(len(buf) - bytesRead)
+		}
+		seg := buf[bytesRead : bytesRead+int(segLen)]
+		if len(val.DiskPath) == 0 {
+			for i := range seg {
+				seg[i] = 0
+			}
+		} else {
+			if reader.path != val.DiskPath {
+				reader.Close()
+				handle, er := os.Open(val.DiskPath)
+				if er != nil {
+					return er
+				}
+				reader.path = val.DiskPath
+				reader.handle = handle
+			}
+			if _, er := reader.handle.ReadAt(seg, segOffset); er != nil {
+				if er == io.EOF {
+					er = io.ErrUnexpectedEOF
+				}
+				return er
+			}
+		}
+		bytesRead += int(segLen)
+		offset += segLen
+		fileOffset += val.Length
+	}
+	return nil
+}
+
+// Close open file, if any
+func (reader *createFileReader) Close() {
+	if reader.handle != nil {
+		reader.handle.Close()
+		reader.handle = nil
+		reader.path = ""
+	}
+}
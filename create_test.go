@@ -0,0 +1,136 @@
+package gotrnt
+
+import (
+	"crypto/sha1"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// Write files of a test directory, in given order
+func writeTestCreateDir(t *testing.T, dir string, names []string) {
+	for _, val := range names {
+		path := filepath.Join(dir, filepath.FromSlash(val))
+		if er := os.MkdirAll(filepath.Dir(path), 0755); er != nil {
+			t.Fatal(er)
+		}
+		data := make([]byte, 1000+(100*len(val)))
+		for i := range data {
+			data[i] = byte(i + len(val))
+		}
+		if er := os.WriteFile(path, data, 0644); er != nil {
+			t.Fatal(er)
+		}
+	}
+}
+
+func TestCreateDeterministicInfoHash(t *testing.T) {
+	// Same files written in different order, at different places
+	dir1 := filepath.Join(t.TempDir(), "data")
+	dir2 := filepath.Join(t.TempDir(), "data")
+	writeTestCreateDir(t, dir1, []string{"a", "b/c", "b/d", "e"})
+	writeTestCreateDir(t, dir2, []string{"e", "b/d", "a", "b/c"})
+
+	tests := []CreateTorrentOpts{
+		{Path: dir1},
+		{Path: dir2},
+		{Path: dir2, NumWorkers: 1},
+		{Path: dir2, NumWorkers: 7},
+		{Path: dir1, AnnounceList: [][]string{{"http://tracker/announce"}},
+			Comment: "comment", CreatedBy: "gotrnt", CreationDate: time.Unix(1, 0),
+			UrlList: []string{"http://seed/"}},
+	}
+	var want string
+	for i, opts := range tests {
+		opts.DebugOutput = io.Discard
+		torrentBytes, infoHash, ok := CreateTorrent(opts)
+		if !ok || (len(torrentBytes) == 0) || (len(infoHash) != sha1.Size) {
+			t.Fatal("Failed to create torrent:", i)
+		}
+		if i == 0 {
+			want = infoHash
+		} else if infoHash != want {
+			t.Fatal("Infohash differs:", i)
+		}
+	}
+
+	// Info dictionary changes give another infohash
+	for i, opts := range []CreateTorrentOpts{
+		{Path: dir1, Private: true},
+		{Path: dir1, PieceLength: 2 * CreateMinPieceLength},
+		{Path: dir1, PadFiles: true, PieceLength: CreateMinPieceLength},
+	} {
+		opts.DebugOutput = io.Discard
+		if _, infoHash, ok := CreateTorrent(opts); !ok || (infoHash == want) {
+			t.Fatal("Infohash unchanged:", i)
+		}
+	}
+}
+
+func TestCreatePadFiles(t *testing.T) {
+	const pieceLen = 16
+	tests := []struct {
+		lengths []int64
+		want    []int64 // Lengths of files after padding, pad files negated
+	}{
+		{[]int64{5}, []int64{5}},
+		{[]int64{16, 32}, []int64{16, 32}},
+		{[]int64{5, 16}, []int64{5, -11, 16}},
+		{[]int64{17, 1, 3}, []int64{17, -15, 1, -15, 3}},
+		{[]int64{32, 31, 7}, []int64{32, 31, -1, 7}},
+	}
+	for _, test := range tests {
+		var files []createFile
+		for i, val := range test.lengths {
+			files = append(files, createFile{DiskPath: strconv.Itoa(i),
+				Path: []string{strconv.Itoa(i)}, Length: val})
+		}
+		padded := addPadFiles(files, pieceLen)
+		if len(padded) != len(test.want) {
+			t.Fatal("Lengths:", test.lengths, ", padded:", padded)
+		}
+		offset := int64(0)
+		for i, val := range padded {
+			isPad := len(val.DiskPath) == 0
+			if (isPad && ((val.Length != -test.want[i]) || (len(val.Path) != 2) ||
+				(val.Path[0] != ".pad") || (val.Path[1] != strconv.FormatInt(val.Length, 10)))) ||
+				(!isPad && (val.Length != test.want[i])) {
+				t.Fatal("Lengths:", test.lengths, ", padded:", padded)
+			}
+
+			// Every file starts on a piece boundary
+			if !isPad && (offset%pieceLen != 0) {
+				t.Fatal("Lengths:", test.lengths, ", file not aligned:", i)
+			}
+			offset += val.Length
+		}
+	}
+
+	// Pad files are hashed as zeros, and each file's data starts a piece
+	dir := t.TempDir()
+	writeTestCreateDir(t, dir, []string{"a", "bb"})
+	files, ok := getCreateFiles(dir)
+	if !ok || (len(files) != 2) {
+		t.Fatal("Failed to get files:", files)
+	}
+	files = addPadFiles(files, CreateMinPieceLength)
+	pieces, ok := hashCreateFiles(files, CreateMinPieceLength, 2, io.Discard)
+	if !ok || (len(pieces) != 2*sha1.Size) {
+		t.Fatal("Failed to hash files")
+	}
+	for i, val := range []string{"a", "bb"} {
+		data, _ := os.ReadFile(filepath.Join(dir, val))
+		piece := make([]byte, CreateMinPieceLength)
+		copy(piece, data)
+		if i == 1 {
+			piece = data
+		}
+		hash := sha1.Sum(piece)
+		if pieces[i*sha1.Size:(i+1)*sha1.Size] != string(hash[:]) {
+			t.Fatal("Wrong piece hash:", i)
+		}
+	}
+}
@@ -0,0 +1,661 @@
+package gotrnt
+
+import (
+	"crypto/rand"
+	"crypto/sha1"
+	"io"
+	"log"
+	"net"
+	"os"
+	"sort"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Number of queries in flight at a time during a lookup
+const DhtLookupAlpha = 3
+
+// Max number of peers that we store for an infohash, and send in a reply
+const DhtMaxPeers = 100
+
+// Max number of infohashes that we store peers for. Once full, infohash that
+// was announced least recently is dropped for a new one.
+const DhtMaxInfoHashes = 1000
+
+// Peers announced to us are forgotten after this long
+const DhtPeerExpiry = 30 * time.Minute
+
+// Tokens are valid for two rotations
+const DhtTokenRotation = 5 * time.Minute
+
+// Mainline DHT node (BEP 5). Answers queries from other nodes, and finds
+// peers of torrents by looking up nodes closest to their infohash.
+type DhtNode struct {
+	Addr         *net.UDPAddr  // Address to listen on
+	Bootstrap    []string      // host:port of nodes that we join DHT through
+	NodesFile    string        // Routing table is saved here between runs, not saved if empty
+	Timeout      time.Duration // Timeout for a query to a node
+	DebugOutput  io.Writer     // Debug output goes here, stdout if nil
+	MyId         string        // Our node id, raw 20 bytes
+	conn         *net.UDPConn
+	routingTable DhtRoutingTable
+	pending      map[string]dhtPendingQuery      // Transaction id -> query waiting for reply
+	pendingMutex sync.Mutex                      // Guards pending
+	nextTid      uint32                          // Next transaction id, updated atomically
+	peerStore    map[string]map[string]time.Time // Infohash -> peer ip:port -> when announced
+	secrets      [2]string                       // Current and previous token secrets
+	mutex        sync.Mutex                      // Guards peerStore and secrets
+	running      int32                           // Set while node is running, updated atomically
+	quit         chan bool                       // Closed to stop node
+}
+
+// A query waiting for reply, only the node that was queried may reply
+type dhtPendingQuery struct {
+	addr      *net.UDPAddr                // Node that was queried
+	replyChan chan map[string]interface{} // Gets reply dictionary, nil on error reply
+}
+
+// A node found during a lookup
+type dhtLookupNode struct {
+	nodeInfo DhtNodeInfo // Node
+	token    string      // Token got from node, needed to announce to it
+	queried  bool        // Node was queried
+	replied  bool        // Node replied to query
+}
+
+// Start DHT node, and join DHT through nodes saved in last run or through
+// bootstrap nodes
+func (dhtNode *DhtNode) Start() bool {
+	var er error
+	if dhtNode.conn, er = net.ListenUDP("udp", dhtNode.Addr); er != nil {
+		log.Println(DebugGetFuncName(), er)
+		return false
+	}
+	debugPrintln(dhtNode.DebugOutput, DebugGetFuncName(), "DHT node:", dhtNode.conn.LocalAddr())
+
+	dhtNode.pending = make(map[string]dhtPendingQuery)
+	dhtNode.peerStore = make(map[string]map[string]time.Time)
+	dhtNode.secrets[0] = getDhtRandomId()
+	dhtNode.secrets[1] = dhtNode.secrets[0]
+	if !dhtNode.loadNodes() {
+		dhtNode.MyId = getDhtRandomId()
+		dhtNode.routingTable.Init(dhtNode.MyId)
+	}
+	dhtNode.quit = make(chan bool)
+	atomic.StoreInt32(&dhtNode.running, 1)
+	go dhtNode.recvLoop()
+	go dhtNode.maintain(dhtNode.quit)
+	return true
+}
+
+// Stop DHT node, routing table is saved for next run
+func (dhtNode *DhtNode) Stop() bool {
+	if !dhtNode.IsRunning() {
+		return false
+	}
+	atomic.StoreInt32(&dhtNode.running, 0)
+	close(dhtNode.quit)
+	dhtNode.conn.Close()
+	dhtNode.saveNodes()
+	return true
+}
+
+// Check if DHT node is running
+func (dhtNode *DhtNode) IsRunning() bool {
+	return atomic.LoadInt32(&dhtNode.running) == 1
+}
+
+// Get UDP port that DHT node listens on
+func (dhtNode *DhtNode) getPort() uint16 {
+	return uint16(dhtNode.conn.LocalAddr().(*net.UDPAddr).Port)
+}
+
+// Number of nodes in routing table
+func (dhtNode *DhtNode) NumNodes() int {
+	return dhtNode.routingTable.Len()
+}
+
+// Find peers of a torrent
+func (dhtNode *DhtNode) GetPeers(infoHash string) []string {
+	peers, _ := dhtNode.lookup(infoHash, "get_peers")
+	return peers
+}
+
+// Find peers of a torrent, and announce to nodes closest to its infohash
+// that we're a peer too. Returns peers found.
+func (dhtNode *DhtNode) Announce(infoHash string, port uint16) []string {
+	peers, closest := dhtNode.lookup(infoHash, "get_peers")
+	var wg sync.WaitGroup
+	for _, val := range closest {
+		if len(val.token) == 0 {
+			continue
+		}
+		args := make(map[string]interface{})
+		args["info_hash"] = infoHash
+		args["port"] = int64(port)
+		args["token"] = val.token
+		wg.Add(1)
+		go func(addr *net.UDPAddr) {
+			defer wg.Done()
+			dhtNode.query(addr, "announce_peer", args)
+		}(val.nodeInfo.Addr)
+	}
+	wg.Wait()
+	return peers
+}
+
+// Ping a node, it gets into routing table if it replies
+func (dhtNode *DhtNode) Ping(addr *net.UDPAddr) bool {
+	_, ok := dhtNode.query(addr, "ping", make(map[string]interface{}))
+	return ok
+}
+
+// Look up peers of a session and announce to DHT periodically, till quit
+// is closed
+func (dhtNode *DhtNode) announceSession(sessionInfo *TrntSessionInfo, quit chan bool) {
+	for {
+		peers := dhtNode.Announce(sessionInfo.metaInfo.InfoHash, sessionInfo.cfg.Port)
+		debugPrintln(dhtNode.DebugOutput, DebugGetFuncName(), "DHT peers:", len(peers))
+		sessionInfo.peerMgr.AddPeers(sessionInfo, peers)
+		select {
+		case <-time.After(sessionInfo.cfg.DhtInterval):
+		case <-quit:
+			return
+		}
+	}
+}
+
+// Iterative lookup of nodes closest to target. Closest nodes that aren't
+// queried yet are queried, a few at a time, till the closest nodes have all
+// been queried. For get_peers, peers that nodes send are collected too.
+// Returns peers, and closest nodes that replied.
+func (dhtNode *DhtNode) lookup(target string, method string) ([]string, []dhtLookupNode) {
+	var nodes []*dhtLookupNode
+	seen := make(map[string]bool)
+	addNode := func(nodeInfo DhtNodeInfo) {
+		if seen[nodeInfo.Addr.String()] || (nodeInfo.Id == dhtNode.MyId) {
+			return
+		}
+		seen[nodeInfo.Addr.String()] = true
+		lookupNode := new(dhtLookupNode)
+		lookupNode.nodeInfo = nodeInfo
+		nodes = append(nodes, lookupNode)
+	}
+	for _, val := range dhtNode.routingTable.Closest(target, DhtBucketSize) {
+		addNode(val)
+	}
+
+	peerSet := make(map[string]bool)
+	var peers []string
+	for {
+		// Closest nodes yet to be queried
+		sort.Slice(nodes, func(i, j int) bool {
+			return isDhtCloser(target, nodes[i].nodeInfo.Id, nodes[j].nodeInfo.Id)
+		})
+		var toQuery []*dhtLookupNode
+		for i := 0; (i < len(nodes)) && (i < DhtBucketSize); i++ {
+			if !nodes[i].queried && (len(toQuery) < DhtLookupAlpha) {
+				nodes[i].queried = true
+				toQuery = append(toQuery, nodes[i])
+			}
+		}
+		if len(toQuery) == 0 {
+			break
+		}
+
+		// Query them in parallel
+		replies := make([]map[string]interface{}, len(toQuery))
+		var wg sync.WaitGroup
+		for i, val := range toQuery {
+			args := make(map[string]interface{})
+			if method == "get_peers" {
+				args["info_hash"] = target
+			} else {
+				args["target"] = target
+			}
+			wg.Add(1)
+			go func(i int, addr *net.UDPAddr) {
+				defer wg.Done()
+				replies[i], _ = dhtNode.query(addr, method, args)
+			}(i, val.nodeInfo.Addr)
+		}
+		wg.Wait()
+
+		for i, reply := range replies {
+			if reply == nil {
+				continue
+			}
+			toQuery[i].replied = true
+			toQuery[i].token, _ = reply["token"].(string)
+			nodeInfoList, _ := reply["nodes"].(string)
+			for _, val := range parseDhtCompactNodes(nodeInfoList) {
+				addNode(val)
+			}
+			values, _ := reply["values"].([]interface{})
+			for _, val := range values {
+				compactPeer, _ := val.(string)
+				for _, peer := range parseCompactPeers(compactPeer, net.IPv4len) {
+					if !peerSet[peer] {
+						peerSet[peer] = true
+						peers = append(peers, peer)
+					}
+				}
+			}
+		}
+	}
+
+	var closest []dhtLookupNode
+	for _, val := range nodes {
+		if val.replied && (len(closest) < DhtBucketSize) {
+			closest = append(closest, *val)
+		}
+	}
+	return peers, closest
+}
+
+// Send a query to a node and wait for its reply. Returns reply dictionary.
+func (dhtNode *DhtNode) query(addr *net.UDPAddr, method string,
+	args map[string]interface{}) (map[string]interface{}, bool) {
+	if !dhtNode.IsRunning() {
+		return nil, false
+	}
+	tid := string(getBytesFromUint32(atomic.AddUint32(&dhtNode.nextTid, 1)))
+	args["id"] = dhtNode.MyId
+	msg := make(map[string]interface{})
+	msg["t"] = tid
+	msg["y"] = "q"
+	msg["q"] = method
+	msg["a"] = args
+	buf, ok := encodeBencode(msg)
+	if !ok {
+		return nil, false
+	}
+
+	replyChan := make(chan map[string]interface{}, 1)
+	dhtNode.pendingMutex.Lock()
+	dhtNode.pending[tid] = dhtPendingQuery{addr: addr, replyChan: replyChan}
+	dhtNode.pendingMutex.Unlock()
+	defer func() {
+		dhtNode.pendingMutex.Lock()
+		delete(dhtNode.pending, tid)
+		dhtNode.pendingMutex.Unlock()
+	}()
+
+	if _, er := dhtNode.conn.WriteToUDP(buf, addr); er != nil {
+		log.Println(DebugGetFuncName(), er)
+		return nil, false
+	}
+	select {
+	case reply := <-replyChan:
+		return reply, reply != nil
+	case <-time.After(dhtNode.Timeout):
+		dhtNode.routingTable.Failed(addr)
+		return nil, false
+	}
+}
+
+// Receive queries and replies from other nodes, till node is stopped
+func (dhtNode *DhtNode) recvLoop() {
+	buf := make([]byte, 2048)
+	for {
+		bytesRead, addr, er := dhtNode.conn.ReadFromUDP(buf)
+		if er != nil {
+			if dhtNode.IsRunning() {
+				log.Println(DebugGetFuncName(), er)
+				continue
+			}
+			return
+		}
+		msg, ok := decodeBencodeDict(buf[:bytesRead])
+		if !ok {
+			continue
+		}
+		tid, _ := msg["t"].(string)
+		msgType, _ := msg["y"].(string)
+		switch msgType {
+		case "q":
+			dhtNode.processQuery(addr, tid, msg)
+
+		case "r", "e":
+			dhtNode.pendingMutex.Lock()
+			pendingQuery, ok := dhtNode.pending[tid]
+			dhtNode.pendingMutex.Unlock()
+			if !ok || !pendingQuery.addr.IP.Equal(addr.IP) ||
+				(pendingQuery.addr.Port != addr.Port) {
+				continue
+			}
+			reply, _ := msg["r"].(map[string]interface{})
+			if nodeId, _ := reply["id"].(string); len(nodeId) == sha1.Size {
+				dhtNode.routingTable.Update(nodeId, addr, time.Now())
+			} else {
+				reply = nil
+			}
+			select {
+			case pendingQuery.replyChan <- reply:
+			default:
+			}
+		}
+	}
+}
+
+// Reply to a query from another node
+func (dhtNode *DhtNode) processQuery(addr *net.UDPAddr, tid string,
+	msg map[string]interface{}) {
+	method, _ := msg["q"].(string)
+	args, _ := msg["a"].(map[string]interface{})
+	nodeId, _ := args["id"].(string)
+	if len(nodeId) != sha1.Size {
+		dhtNode.sendError(addr, tid, 203, "Invalid id")
+		return
+	}
+	dhtNode.routingTable.Update(nodeId, addr, time.Now())
+
+	reply := make(map[string]interface{})
+	reply["id"] = dhtNode.MyId
+	switch method {
+	case "ping":
+
+	case "find_node":
+		target, _ := args["target"].(string)
+		if len(target) != sha1.Size {
+			dhtNode.sendError(addr, tid, 203, "Invalid target")
+			return
+		}
+		reply["nodes"] = dhtNode.getCompactNodes(target)
+
+	case "get_peers":
+		infoHash, _ := args["info_hash"].(string)
+		if len(infoHash) != sha1.Size {
+			dhtNode.sendError(addr, tid, 203, "Invalid info_hash")
+			return
+		}
+		reply["token"] = dhtNode.makeToken(addr.IP, 0)
+		if values := dhtNode.getStoredPeers(infoHash); len(values) > 0 {
+			reply["values"] = values
+		} else {
+			reply["nodes"] = dhtNode.getCompactNodes(infoHash)
+		}
+
+	case "announce_peer":
+		infoHash, _ := args["info_hash"].(string)
+		token, _ := args["token"].(string)
+		port, _ := args["port"].(int64)
+		if impliedPort, _ := args["implied_port"].(int64); impliedPort != 0 {
+			port = int64(addr.Port)
+		}
+		if (len(infoHash) != sha1.Size) || (port <= 0) || (port > 0xffff) {
+			dhtNode.sendError(addr, tid, 203, "Invalid announce")
+			return
+		}
+		if !dhtNode.isValidToken(addr.IP, token) {
+			dhtNode.sendError(addr, tid, 203, "Invalid token")
+			return
+		}
+		dhtNode.storePeer(infoHash, net.JoinHostPort(addr.IP.String(),
+			strconv.Itoa(int(port))))
+
+	default:
+		dhtNode.sendError(addr, tid, 204, "Method unknown")
+		return
+	}
+
+	resp := make(map[string]interface{})
+	resp["t"] = tid
+	resp["y"] = "r"
+	resp["r"] = reply
+	dhtNode.send(addr, resp)
+}
+
+// Send an error reply to a query
+func (dhtNode *DhtNode) sendError(addr *net.UDPAddr, tid string, code int64, errMsg string) {
+	resp := make(map[string]interface{})
+	resp["t"] = tid
+	resp["y"] = "e"
+	resp["e"] = []interface{}{code, errMsg}
+	dhtNode.send(addr, resp)
+}
+
+// Send a bencoded msg to a node
+func (dhtNode *DhtNode) send(addr *net.UDPAddr, msg map[string]interface{}) bool {
+	buf, ok := encodeBencode(msg)
+	if !ok {
+		return false
+	}
+	if _, er := dhtNode.conn.WriteToUDP(buf, addr); er != nil {
+		log.Println(DebugGetFuncName(), er)
+		return false
+	}
+	return true
+}
+
+// Rotate token secrets, forget old peers, refresh routing table and save it,
+// periodically till quit is closed
+func (dhtNode *DhtNode) maintain(quit chan bool) {
+	dhtNode.bootstrap()
+	ticker := time.NewTicker(DhtTokenRotation)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			dhtNode.mutex.Lock()
+			dhtNode.secrets[1] = dhtNode.secrets[0]
+			dhtNode.secrets[0] = getDhtRandomId()
+			for infoHash, peers := range dhtNode.peerStore {
+				for peer, announcedAt := range peers {
+					if time.Since(announcedAt) > DhtPeerExpiry {
+						delete(peers, peer)
+					}
+				}
+				if len(peers) == 0 {
+					delete(dhtNode.peerStore, infoHash)
+				}
+			}
+			dhtNode.mutex.Unlock()
+			dhtNode.bootstrap()
+			dhtNode.saveNodes()
+		case <-quit:
+			return
+		}
+	}
+}
+
+// Fill routing table by looking up our own id. Bootstrap nodes are asked
+// first if routing table is nearly empty.
+func (dhtNode *DhtNode) bootstrap() {
+	if dhtNode.routingTable.Len() < DhtBucketSize {
+		var wg sync.WaitGroup
+		for _, val := range dhtNode.Bootstrap {
+			addr, er := net.ResolveUDPAddr("udp", val)
+			if er != nil {
+				log.Println(DebugGetFuncName(), er)
+				continue
+			}
+			args := make(map[string]interface{})
+			args["target"] = dhtNode.MyId
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				if reply, ok := dhtNode.query(addr, "find_node", args); ok {
+					nodeInfoList, _ := reply["nodes"].(string)
+					for _, nodeInfo := range parseDhtCompactNodes(nodeInfoList) {
+						go dhtNode.Ping(nodeInfo.Addr)
+					}
+				}
+			}()
+		}
+		wg.Wait()
+	}
+	dhtNode.lookup(dhtNode.MyId, "find_node")
+	debugPrintln(dhtNode.DebugOutput,
+		DebugGetFuncName(), "DHT nodes:", dhtNode.routingTable.Len())
+}
+
+// Get compact node info of nodes closest to target
+func (dhtNode *DhtNode) getCompactNodes(target string) string {
+	var buf []byte
+	for _, val := range dhtNode.routingTable.Closest(target, DhtBucketSize) {
+		if compactNode, ok := getDhtCompactNode(val); ok {
+			buf = append(buf, compactNode...)
+		}
+	}
+	return string(buf)
+}
+
+// Make a token for an IP address, from current or previous secret
+func (dhtNode *DhtNode) makeToken(ip net.IP, secretIdx int) string {
+	dhtNode.mutex.Lock()
+	secret := dhtNode.secrets[secretIdx]
+	dhtNode.mutex.Unlock()
+	hash := sha1.Sum(append([]byte(secret), ip...))
+	return string(hash[0:8])
+}
+
+// Check a token got in announce_peer, tokens made from previous secret are
+// still valid
+func (dhtNode *DhtNode) isValidToken(ip net.IP, token string) bool {
+	return (token == dhtNode.makeToken(ip, 0)) || (token == dhtNode.makeToken(ip, 1))
+}
+
+// Remember a peer announced for an infohash
+func (dhtNode *DhtNode) storePeer(infoHash string, peerIpPort string) {
+	dhtNode.mutex.Lock()
+	defer dhtNode.mutex.Unlock()
+	peers, ok := dhtNode.peerStore[infoHash]
+	if !ok {
+		if len(dhtNode.peerStore) >= DhtMaxInfoHashes {
+			dhtNode.dropOldestInfoHash()
+		}
+		peers = make(map[string]time.Time)
+		dhtNode.peerStore[infoHash] = peers
+	}
+	if _, ok := peers[peerIpPort]; ok || (len(peers) < DhtMaxPeers) {
+		peers[peerIpPort] = time.Now()
+	}
+}
+
+// Drop stored peers of infohash that was announced least recently, caller
+// holds lock
+func (dhtNode *DhtNode) dropOldestInfoHash() {
+	var oldestInfoHash string
+	var oldestAt time.Time
+	for infoHash, peers := range dhtNode.peerStore {
+		var lastAt time.Time
+		for _, announcedAt := range peers {
+			if announcedAt.After(lastAt) {
+				lastAt = announcedAt
+			}
+		}
+		if (len(oldestInfoHash) == 0) || lastAt.Before(oldestAt) {
+			oldestInfoHash = infoHash
+			oldestAt = lastAt
+		}
+	}
+	delete(dhtNode.peerStore, oldestInfoHash)
+}
+
+// Get peers announced for an infohash, as compact peer strings
+func (dhtNode *DhtNode) getStoredPeers(infoHash string) []interface{} {
+	dhtNode.mutex.Lock()
+	defer dhtNode.mutex.Unlock()
+	var values []interface{}
+	for peerIpPort := range dhtNode.peerStore[infoHash] {
+		if compactPeer, ok := getCompactPeer(peerIpPort); ok {
+			values = append(values, string(compactPeer))
+		}
+	}
+	return values
+}
+
+// Save our id and routing table nodes to nodes file
+func (dhtNode *DhtNode) saveNodes() bool {
+	if len(dhtNode.NodesFile) == 0 {
+		return false
+	}
+	var nodeInfoList []byte
+	for _, val := range dhtNode.routingTable.Nodes() {
+		if compactNode, ok := getDhtCompactNode(val); ok {
+			nodeInfoList = append(nodeInfoList, compactNode...)
+		}
+	}
+	dict := make(map[string]interface{})
+	dict["id"] = dhtNode.MyId
+	dict["nodes"] = string(nodeInfoList)
+	buf, ok := encodeBencode(dict)
+	if !ok {
+		return false
+	}
+	if er := os.WriteFile(dhtNode.NodesFile, buf, 0644); er != nil {
+		log.Println(DebugGetFuncName(), er)
+		return false
+	}
+	return true
+}
+
+// Load our id and routing table nodes from nodes file. Nodes are taken as
+// not seen in a while, so they're replaced by ones that are alive.
+func (dhtNode *DhtNode) loadNodes() bool {
+	if len(dhtNode.NodesFile) == 0 {
+		return false
+	}
+	buf, er := os.ReadFile(dhtNode.NodesFile)
+	if er != nil {
+		return false
+	}
+	dict, ok := decodeBencodeDict(buf)
+	if !ok {
+		return false
+	}
+	myId, _ := dict["id"].(string)
+	if len(myId) != sha1.Size {
+		return false
+	}
+	dhtNode.MyId = myId
+	dhtNode.routingTable.Init(myId)
+	nodeInfoList, _ := dict["nodes"].(string)
+	for _, val := range parseDhtCompactNodes(nodeInfoList) {
+		dhtNode.routingTable.Update(val.Id, val.Addr, time.Time{})
+	}
+	debugPrintln(dhtNode.DebugOutput,
+		DebugGetFuncName(), "Loaded DHT nodes:", dhtNode.routingTable.Len())
+	return true
+}
+
+// Get compact node info, node id followed by compact IPv4 address and port
+func getDhtCompactNode(nodeInfo DhtNodeInfo) ([]byte, bool) {
+	ip := nodeInfo.Addr.IP.To4()
+	if ip == nil {
+		return nil, false
+	}
+	compactNode := make([]byte, 0, sha1.Size+net.IPv4len+2)
+	compactNode = append(compactNode, nodeInfo.Id...)
+	compactNode = append(compactNode, ip...)
+	return append(compactNode, getBytesFromUint16(uint16(nodeInfo.Addr.Port))...), true
+}
+
+// Get nodes from a list of compact node info
+func parseDhtCompactNodes(nodeInfoList string) []DhtNodeInfo {
+	var nodes []DhtNodeInfo
+	entryLen := sha1.Size + net.IPv4len + 2
+	for i := 0; i+entryLen <= len(nodeInfoList); i += entryLen {
+		var nodeInfo DhtNodeInfo
+		nodeInfo.Id = nodeInfoList[i : i+sha1.Size]
+		addr := new(net.UDPAddr)
+		addr.IP = net.IP([]byte(nodeInfoList[i+sha1.Size : i+sha1.Size+net.IPv4len]))
+		addr.Port = int(getUint16FromBytes([]byte(nodeInfoList[i+sha1.Size+net.IPv4len : i+entryLen])))
+		if addr.Port == 0 {
+			continue
+		}
+		nodeInfo.Addr = addr
+		nodes = append(nodes, nodeInfo)
+	}
+	return nodes
+}
+
+// Generate a random 20 byte id
+func getDhtRandomId() string {
+	buf := make([]byte, sha1.Size)
+	rand.Read(buf)
+	return string(buf)
+}
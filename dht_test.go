@@ -0,0 +1,127 @@
+package gotrnt
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Start DHT nodes on loopback, all of them joining DHT through first node
+func startDhtSwarm(t *testing.T, numNodes int) []*DhtNode {
+	addr, _ := net.ResolveUDPAddr("udp", "127.0.0.1:0")
+	nodes := make([]*DhtNode, numNodes)
+	for i := range nodes {
+		nodes[i] = new(DhtNode)
+		nodes[i].Addr = addr
+		nodes[i].Timeout = 500 * time.Millisecond
+		if i > 0 {
+			nodes[i].Bootstrap = []string{nodes[0].conn.LocalAddr().String()}
+		}
+		if !nodes[i].Start() {
+			t.Fatal("Failed to start DHT node:", i)
+		}
+		node := nodes[i]
+		t.Cleanup(func() { node.Stop() })
+	}
+
+	// Nodes that joined early learn about the ones that joined later
+	for _, val := range nodes[1:] {
+		val.bootstrap()
+	}
+	return nodes
+}
+
+func TestDhtAnnounceGetPeers(t *testing.T) {
+	nodes := startDhtSwarm(t, 16)
+	for i, val := range nodes {
+		if val.NumNodes() == 0 {
+			t.Fatal("Empty routing table, node:", i)
+		}
+	}
+
+	infoHash := getDhtRandomId()
+	if peers := nodes[5].Announce(infoHash, 7777); len(peers) != 0 {
+		t.Fatal("Peers before announce:", peers)
+	}
+	peers := nodes[12].GetPeers(infoHash)
+	if (len(peers) != 1) || (peers[0] != "127.0.0.1:7777") {
+		t.Fatal("Announced peer not found:", peers)
+	}
+	if peers := nodes[12].GetPeers(getDhtRandomId()); len(peers) != 0 {
+		t.Fatal("Peers of unknown infohash:", peers)
+	}
+}
+
+func TestDhtReplyFromOtherAddr(t *testing.T) {
+	nodes := startDhtSwarm(t, 1)
+	addr, _ := net.ResolveUDPAddr("udp", "127.0.0.1:0")
+	queried, er := net.ListenUDP("udp", addr)
+	if er != nil {
+		t.Fatal(er)
+	}
+	defer queried.Close()
+	other, er := net.ListenUDP("udp", addr)
+	if er != nil {
+		t.Fatal(er)
+	}
+	defer other.Close()
+
+	// Another host replies first with transaction id of query, then the
+	// queried node replies
+	queriedId := getDhtRandomId()
+	go func() {
+		buf := make([]byte, 2048)
+		bytesRead, nodeAddr, er := queried.ReadFromUDP(buf)
+		if er != nil {
+			return
+		}
+		msg, _ := decodeBencodeDict(buf[:bytesRead])
+		reply := func(conn *net.UDPConn, nodeId string) {
+			resp := map[string]interface{}{"t": msg["t"], "y": "r",
+				"r": map[string]interface{}{"id": nodeId}}
+			if buf, ok := encodeBencode(resp); ok {
+				conn.WriteToUDP(buf, nodeAddr)
+			}
+		}
+		reply(other, getDhtRandomId())
+		time.Sleep(100 * time.Millisecond)
+		reply(queried, queriedId)
+	}()
+
+	reply, ok := nodes[0].query(queried.LocalAddr().(*net.UDPAddr), "ping",
+		make(map[string]interface{}))
+	if !ok {
+		t.Fatal("No reply")
+	}
+	if nodeId, _ := reply["id"].(string); nodeId != queriedId {
+		t.Fatal("Took reply from another host")
+	}
+}
+
+func TestDhtStoreDropsOldestInfoHash(t *testing.T) {
+	var dhtNode DhtNode
+	dhtNode.peerStore = make(map[string]map[string]time.Time)
+	longAgo := time.Now().Add(-time.Hour)
+	for i := 0; i < DhtMaxInfoHashes; i++ {
+		infoHash := fmt.Sprintf("%020d", i)
+		dhtNode.peerStore[infoHash] = map[string]time.Time{
+			"127.0.0.1:1000": longAgo.Add(time.Duration(i) * time.Second)}
+	}
+	// First infohash is announced again, so second one is the oldest
+	dhtNode.storePeer(fmt.Sprintf("%020d", 0), "127.0.0.1:2000")
+	dhtNode.storePeer(strings.Repeat("a", 20), "127.0.0.1:1000")
+
+	if len(dhtNode.peerStore) != DhtMaxInfoHashes {
+		t.Fatal("Wrong number of infohashes:", len(dhtNode.peerStore))
+	}
+	for i, want := range []bool{true, false, true} {
+		if _, ok := dhtNode.peerStore[fmt.Sprintf("%020d", i)]; ok != want {
+			t.Fatal("Wrong infohash dropped, infohash:", i, ", kept:", ok)
+		}
+	}
+	if _, ok := dhtNode.peerStore[strings.Repeat("a", 20)]; !ok {
+		t.Fatal("New infohash not stored")
+	}
+}
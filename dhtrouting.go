@@ -0,0 +1,172 @@
+package gotrnt
+
+import (
+	"net"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Number of nodes in a k-bucket
+const DhtBucketSize = 8
+
+// Node is dropped from routing table after these many failed queries
+const DhtMaxFails = 3
+
+// Node that hasn't been heard from in this long may be replaced by a new one
+const DhtStaleTime = 15 * time.Minute
+
+// A DHT node, as known to us
+type DhtNodeInfo struct {
+	Id       string       // Node id, raw 20 bytes
+	Addr     *net.UDPAddr // Node address
+	LastSeen time.Time    // When node last replied to or queried us
+	Fails    int          // Number of queries to node that failed in a row
+}
+
+// Kademlia routing table. Bucket i holds nodes whose id shares first i bits
+// with our id, so buckets near our id are the ones that fill up.
+type DhtRoutingTable struct {
+	myId    string              // Our node id
+	buckets [160][]*DhtNodeInfo // k-buckets, least recently seen node first
+	mutex   sync.Mutex          // Guards buckets
+}
+
+// Init routing table, with our node id
+func (routingTable *DhtRoutingTable) Init(myId string) {
+	routingTable.mutex.Lock()
+	defer routingTable.mutex.Unlock()
+	routingTable.myId = myId
+	for i := range routingTable.buckets {
+		routingTable.buckets[i] = nil
+	}
+}
+
+// Add a node that replied to or queried us, or mark it as seen now if we
+// already know it. If node's bucket is full, a failing or stale node makes
+// way for it; otherwise it isn't added.
+func (routingTable *DhtRoutingTable) Update(nodeId string, addr *net.UDPAddr,
+	lastSeen time.Time) {
+	routingTable.mutex.Lock()
+	defer routingTable.mutex.Unlock()
+	bucketIdx := getDhtBucketIndex(routingTable.myId, nodeId)
+	if bucketIdx < 0 {
+		return
+	}
+	bucket := routingTable.buckets[bucketIdx]
+	for i, val := range bucket {
+		if val.Id == nodeId {
+			// Move to end of bucket, as most recently seen
+			val.Addr = addr
+			val.LastSeen = lastSeen
+			val.Fails = 0
+			copy(bucket[i:], bucket[i+1:])
+			bucket[len(bucket)-1] = val
+			return
+		}
+	}
+
+	nodeInfo := new(DhtNodeInfo)
+	nodeInfo.Id = nodeId
+	nodeInfo.Addr = addr
+	nodeInfo.LastSeen = lastSeen
+	if len(bucket) < DhtBucketSize {
+		routingTable.buckets[bucketIdx] = append(bucket, nodeInfo)
+		return
+	}
+	for i, val := range bucket {
+		if (val.Fails > 0) || (time.Since(val.LastSeen) > DhtStaleTime) {
+			copy(bucket[i:], bucket[i+1:])
+			bucket[len(bucket)-1] = nodeInfo
+			return
+		}
+	}
+}
+
+// Note that a query to node at given address failed, node is dropped once
+// it fails too often
+func (routingTable *DhtRoutingTable) Failed(addr *net.UDPAddr) {
+	routingTable.mutex.Lock()
+	defer routingTable.mutex.Unlock()
+	for bucketIdx, bucket := range routingTable.buckets {
+		for i, val := range bucket {
+			if val.Addr.String() != addr.String() {
+				continue
+			}
+			val.Fails++
+			if val.Fails >= DhtMaxFails {
+				routingTable.buckets[bucketIdx] = append(bucket[:i], bucket[i+1:]...)
+			}
+			return
+		}
+	}
+}
+
+// Get upto count nodes closest to target id
+func (routingTable *DhtRoutingTable) Closest(target string, count int) []DhtNodeInfo {
+	nodes := routingTable.Nodes()
+	sort.Slice(nodes, func(i, j int) bool {
+		return isDhtCloser(target, nodes[i].Id, nodes[j].Id)
+	})
+	if len(nodes) > count {
+		nodes = nodes[:count]
+	}
+	return nodes
+}
+
+// Get a copy of all nodes in routing table
+func (routingTable *DhtRoutingTable) Nodes() []DhtNodeInfo {
+	routingTable.mutex.Lock()
+	defer routingTable.mutex.Unlock()
+	var nodes []DhtNodeInfo
+	for _, bucket := range routingTable.buckets {
+		for _, val := range bucket {
+			nodes = append(nodes, *val)
+		}
+	}
+	return nodes
+}
+
+// Number of nodes in routing table
+func (routingTable *DhtRoutingTable) Len() int {
+	routingTable.mutex.Lock()
+	defer routingTable.mutex.Unlock()
+	numNodes := 0
+	for _, bucket := range routingTable.buckets {
+		numNodes += len(bucket)
+	}
+	return numNodes
+}
+
+// Get index of bucket for a node id, which is the number of leading bits
+// that it shares with our id. Returns -1 for our own id.
+func getDhtBucketIndex(myId, nodeId string) int {
+	if (len(myId) != len(nodeId)) || (myId == nodeId) {
+		return -1
+	}
+	for i := 0; i < len(myId); i++ {
+		xor := myId[i] ^ nodeId[i]
+		if xor == 0 {
+			continue
+		}
+		bitIdx := 0
+		for (xor & 0x80) == 0 {
+			xor <<= 1
+			bitIdx++
+		}
+		return (i * 8) + bitIdx
+	}
+	return -1
+}
+
+// Check if node id a is closer to target than node id b, as per XOR metric
+func isDhtCloser(target, a, b string) bool {
+	for i := 0; i < len(target); i++ {
+		distA := target[i] ^ a[i]
+		distB := target[i] ^ b[i]
+		if distA != distB {
+			return distA < distB
+		}
+	}
+	return false
+}
@@ -0,0 +1,206 @@
+package gotrnt
+
+import (
+	"log"
+	"net"
+)
+
+// Extension protocol (BEP 10) msg id, and id of extended handshake
+const (
+	MsgTypeExtended = 20 // Extended msg, payload starts with extended msg id
+	ExtMsgHandshake = 0  // Extended handshake
+)
+
+// Client name sent in extended handshake
+const GoTrntClientName = "gotrnt 0.1"
+
+// Processes an extended msg from peer, payload is what follows extended
+// msg id. Returns false if msg is invalid.
+type ExtensionHandler func(sessionInfo *TrntSessionInfo, peerInfo *PeerInfo,
+	payload []byte) bool
+
+// An extension that we support
+type Extension struct {
+	Name       string           // Extension name, as in m dictionary of extended handshake
+	Id         uint8            // Our msg id for this extension
+	Handler    ExtensionHandler // Processes msgs of this extension
+	PublicOnly bool             // Extension is turned off for private torrents
+}
+
+// Register an extension with client, its msgs from peers of all torrents
+// are handed over to handler. Returns msg id assigned to extension, or 0 if
+// it can't be registered.
+func (client *Client) RegisterExtension(name string, handler ExtensionHandler) uint8 {
+	return client.registerExtension(name, handler, false)
+}
+
+// Register an extension that mustn't be used for private torrents, such as
+// the ones that get us peers from elsewhere than tracker
+func (client *Client) RegisterPublicExtension(name string, handler ExtensionHandler) uint8 {
+	return client.registerExtension(name, handler, true)
+}
+
+func (client *Client) registerExtension(name string, handler ExtensionHandler,
+	publicOnly bool) uint8 {
+	// Sanity checks
+	if (len(name) == 0) || (handler == nil) {
+		log.Println(DebugGetFuncName(), "Invalid param")
+		return 0
+	}
+
+	client.extMutex.Lock()
+	defer client.extMutex.Unlock()
+	for _, val := range client.extensions {
+		if val.Name == name {
+			log.Println(DebugGetFuncName(), "Already registered:", name)
+			return 0
+		}
+	}
+	if len(client.extensions) >= 0xff {
+		log.Println(DebugGetFuncName(), "Too many extensions")
+		return 0
+	}
+	var extension Extension
+	extension.Name = name
+	extension.Id = uint8(len(client.extensions) + 1)
+	extension.Handler = handler
+	extension.PublicOnly = publicOnly
+	client.extensions = append(client.extensions, extension)
+	return extension.Id
+}
+
+// Find extension having given msg id
+func (client *Client) findExtension(extMsgId uint8) (Extension, bool) {
+	client.extMutex.RLock()
+	defer client.extMutex.RUnlock()
+	if (extMsgId == ExtMsgHandshake) || (int(extMsgId) > len(client.extensions)) {
+		return Extension{}, false
+	}
+	return client.extensions[extMsgId-1], true
+}
+
+// Send extended handshake, telling peer the extensions that we support
+// along with some info about us
+func (peerInfo *PeerInfo) sendExtHandshake(sessionInfo *TrntSessionInfo) bool {
+	extMap := make(map[string]interface{})
+	client := sessionInfo.client
+	client.extMutex.RLock()
+	for _, val := range client.extensions {
+		if !val.PublicOnly || !sessionInfo.isPrivate() {
+			extMap[val.Name] = int64(val.Id)
+		}
+	}
+	client.extMutex.RUnlock()
+
+	dict := make(map[string]interface{})
+	dict["m"] = extMap
+	dict["v"] = GoTrntClientName
+	dict["p"] = int64(sessionInfo.cfg.Port)
+	dict["reqq"] = int64(sessionInfo.cfg.MaxUploadQueue)
+	if tcpAddr := peerInfo.getTcpAddr(); tcpAddr != nil {
+		if ip := tcpAddr.IP.To4(); ip != nil {
+			dict["yourip"] = string(ip)
+		} else {
+			dict["yourip"] = string(tcpAddr.IP)
+		}
+	}
+	if infoBytes := sessionInfo.metadata.getInfoBytes(); infoBytes != nil {
+		dict["metadata_size"] = int64(len(infoBytes))
+	}
+	payload, ok := encodeBencode(dict)
+	if !ok {
+		return false
+	}
+	return peerInfo.sendExtMsg(ExtMsgHandshake, payload)
+}
+
+// Process an extended msg from peer, payload starts with extended msg id
+func (peerInfo *PeerInfo) processExtMsg(sessionInfo *TrntSessionInfo,
+	payload []byte) bool {
+	// Sanity checks
+	if len(payload) == 0 {
+		return false
+	}
+
+	if payload[0] == ExtMsgHandshake {
+		return peerInfo.processExtHandshake(sessionInfo, payload[1:])
+	}
+	extension, ok := sessionInfo.client.findExtension(payload[0])
+	if !ok || (extension.PublicOnly && sessionInfo.isPrivate()) {
+		debugPrintln(sessionInfo.cfg.DebugOutput,
+			DebugGetFuncName(), "Unknown extended msg:", payload[0],
+			", peer:", peerInfo.Addr)
+		return true
+	}
+	return extension.Handler(sessionInfo, peerInfo, payload[1:])
+}
+
+// Process extended handshake from peer. Peer may send it again later on, so
+// only the keys that it has are updated.
+func (peerInfo *PeerInfo) processExtHandshake(sessionInfo *TrntSessionInfo,
+	buf []byte) bool {
+	dict, ok := decodeBencodeDict(buf)
+	if !ok {
+		return false
+	}
+
+	// Msg ids of extensions, id 0 means peer turned off that extension
+	peerInfo.extMutex.Lock()
+	if extMap, ok := dict["m"].(map[string]interface{}); ok {
+		for name, val := range extMap {
+			extMsgId, ok := val.(int64)
+			if !ok || (extMsgId < 0) || (extMsgId > 0xff) {
+				continue
+			}
+			if extMsgId == 0 {
+				delete(peerInfo.ExtensionMap, name)
+			} else {
+				peerInfo.ExtensionMap[name] = uint8(extMsgId)
+			}
+		}
+	}
+	peerInfo.extMutex.Unlock()
+
+	if clientName, ok := dict["v"].(string); ok {
+		peerInfo.ClientName = clientName
+	}
+	if port, ok := dict["p"].(int64); ok && (port > 0) && (port <= 0xffff) {
+		peerInfo.ListenPort = uint16(port)
+	}
+	if reqq, ok := dict["reqq"].(int64); ok && (reqq > 0) && (reqq <= 0xffff) {
+		peerInfo.MaxRequests = uint32(reqq)
+	}
+	if yourIp, ok := dict["yourip"].(string); ok &&
+		((len(yourIp) == net.IPv4len) || (len(yourIp) == net.IPv6len)) {
+		peerInfo.YourIp = net.IP([]byte(yourIp))
+	}
+	if size, ok := dict["metadata_size"].(int64); ok && (size > 0) &&
+		(size <= int64(sessionInfo.cfg.MaxMetadataSize)) {
+		peerInfo.MetadataSize = int(size)
+	}
+	debugPrintln(sessionInfo.cfg.DebugOutput,
+		DebugGetFuncName(), "Extended handshake, client:", peerInfo.ClientName,
+		", reqq:", peerInfo.MaxRequests, ", metadata size:", peerInfo.MetadataSize,
+		", peer:", peerInfo.Addr)
+
+	// Peer may have metadata that we're after
+	sessionInfo.metadata.requestPieces(sessionInfo)
+	return true
+}
+
+// Get peer's msg id for an extension, 0 if peer doesn't support it
+func (peerInfo *PeerInfo) getExtensionId(name string) uint8 {
+	peerInfo.extMutex.RLock()
+	defer peerInfo.extMutex.RUnlock()
+	return peerInfo.ExtensionMap[name]
+}
+
+// Send an extended msg, <len><20><extended msg id><payload>
+func (peerInfo *PeerInfo) sendExtMsg(extMsgId uint8, payload []byte) bool {
+	buf := make([]byte, 6+len(payload))
+	copy(buf[0:4], getBytesFromUint32(uint32(2+len(payload))))
+	buf[4] = MsgTypeExtended
+	buf[5] = extMsgId
+	copy(buf[6:], payload)
+	return peerInfo.sendBuf("Extended", buf)
+}
@@ -0,0 +1,8 @@
+module github.com/swatkat/gotrnt
+
+go 1.16
+
+require code.google.com/p/bencode-go v0.0.0-00010101000000-000000000000
+
+// Google Code is gone, its bencode package lives on at GitHub
+replace code.google.com/p/bencode-go => github.com/jackpal/bencode-go v1.0.0
@@ -0,0 +1,195 @@
+package gotrnt
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"encoding/base32"
+	"encoding/hex"
+	"github.com/swatkat/gotrntmetainfoparser"
+	"log"
+	"net/url"
+	"os"
+	"strings"
+)
+
+// Data got from a magnet link
+type MagnetLink struct {
+	InfoHash    string   // Torrent infohash, raw 20 bytes
+	DisplayName string   // Torrent name to show till metadata is fetched
+	Trackers    []string // Tracker announce URLs
+	Peers       []string // List of ip:port of peers
+}
+
+// Parse a magnet link, magnet:?xt=urn:btih:<infohash>&dn=...&tr=...&x.pe=...
+// Infohash can be 40 hex digits or 32 base32 characters.
+func ParseMagnetLink(uri string) (MagnetLink, bool) {
+	var magnet MagnetLink
+	if !strings.HasPrefix(uri, "magnet:?") {
+		log.Println(DebugGetFuncName(), "Not a magnet link")
+		return magnet, false
+	}
+	params, er := url.ParseQuery(uri[len("magnet:?"):])
+	if er != nil {
+		log.Println(DebugGetFuncName(), er)
+		return magnet, false
+	}
+
+	for _, xt := range params["xt"] {
+		if !strings.HasPrefix(xt, "urn:btih:") {
+			continue
+		}
+		if infoHash, ok := ParseInfoHash(xt[len("urn:btih:"):]); ok {
+			magnet.InfoHash = infoHash
+			break
+		}
+	}
+	if len(magnet.InfoHash) == 0 {
+		log.Println(DebugGetFuncName(), "No valid infohash in magnet link")
+		return magnet, false
+	}
+
+	magnet.DisplayName = params.Get("dn")
+	magnet.Trackers = params["tr"]
+	magnet.Peers = params["x.pe"]
+	return magnet, true
+}
+
+// Get raw 20 byte infohash from its text form, which can be 40 hex digits or
+// 32 base32 characters
+func ParseInfoHash(hash string) (string, bool) {
+	var infoHash []byte
+	var er error
+	switch len(hash) {
+	case 2 * sha1.Size:
+		infoHash, er = hex.DecodeString(hash)
+	case 32:
+		infoHash, er = base32.StdEncoding.DecodeString(strings.ToUpper(hash))
+	default:
+		return "", false
+	}
+	if (er != nil) || (len(infoHash) != sha1.Size) {
+		return "", false
+	}
+	return string(infoHash), true
+}
+
+// Start a session from a magnet link. Session has no info dictionary till
+// metadata is fetched from peers.
+func (sessionInfo *TrntSessionInfo) InitMagnet(uri string) bool {
+	magnet, ok := ParseMagnetLink(uri)
+	if !ok {
+		return false
+	}
+	sessionInfo.magnet = magnet
+	sessionInfo.metaInfo.InfoHash = magnet.InfoHash
+	sessionInfo.metaInfo.Info.Name = magnet.DisplayName
+	if len(magnet.Trackers) > 0 {
+		sessionInfo.metaInfo.Announce = magnet.Trackers[0]
+	}
+	for _, val := range magnet.Trackers {
+		sessionInfo.metaInfo.AnnounceList = append(sessionInfo.metaInfo.AnnounceList,
+			[]string{val})
+	}
+	return true
+}
+
+// Read info dictionary from torrent file as raw bytes, so that it can be
+// sent to peers fetching metadata. Info dictionary is re-encoded, so this
+// only works if torrent file has it in canonical form; infohash tells.
+func (sessionInfo *TrntSessionInfo) loadInfoBytes(fileNameWithPath string) bool {
+	buf, er := os.ReadFile(fileNameWithPath)
+	if er != nil {
+		log.Println(DebugGetFuncName(), er)
+		return false
+	}
+	dict, ok := decodeBencodeDict(buf)
+	if !ok {
+		return false
+	}
+	infoBytes, ok := encodeBencode(dict["info"])
+	if !ok {
+		return false
+	}
+	if hash := sha1.Sum(infoBytes); string(hash[0:]) != sessionInfo.metaInfo.InfoHash {
+		log.Println(DebugGetFuncName(), "Info dictionary isn't in canonical form")
+		return false
+	}
+	sessionInfo.metadata.InfoBytes = infoBytes
+	return true
+}
+
+// Build info part of metainfo from raw info dictionary
+func parseInfoDict(infoBytes []byte) (gotrntmetainfoparser.InfoDict, bool) {
+	var info gotrntmetainfoparser.InfoDict
+	dict, ok := decodeBencodeDict(infoBytes)
+	if !ok {
+		return info, false
+	}
+	info.Name, _ = dict["name"].(string)
+	info.PieceLength, _ = dict["piece length"].(int64)
+	info.Pieces, _ = dict["pieces"].(string)
+	info.Length, _ = dict["length"].(int64)
+	info.Private, _ = dict["private"].(int64)
+	if files, ok := dict["files"].([]interface{}); ok {
+		for _, val := range files {
+			fileDict, ok := val.(map[string]interface{})
+			if !ok {
+				return info, false
+			}
+			var fileInfo gotrntmetainfoparser.FileDict
+			fileInfo.Length, _ = fileDict["length"].(int64)
+			pathList, _ := fileDict["path"].([]interface{})
+			for _, elem := range pathList {
+				pathElem, _ := elem.(string)
+				fileInfo.Path = append(fileInfo.Path, pathElem)
+			}
+			info.Files = append(info.Files, fileInfo)
+		}
+	}
+	if (len(info.Name) == 0) || (info.PieceLength <= 0) || (len(info.Pieces) == 0) ||
+		(len(info.Pieces)%sha1.Size != 0) {
+		return info, false
+	}
+	return info, true
+}
+
+// Save metainfo of session as a .torrent file
+func (sessionInfo *TrntSessionInfo) SaveTorrentFile(fileNameWithPath string) bool {
+	infoBytes := sessionInfo.metadata.getInfoBytes()
+	if infoBytes == nil {
+		log.Println(DebugGetFuncName(), "No metadata yet")
+		return false
+	}
+
+	// Info dictionary is written as is, so that infohash doesn't change.
+	// Keys must be in sorted order.
+	var buf bytes.Buffer
+	buf.WriteString("d")
+	if len(sessionInfo.metaInfo.Announce) > 0 {
+		announce, _ := encodeBencode(sessionInfo.metaInfo.Announce)
+		buf.WriteString("8:announce")
+		buf.Write(announce)
+	}
+	if len(sessionInfo.metaInfo.AnnounceList) > 0 {
+		var tiers []interface{}
+		for _, tier := range sessionInfo.metaInfo.AnnounceList {
+			var urls []interface{}
+			for _, val := range tier {
+				urls = append(urls, val)
+			}
+			tiers = append(tiers, urls)
+		}
+		announceList, _ := encodeBencode(tiers)
+		buf.WriteString("13:announce-list")
+		buf.Write(announceList)
+	}
+	buf.WriteString("4:info")
+	buf.Write(infoBytes)
+	buf.WriteString("e")
+
+	if er := os.WriteFile(fileNameWithPath, buf.Bytes(), 0644); er != nil {
+		log.Println(DebugGetFuncName(), er)
+		return false
+	}
+	return true
+}
@@ -0,0 +1,84 @@
+package gotrnt
+
+import (
+	"errors"
+	"github.com/swatkat/gotrntmetainfoparser"
+	"sync"
+)
+
+// Keeps torrent data in memory, nothing touches disk. Meant for tests, and
+// for small torrents that are consumed right away. Data is gone once storage
+// is dropped; an opener that hands out the same storage again keeps it
+// across a pause.
+type MemoryStorage struct {
+	data        []byte       // Torrent data
+	pieceLength int64        // Piece length, to map blocks to byte offsets
+	mutex       sync.RWMutex // Guards data
+}
+
+// Make in-memory storage of a torrent
+func NewMemoryStorage(metaInfo *gotrntmetainfoparser.MetaInfo) (*MemoryStorage, bool) {
+	var layout storageLayout
+	if !layout.init(metaInfo, "") {
+		return nil, false
+	}
+	storage := new(MemoryStorage)
+	storage.data = make([]byte, layout.TotalLength)
+	storage.pieceLength = layout.PieceLength
+	return storage, true
+}
+
+// Make in-memory storage of a torrent, as a StorageOpener. Base directory
+// isn't used.
+func OpenMemoryStorage(metaInfo *gotrntmetainfoparser.MetaInfo, baseDir string) (Storage, error) {
+	storage, ok := NewMemoryStorage(metaInfo)
+	if !ok {
+		return nil, errors.New("invalid metainfo")
+	}
+	return storage, nil
+}
+
+// Read a block of a piece
+func (storage *MemoryStorage) ReadBlock(pieceIdx, begin uint32, buf []byte) error {
+	storage.mutex.RLock()
+	defer storage.mutex.RUnlock()
+	offset, ok := storage.getBlockOffset(pieceIdx, begin, len(buf))
+	if !ok {
+		return errors.New("invalid byte range")
+	}
+	copy(buf, storage.data[offset:])
+	return nil
+}
+
+// Write a block of a piece
+func (storage *MemoryStorage) WriteBlock(pieceIdx, begin uint32, buf []byte) error {
+	storage.mutex.Lock()
+	defer storage.mutex.Unlock()
+	offset, ok := storage.getBlockOffset(pieceIdx, begin, len(buf))
+	if !ok {
+		return errors.New("invalid byte range")
+	}
+	copy(storage.data[offset:], buf)
+	return nil
+}
+
+// Nothing to do once a piece is complete
+func (storage *MemoryStorage) MarkComplete(pieceIdx uint32) error {
+	return nil
+}
+
+// Nothing to release, data stays around till storage is dropped
+func (storage *MemoryStorage) Close() error {
+	return nil
+}
+
+// Nothing to move, data isn't kept in a directory
+func (storage *MemoryStorage) Move(baseDir string) error {
+	return nil
+}
+
+// Get byte offset of a block, checking that it lies within torrent
+func (storage *MemoryStorage) getBlockOffset(pieceIdx, begin uint32, length int) (int64, bool) {
+	offset := (storage.pieceLength * int64(pieceIdx)) + int64(begin)
+	return offset, offset+int64(length) <= int64(len(storage.data))
+}
@@ -0,0 +1,266 @@
+package gotrnt
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"log"
+	"sync"
+	"time"
+)
+
+// ut_metadata msg types
+const (
+	MetadataMsgRequest = iota
+	MetadataMsgData
+	MetadataMsgReject
+)
+
+// Metadata is exchanged in pieces of this size, last piece may be shorter
+const MetadataPieceLen = 0x4000 // 16KB
+
+// Fetches info dictionary of a torrent from peers when all we have is its
+// infohash (ut_metadata, BEP 9), and serves it to peers once we have it
+type MetadataMgr struct {
+	InfoBytes   []byte      // Raw info dictionary, nil till we have it
+	size        int         // Size of info dictionary being fetched
+	pieces      [][]byte    // Metadata pieces received so far
+	requestedAt []time.Time // When each metadata piece was last requested
+	mutex       sync.Mutex  // Guards all of the above
+	quit        chan bool   // Closed to stop fetching
+}
+
+// A metadata piece to be requested from a peer
+type metadataRequest struct {
+	peerInfo *PeerInfo
+	pieceIdx int
+}
+
+// Start fetching metadata
+func (metadataMgr *MetadataMgr) Start(sessionInfo *TrntSessionInfo) bool {
+	// Sanity checks
+	if sessionInfo == nil {
+		log.Println(DebugGetFuncName(), "Invalid param")
+		return false
+	}
+
+	debugPrintln(sessionInfo.cfg.DebugOutput, DebugGetFuncName(), "MetadataMgr")
+	metadataMgr.quit = make(chan bool)
+	go metadataMgr.run(sessionInfo, metadataMgr.quit)
+	return true
+}
+
+// Stop fetching metadata
+func (metadataMgr *MetadataMgr) Stop() bool {
+	if metadataMgr.quit != nil {
+		close(metadataMgr.quit)
+		metadataMgr.quit = nil
+	}
+	return true
+}
+
+// Request metadata pieces again if peers didn't send them in time, till
+// we have the whole info dictionary
+func (metadataMgr *MetadataMgr) run(sessionInfo *TrntSessionInfo, quit chan bool) {
+	ticker := time.NewTicker(sessionInfo.cfg.MetadataTimeout)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if metadataMgr.getInfoBytes() != nil {
+				return
+			}
+			metadataMgr.requestPieces(sessionInfo)
+		case <-quit:
+			return
+		}
+	}
+}
+
+// Get raw info dictionary, nil if we don't have it yet
+func (metadataMgr *MetadataMgr) getInfoBytes() []byte {
+	metadataMgr.mutex.Lock()
+	defer metadataMgr.mutex.Unlock()
+	return metadataMgr.InfoBytes
+}
+
+// Hand over ut_metadata msg to metadata mgr of session
+func processMetadataMsg(sessionInfo *TrntSessionInfo, peerInfo *PeerInfo,
+	payload []byte) bool {
+	return sessionInfo.metadata.processMsg(sessionInfo, peerInfo, payload)
+}
+
+// Process a ut_metadata msg. Msg is a bencoded dictionary, followed by
+// metadata piece in case of data msg.
+func (metadataMgr *MetadataMgr) processMsg(sessionInfo *TrntSessionInfo,
+	peerInfo *PeerInfo, buf []byte) bool {
+	dictLen, ok := getBencodeLength(buf)
+	if !ok {
+		return false
+	}
+	dict, ok := decodeBencodeDict(buf[:dictLen])
+	if !ok {
+		return false
+	}
+	msgType, _ := dict["msg_type"].(int64)
+	pieceIdx, ok := dict["piece"].(int64)
+	if !ok || (pieceIdx < 0) || (pieceIdx > int64(sessionInfo.cfg.MaxMetadataSize/MetadataPieceLen)) {
+		return false
+	}
+
+	switch msgType {
+	case MetadataMsgRequest:
+		metadataMgr.servePiece(peerInfo, int(pieceIdx))
+
+	case MetadataMsgData:
+		return metadataMgr.addPiece(sessionInfo, peerInfo, int(pieceIdx), buf[dictLen:])
+
+	case MetadataMsgReject:
+		// Some other peer may have it
+		debugPrintln(sessionInfo.cfg.DebugOutput,
+			DebugGetFuncName(), "Metadata piece rejected:", pieceIdx,
+			", peer:", peerInfo.Addr)
+		metadataMgr.mutex.Lock()
+		if int(pieceIdx) < len(metadataMgr.requestedAt) {
+			metadataMgr.requestedAt[pieceIdx] = time.Time{}
+		}
+		metadataMgr.mutex.Unlock()
+	}
+	return true
+}
+
+// Send a metadata piece to peer, or reject the request if we don't have it
+func (metadataMgr *MetadataMgr) servePiece(peerInfo *PeerInfo, pieceIdx int) bool {
+	if peerInfo.getExtensionId("ut_metadata") == 0 {
+		return false
+	}
+	dict := make(map[string]interface{})
+	dict["piece"] = int64(pieceIdx)
+	infoBytes := metadataMgr.getInfoBytes()
+	begin := pieceIdx * MetadataPieceLen
+	if (infoBytes == nil) || (begin >= len(infoBytes)) {
+		dict["msg_type"] = int64(MetadataMsgReject)
+		return peerInfo.sendMetadataMsg(dict, nil)
+	}
+	end := begin + MetadataPieceLen
+	if end > len(infoBytes) {
+		end = len(infoBytes)
+	}
+	dict["msg_type"] = int64(MetadataMsgData)
+	dict["total_size"] = int64(len(infoBytes))
+	return peerInfo.sendMetadataMsg(dict, infoBytes[begin:end])
+}
+
+// Save a metadata piece got from peer. Once all pieces are in, check them
+// against infohash and switch session over to downloading torrent data.
+func (metadataMgr *MetadataMgr) addPiece(sessionInfo *TrntSessionInfo,
+	peerInfo *PeerInfo, pieceIdx int, data []byte) bool {
+	metadataMgr.mutex.Lock()
+	if (metadataMgr.InfoBytes != nil) || (pieceIdx >= len(metadataMgr.pieces)) ||
+		(metadataMgr.pieces[pieceIdx] != nil) {
+		metadataMgr.mutex.Unlock()
+		return true
+	}
+	pieceLen := metadataMgr.size - (pieceIdx * MetadataPieceLen)
+	if pieceLen > MetadataPieceLen {
+		pieceLen = MetadataPieceLen
+	}
+	if len(data) != pieceLen {
+		metadataMgr.mutex.Unlock()
+		log.Println(DebugGetFuncName(), "Invalid metadata piece:", pieceIdx,
+			", len:", len(data), ", peer:", peerInfo.Addr)
+		return false
+	}
+	metadataMgr.pieces[pieceIdx] = data
+	debugPrintln(sessionInfo.cfg.DebugOutput,
+		DebugGetFuncName(), "Metadata piece:", pieceIdx, ", peer:", peerInfo.Addr)
+	for _, val := range metadataMgr.pieces {
+		if val == nil {
+			metadataMgr.mutex.Unlock()
+			return true
+		}
+	}
+
+	// All pieces are in, infohash is hash of the whole info dictionary
+	infoBytes := bytes.Join(metadataMgr.pieces, nil)
+	hash := sha1.Sum(infoBytes)
+	if string(hash[0:]) != sessionInfo.metaInfo.InfoHash {
+		// Start over, size may have been wrong too
+		log.Println(DebugGetFuncName(), "Metadata hash mismatch")
+		metadataMgr.size = 0
+		metadataMgr.pieces = nil
+		metadataMgr.requestedAt = nil
+		metadataMgr.mutex.Unlock()
+		return true
+	}
+	metadataMgr.InfoBytes = infoBytes
+	metadataMgr.pieces = nil
+	metadataMgr.requestedAt = nil
+	metadataMgr.mutex.Unlock()
+
+	debugPrintln(sessionInfo.cfg.DebugOutput,
+		DebugGetFuncName(), "Got metadata, size:", len(infoBytes))
+	go sessionInfo.client.switchToDownload(sessionInfo)
+	return true
+}
+
+// Request missing metadata pieces from peers that have metadata, spreading
+// requests over those peers. Pieces that are already requested aren't
+// requested again till timeout.
+func (metadataMgr *MetadataMgr) requestPieces(sessionInfo *TrntSessionInfo) {
+	var requests []metadataRequest
+	metadataMgr.mutex.Lock()
+	if metadataMgr.InfoBytes != nil {
+		metadataMgr.mutex.Unlock()
+		return
+	}
+
+	// Peers that told us metadata size, first one decides size to fetch
+	var peers []*PeerInfo
+	for _, val := range sessionInfo.peerMgr.getPeers() {
+		if !val.isConnected() || (val.getExtensionId("ut_metadata") == 0) || (val.MetadataSize == 0) {
+			continue
+		}
+		if metadataMgr.size == 0 {
+			metadataMgr.size = val.MetadataSize
+			numPieces := (val.MetadataSize + MetadataPieceLen - 1) / MetadataPieceLen
+			metadataMgr.pieces = make([][]byte, numPieces)
+			metadataMgr.requestedAt = make([]time.Time, numPieces)
+		}
+		if val.MetadataSize == metadataMgr.size {
+			peers = append(peers, val)
+		}
+	}
+
+	for pieceIdx := range metadataMgr.pieces {
+		if len(peers) == 0 {
+			break
+		}
+		if (metadataMgr.pieces[pieceIdx] != nil) ||
+			(time.Since(metadataMgr.requestedAt[pieceIdx]) < sessionInfo.cfg.MetadataTimeout) {
+			continue
+		}
+		var req metadataRequest
+		req.peerInfo = peers[len(requests)%len(peers)]
+		req.pieceIdx = pieceIdx
+		requests = append(requests, req)
+		metadataMgr.requestedAt[pieceIdx] = time.Now()
+	}
+	metadataMgr.mutex.Unlock()
+
+	// Send requests
+	for _, req := range requests {
+		dict := make(map[string]interface{})
+		dict["msg_type"] = int64(MetadataMsgRequest)
+		dict["piece"] = int64(req.pieceIdx)
+		req.peerInfo.sendMetadataMsg(dict, nil)
+	}
+}
+
+// Send a ut_metadata msg, data follows the bencoded dictionary
+func (peerInfo *PeerInfo) sendMetadataMsg(dict map[string]interface{}, data []byte) bool {
+	payload, ok := encodeBencode(dict)
+	if !ok {
+		return false
+	}
+	return peerInfo.sendExtMsg(peerInfo.getExtensionId("ut_metadata"), append(payload, data...))
+}
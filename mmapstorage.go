@@ -0,0 +1,158 @@
+//go:build linux || darwin || freebsd
+// +build linux darwin freebsd
+
+package gotrnt
+
+import (
+	"errors"
+	"github.com/swatkat/gotrntmetainfoparser"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+	"syscall"
+)
+
+// Maps files of a torrent into memory, blocks are copied in and out of the
+// mappings. Files are grown to full length up front, as writes through a
+// mapping can't grow a file. Kernel writes dirty pages back to files.
+type MmapStorage struct {
+	storageLayout
+	mappings map[*StorageFile][]byte // Mapping of each non empty file, nil once closed
+	mutex    sync.RWMutex            // Guards mappings, so that they aren't unmapped under a copy
+}
+
+// Open and map files of a torrent, as a StorageOpener
+func OpenMmapStorage(metaInfo *gotrntmetainfoparser.MetaInfo, baseDir string) (Storage, error) {
+	storage := new(MmapStorage)
+	if !storage.init(metaInfo, baseDir) {
+		return nil, errors.New("invalid metainfo")
+	}
+	storage.mutex.Lock()
+	defer storage.mutex.Unlock()
+	if er := storage.mapFiles(); er != nil {
+		return nil, er
+	}
+	return storage, nil
+}
+
+// Create directories, and map files. A file isn't needed once it's mapped.
+// Caller holds lock.
+func (storage *MmapStorage) mapFiles() error {
+	mappings := make(map[*StorageFile][]byte)
+	for _, f := range storage.Files {
+		data, er := mapFile(f)
+		if er != nil {
+			log.Println(DebugGetFuncName(), er)
+			for _, val := range mappings {
+				syscall.Munmap(val)
+			}
+			return er
+		}
+		if data != nil {
+			mappings[f] = data
+		}
+	}
+	storage.mappings = mappings
+	return nil
+}
+
+// Map a file for reading and writing, growing it to its length first. Empty
+// files aren't mapped.
+func mapFile(f *StorageFile) ([]byte, error) {
+	if er := os.MkdirAll(filepath.Dir(f.Path), 0755); er != nil {
+		return nil, er
+	}
+	handle, er := os.OpenFile(f.Path, os.O_RDWR|os.O_CREATE, 0644)
+	if er != nil {
+		return nil, er
+	}
+	defer handle.Close()
+	if f.Length == 0 {
+		return nil, nil
+	}
+	fileInfo, er := handle.Stat()
+	if (er == nil) && (fileInfo.Size() < f.Length) {
+		er = handle.Truncate(f.Length)
+	}
+	if er != nil {
+		return nil, er
+	}
+	return syscall.Mmap(int(handle.Fd()), 0, int(f.Length),
+		syscall.PROT_READ|syscall.PROT_WRITE, syscall.MAP_SHARED)
+}
+
+// Read a block of a piece
+func (storage *MmapStorage) ReadBlock(pieceIdx, begin uint32, buf []byte) error {
+	return storage.copyBlock(pieceIdx, begin, buf, false)
+}
+
+// Write a block of a piece
+func (storage *MmapStorage) WriteBlock(pieceIdx, begin uint32, buf []byte) error {
+	return storage.copyBlock(pieceIdx, begin, buf, true)
+}
+
+// Copy a block out of mappings, or into them if toFile is set
+func (storage *MmapStorage) copyBlock(pieceIdx, begin uint32, buf []byte, toFile bool) error {
+	segments, er := storage.getSegments(storage.getBlockOffset(pieceIdx, begin), int64(len(buf)))
+	if er != nil {
+		return er
+	}
+	storage.mutex.RLock()
+	defer storage.mutex.RUnlock()
+	if storage.mappings == nil {
+		return errors.New("storage closed")
+	}
+	bufOffset := int64(0)
+	for _, seg := range segments {
+		data := storage.mappings[seg.File][seg.Offset : seg.Offset+seg.Length]
+		if toFile {
+			copy(data, buf[bufOffset:])
+		} else {
+			copy(buf[bufOffset:], data)
+		}
+		bufOffset += seg.Length
+	}
+	return nil
+}
+
+// Nothing to do once a piece is complete, kernel writes it back to file
+func (storage *MmapStorage) MarkComplete(pieceIdx uint32) error {
+	return nil
+}
+
+// Unmap all files
+func (storage *MmapStorage) Close() error {
+	storage.mutex.Lock()
+	defer storage.mutex.Unlock()
+	return storage.unmapFiles()
+}
+
+// Unmap all files, caller holds lock
+func (storage *MmapStorage) unmapFiles() error {
+	var firstEr error
+	for _, val := range storage.mappings {
+		if er := syscall.Munmap(val); (er != nil) && (firstEr == nil) {
+			firstEr = er
+		}
+	}
+	storage.mappings = nil
+	return firstEr
+}
+
+// Move files to another directory, and map them there
+func (storage *MmapStorage) Move(baseDir string) error {
+	storage.mutex.Lock()
+	defer storage.mutex.Unlock()
+	storage.unmapFiles()
+	er := storage.moveFiles(baseDir)
+	if mapEr := storage.mapFiles(); er == nil {
+		er = mapEr
+	}
+	return er
+}
+
+// Get paths of files that hold torrent data
+func (storage *MmapStorage) getFilePaths() []string {
+	return storage.getLayoutPaths()
+}
@@ -0,0 +1,14 @@
+//go:build !(linux || darwin || freebsd)
+// +build !linux,!darwin,!freebsd
+
+package gotrnt
+
+import (
+	"errors"
+	"github.com/swatkat/gotrntmetainfoparser"
+)
+
+// Memory mapped storage isn't available on this platform
+func OpenMmapStorage(metaInfo *gotrntmetainfoparser.MetaInfo, baseDir string) (Storage, error) {
+	return nil, errors.New("mmap storage isn't supported on this platform")
+}
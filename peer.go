@@ -1,12 +1,13 @@
-package main
+package gotrnt
 
 import (
-	"fmt"
 	"github.com/swatkat/gotrntmessages"
 	"io"
 	"log"
-	"math/big"
 	"net"
+	"sync"
+	"sync/atomic"
+	"time"
 )
 
 // Peer states
@@ -18,20 +19,83 @@ const (
 )
 
 type PeerInfo struct {
-	State        uint32   // Peer state
-	IsInterested bool     // Interested or not
-	Addr         string   // Peer ip:port
-	Conn         net.Conn // Peer connection
-	PeerId       string   // Peer id got from Handshake
-	BitField     *big.Int // Bitfield indicating pices that a peer has
+	State        uint32                     // Peer state, updated atomically
+	IsInterested int32                      // Peer is interested in us or not, updated atomically
+	AmInterested bool                       // We're interested in peer or not
+	Addr         string                     // Peer ip:port
+	Conn         net.Conn                   // Peer connection
+	PeerId       string                     // Peer id got from Handshake
+	BitField     *Bitfield                  // Bitfield indicating pices that a peer has
+	HashFails    uint32                     // Number of pieces from this peer that failed hash check
+	Requests     map[BlockRequest]time.Time // Blocks requested from peer, guarded by piecemgr lock
+	AmChoking    int32                      // We're choking peer, so its requests aren't served; updated atomically
+	uploadQueue  []BlockRequest             // Blocks requested by peer, yet to be sent
+	uploadMutex  sync.Mutex                 // Guards uploadQueue
+	uploadWake   chan bool                  // Signals uploader that a block got queued
+	sendMutex    sync.Mutex                 // Serializes writes to Conn
+	Downloaded   uint64                     // Bytes downloaded from peer, updated atomically
+	Uploaded     uint64                     // Bytes uploaded to peer, updated atomically
+	DownloadRate float64                    // Bytes per second downloaded from peer, as of last rechoke
+	UploadRate   float64                    // Bytes per second uploaded to peer, as of last rechoke
+	SupportsExt  bool                       // Peer supports extension protocol, as per its handshake
+	SupportsDht  bool                       // Peer runs a DHT node, as per its handshake
+	ExtensionMap map[string]uint8           // Peer's msg ids of extensions, from extended handshake
+	extMutex     sync.RWMutex               // Guards ExtensionMap
+	ClientName   string                     // Peer's client name and version, from extended handshake
+	ListenPort   uint16                     // Port on which peer listens, from extended handshake
+	MaxRequests  uint32                     // Peer's max number of outstanding requests, 0 if unknown
+	YourIp       net.IP                     // Our IP address as seen by peer, from extended handshake
+	MetadataSize int                        // Size of info dictionary, as told by peer
+	Outgoing     bool                       // We connected to peer, rather than peer connecting to us
+
+	lastDownloaded uint64          // Downloaded as of last rechoke
+	lastUploaded   uint64          // Uploaded as of last rechoke
+	pexPeers       map[string]bool // Peers that we told peer about in peer exchange msgs
+	lastPexRecv    time.Time       // When peer last sent us a peer exchange msg
+	pexMutex       sync.Mutex      // Guards pexPeers and lastPexRecv
+	downloadBps    uint64          // DownloadRate for request deadlines, updated atomically
+	lastBlockAt    int64           // When peer last sent a block or we began waiting on it, in unix nanoseconds; updated atomically
+	snubbed        int32           // Set if peer sent no block for SnubTimeout, updated atomically
+	connMutex      sync.RWMutex    // Guards Conn and disconnected
+	disconnected   bool            // Disconnect was called, a dial that's under way must drop its conn
+	debugOutput    io.Writer       // Debug output of client that peer belongs to, stdout if nil
 }
 
 // Initalizes data related to peer state
-func (peerInfo *PeerInfo) Init(peerIpPort string) {
+func (peerInfo *PeerInfo) Init(peerIpPort string, numPieces uint32) {
 	peerInfo.Addr = peerIpPort
 	peerInfo.updateState(PeerStateChoked)
-	peerInfo.IsInterested = false
-	peerInfo.BitField = big.NewInt(0)
+	peerInfo.setInterested(false)
+	peerInfo.AmInterested = false
+	peerInfo.BitField = NewBitfield(numPieces)
+	peerInfo.Requests = make(map[BlockRequest]time.Time)
+	peerInfo.setAmChoking(true)
+	peerInfo.clearUploads()
+	peerInfo.uploadWake = make(chan bool, 1)
+	atomic.StoreUint64(&peerInfo.Downloaded, 0)
+	atomic.StoreUint64(&peerInfo.Uploaded, 0)
+	peerInfo.DownloadRate = 0
+	peerInfo.UploadRate = 0
+	peerInfo.lastDownloaded = 0
+	peerInfo.lastUploaded = 0
+	peerInfo.SupportsExt = false
+	peerInfo.SupportsDht = false
+	peerInfo.extMutex.Lock()
+	peerInfo.ExtensionMap = make(map[string]uint8)
+	peerInfo.extMutex.Unlock()
+	peerInfo.ClientName = ""
+	peerInfo.ListenPort = 0
+	peerInfo.MaxRequests = 0
+	peerInfo.YourIp = nil
+	peerInfo.MetadataSize = 0
+	peerInfo.Outgoing = false
+	peerInfo.pexMutex.Lock()
+	peerInfo.pexPeers = make(map[string]bool)
+	peerInfo.lastPexRecv = time.Time{}
+	peerInfo.pexMutex.Unlock()
+	atomic.StoreUint64(&peerInfo.downloadBps, 0)
+	atomic.StoreInt64(&peerInfo.lastBlockAt, time.Now().UnixNano())
+	atomic.StoreInt32(&peerInfo.snubbed, 0)
 }
 
 // Opens a TCP connection to peer
@@ -42,11 +106,37 @@ func (peerInfo *PeerInfo) Connect(sessionInfo *TrntSessionInfo) bool {
 		return false
 	}
 
-	// Connect to a peer
-	var er error
-	if peerInfo.Conn, er = net.DialTimeout("tcp", peerInfo.Addr,
-		trntCfg.PeerConnectTimeout); er != nil {
+	// Stay within client's connection limit, peer goes back to candidate pool
+	// if there's no room for it
+	client := sessionInfo.client
+	if !client.acquireConn() {
+		sessionInfo.peerMgr.removePeer(peerInfo.Addr, peerInfo)
+		sessionInfo.peerMgr.addCandidates(sessionInfo, map[string]uint8{peerInfo.Addr: 0})
+		return false
+	}
+
+	// Connect to a peer, waiting for a half-open slot first. Session may be
+	// stopped while we wait, or while we dial.
+	peerInfo.Outgoing = true
+	client.acquireHalfOpen()
+	if peerInfo.isDisconnected() {
+		client.releaseHalfOpen()
+		sessionInfo.peerMgr.removePeer(peerInfo.Addr, peerInfo)
+		client.releaseConn()
+		return false
+	}
+	conn, er := net.DialTimeout("tcp", peerInfo.Addr, sessionInfo.cfg.PeerConnectTimeout)
+	client.releaseHalfOpen()
+	if er != nil {
 		log.Println(DebugGetFuncName(), er)
+		sessionInfo.peerMgr.removePeer(peerInfo.Addr, peerInfo)
+		client.releaseConn()
+		return false
+	}
+	if !peerInfo.setConn(conn) {
+		conn.Close()
+		sessionInfo.peerMgr.removePeer(peerInfo.Addr, peerInfo)
+		client.releaseConn()
 		return false
 	}
 
@@ -58,15 +148,75 @@ func (peerInfo *PeerInfo) Connect(sessionInfo *TrntSessionInfo) bool {
 
 // Disconnects from a peer
 func (peerInfo *PeerInfo) Disconnect() bool {
-	if er := peerInfo.Conn.Close(); er != nil {
+	// Peer may still be waiting for a half-open slot or dialing, Connect
+	// drops the conn once it sees that peer is disconnected
+	peerInfo.connMutex.Lock()
+	peerInfo.disconnected = true
+	conn := peerInfo.Conn
+	peerInfo.Conn = nil
+	peerInfo.connMutex.Unlock()
+	if conn == nil {
+		return false
+	}
+	if er := conn.Close(); er != nil {
 		log.Println(DebugGetFuncName(), er)
 	}
-	peerInfo.Init("")
+
+	// Peer isn't reused once disconnected. Its goroutine hands requests back
+	// to piecemgr on its way out, so only what others may act on is reset.
+	peerInfo.updateState(PeerStateChoked)
+	peerInfo.setAmChoking(true)
+	peerInfo.clearUploads()
 	return true
 }
 
+// Set conn of peer, once dial is done. Returns false if peer was
+// disconnected meanwhile, conn is then caller's to close.
+func (peerInfo *PeerInfo) setConn(conn net.Conn) bool {
+	peerInfo.connMutex.Lock()
+	defer peerInfo.connMutex.Unlock()
+	if peerInfo.disconnected {
+		return false
+	}
+	peerInfo.Conn = conn
+	return true
+}
+
+// Get peer connection, nil if we aren't connected yet
+func (peerInfo *PeerInfo) getConn() net.Conn {
+	peerInfo.connMutex.RLock()
+	defer peerInfo.connMutex.RUnlock()
+	return peerInfo.Conn
+}
+
+// Get peer's TCP address, nil if we aren't connected
+func (peerInfo *PeerInfo) getTcpAddr() *net.TCPAddr {
+	conn := peerInfo.getConn()
+	if conn == nil {
+		return nil
+	}
+	tcpAddr, _ := conn.RemoteAddr().(*net.TCPAddr)
+	return tcpAddr
+}
+
+// Check if we're connected to peer
+func (peerInfo *PeerInfo) isConnected() bool {
+	return peerInfo.getConn() != nil
+}
+
+// Check if Disconnect was called on peer
+func (peerInfo *PeerInfo) isDisconnected() bool {
+	peerInfo.connMutex.RLock()
+	defer peerInfo.connMutex.RUnlock()
+	return peerInfo.disconnected
+}
+
 // Do handshake with peer and wait for msgs
 func (peerInfo *PeerInfo) recvMsgs(sessionInfo *TrntSessionInfo) {
+	// Peer is gone once we're done with it
+	defer sessionInfo.client.releaseConn()
+	defer sessionInfo.peerMgr.removePeer(peerInfo.Addr, peerInfo)
+
 	// Send handshake
 	if !peerInfo.SendMsg(sessionInfo, gotrntmessages.MsgTypeHandshake) {
 		peerInfo.Disconnect()
@@ -77,25 +227,96 @@ func (peerInfo *PeerInfo) recvMsgs(sessionInfo *TrntSessionInfo) {
 	peerInfo.SendMsg(sessionInfo, gotrntmessages.MsgTypeBitfield)
 
 	// First msg that we get from peer must be handshake
-	buf := make([]byte, 68)
-	if _, er := io.ReadFull(peerInfo.Conn, buf); er != nil {
-		peerInfo.Disconnect()
-		log.Println(DebugGetFuncName(), "Handshake:", er)
-		return
-	}
-	msgData, ok := gotrntmessages.DecodeMessage(buf)
+	msgData, reserved, ok := readHandshake(peerInfo.getConn(), sessionInfo.cfg.HandshakeTimeout)
 	if !ok || !peerInfo.ProcessMsg(sessionInfo, msgData) {
 		peerInfo.Disconnect()
 		log.Println(DebugGetFuncName(), "Error decoding handshake msg, peer:",
 			peerInfo.Addr)
 		return
 	}
+	peerInfo.SupportsExt = supportsExtensions(reserved)
+	peerInfo.SupportsDht = supportsDht(reserved)
+
+	peerInfo.msgLoop(sessionInfo)
+}
+
+// Reply to handshake from a peer that connected to us, and wait for msgs
+func (peerInfo *PeerInfo) acceptMsgs(sessionInfo *TrntSessionInfo,
+	msgData gotrntmessages.MsgData) {
+	// Peer's handshake was already read, to find the torrent it wants
+	if !peerInfo.ProcessMsg(sessionInfo, msgData) ||
+		!peerInfo.SendMsg(sessionInfo, gotrntmessages.MsgTypeHandshake) {
+		peerInfo.Disconnect()
+		return
+	}
+
+	// Send our bitfield
+	peerInfo.SendMsg(sessionInfo, gotrntmessages.MsgTypeBitfield)
+
+	peerInfo.msgLoop(sessionInfo)
+}
+
+// Read and decode handshake, which is the first msg from a peer. Reserved
+// bytes of handshake are returned too, they tell the extensions that peer
+// supports.
+func readHandshake(conn net.Conn,
+	timeout time.Duration) (gotrntmessages.MsgData, []byte, bool) {
+	// Sanity checks
+	if conn == nil {
+		return nil, nil, false
+	}
 
-	// Process all other messages. Message format <len><id><payload>
-	for {
+	buf := make([]byte, 68)
+	conn.SetReadDeadline(time.Now().Add(timeout))
+	defer conn.SetReadDeadline(time.Time{})
+	if _, er := io.ReadFull(conn, buf); er != nil {
+		log.Println(DebugGetFuncName(), "Handshake:", er)
+		return nil, nil, false
+	}
+	msgData, ok := gotrntmessages.DecodeMessage(buf)
+	if !ok {
+		return nil, nil, false
+	}
+	if msgType, _ := msgData.GetMsgType(); msgType != gotrntmessages.MsgTypeHandshake {
+		return nil, nil, false
+	}
+	return msgData, buf[20:28], true
+}
+
+// Check extension protocol bit in reserved bytes of handshake
+func supportsExtensions(reserved []byte) bool {
+	return (len(reserved) == 8) && ((reserved[5] & 0x10) != 0)
+}
+
+// Check DHT bit in reserved bytes of handshake
+func supportsDht(reserved []byte) bool {
+	return (len(reserved) == 8) && ((reserved[7] & 0x01) != 0)
+}
+
+// Process msgs from peer after handshake, till connection breaks
+func (peerInfo *PeerInfo) msgLoop(sessionInfo *TrntSessionInfo) {
+	// Start sending blocks requested by peer
+	uploadQuit := make(chan bool)
+	defer close(uploadQuit)
+	go peerInfo.uploader(sessionInfo, peerInfo.uploadWake, uploadQuit)
+
+	// Tell peer the extended msgs that we support
+	if peerInfo.SupportsExt {
+		peerInfo.sendExtHandshake(sessionInfo)
+	}
+
+	// Tell peer the port of our DHT node
+	if peerInfo.SupportsDht && sessionInfo.client.dhtNode.IsRunning() && !sessionInfo.isPrivate() {
+		peerInfo.SendMsg(sessionInfo, gotrntmessages.MsgTypePort)
+	}
+
+	// Process all other messages. Message format <len><id><payload>. Conn
+	// is nil if peer got disconnected meanwhile.
+	conn := peerInfo.getConn()
+	for conn != nil {
 		// Read length of the message
 		var msglenbuf [4]byte
-		if _, er := io.ReadFull(peerInfo.Conn, msglenbuf[0:]); er != nil {
+		if _, er := io.ReadFull(conn, msglenbuf[0:]); er != nil {
 			log.Println(DebugGetFuncName(), er)
 			break
 		}
@@ -107,15 +328,24 @@ func (peerInfo *PeerInfo) recvMsgs(sessionInfo *TrntSessionInfo) {
 		}
 
 		// Read rest of the message
-		buf = make([]byte, msglen+4)
-		if _, er := io.ReadFull(peerInfo.Conn, buf[4:]); er != nil {
+		buf := make([]byte, msglen+4)
+		if _, er := io.ReadFull(conn, buf[4:]); er != nil {
 			log.Println(DebugGetFuncName(), er)
 			break
 		}
 
+		// Extended msgs are handled here, msgs package doesn't know them
+		if buf[4] == MsgTypeExtended {
+			if !peerInfo.processExtMsg(sessionInfo, buf[5:]) {
+				log.Println(DebugGetFuncName(), "Error processing extended msg, peer:",
+					peerInfo.Addr)
+			}
+			continue
+		}
+
 		// Prefix msg len to the read message, and decode it
 		copy(buf[0:4], msglenbuf[0:])
-		msgData, ok = gotrntmessages.DecodeMessage(buf)
+		msgData, ok := gotrntmessages.DecodeMessage(buf)
 
 		// Process message and take action
 		if !ok || !peerInfo.ProcessMsg(sessionInfo, msgData) {
@@ -126,6 +356,7 @@ func (peerInfo *PeerInfo) recvMsgs(sessionInfo *TrntSessionInfo) {
 	}
 
 	// If we're here, then there's something wrong. Close connection
+	sessionInfo.pieceMgr.peerDisconnected(peerInfo)
 	peerInfo.Disconnect()
 }
 
@@ -137,28 +368,37 @@ func (peerInfo *PeerInfo) ProcessMsg(sessionInfo *TrntSessionInfo,
 	switch msgType {
 	case gotrntmessages.MsgTypeChoke, gotrntmessages.MsgTypeUnchoke:
 		msgData := msgBase.(gotrntmessages.MsgDataChoke)
-		fmt.Println(DebugGetFuncName(), "Choke:", msgData.IsChoking, ", peer:",
+		debugPrintln(sessionInfo.cfg.DebugOutput,
+			DebugGetFuncName(), "Choke:", msgData.IsChoking, ", peer:",
 			peerInfo.Addr)
 		if msgData.IsChoking {
+			// Peer drops our pending requests when it chokes us
 			peerInfo.updateState(PeerStateChoked)
+			sessionInfo.pieceMgr.releaseRequests(peerInfo)
 		} else {
 			peerInfo.updateState(PeerStateUnchoked)
 		}
 
 	case gotrntmessages.MsgTypeInterested, gotrntmessages.MsgTypeNotInterested:
 		msgData := msgBase.(gotrntmessages.MsgDataInterested)
-		fmt.Println(DebugGetFuncName(), "Interested:", msgData.IsInterested)
-		peerInfo.IsInterested = msgData.IsInterested
+		debugPrintln(sessionInfo.cfg.DebugOutput,
+			DebugGetFuncName(), "Interested:", msgData.IsInterested)
+		peerInfo.setInterested(msgData.IsInterested)
 
 	case gotrntmessages.MsgTypeHave:
 		msgData := msgBase.(gotrntmessages.MsgDataHave)
-		// big.Int stores bitfield in big endian format
-		idx := peerInfo.BitField.BitLen() - int(msgData.PieceIndex)
-		if (idx >= 0) && (peerInfo.BitField.Bit(idx) == 0) {
-			peerInfo.BitField.SetBit(peerInfo.BitField, idx, 1)
-			fmt.Println(DebugGetFuncName(), "Set bit index", msgData.PieceIndex,
+		if !sessionInfo.pieceMgr.isReady() {
+			// We don't know number of pieces till we have metadata
+			break
+		}
+		if !sessionInfo.pieceMgr.peerHave(peerInfo, msgData.PieceIndex) {
+			log.Println(DebugGetFuncName(), "Invalid piece index:", msgData.PieceIndex,
 				", peer:", peerInfo.Addr)
+			return false
 		}
+		debugPrintln(sessionInfo.cfg.DebugOutput,
+			DebugGetFuncName(), "Set bit index", msgData.PieceIndex,
+			", peer:", peerInfo.Addr)
 
 	case gotrntmessages.MsgTypeBitfield:
 		msgData := msgBase.(gotrntmessages.MsgDataBitfield)
@@ -167,32 +407,68 @@ func (peerInfo *PeerInfo) ProcessMsg(sessionInfo *TrntSessionInfo,
 				peerInfo.Addr)
 			return false
 		}
+		if !sessionInfo.pieceMgr.isReady() {
+			break
+		}
 		// Save bitfield for this peer
-		peerInfo.BitField.SetBytes(msgData.Bitfield)
+		if !sessionInfo.pieceMgr.peerBitField(peerInfo, msgData.Bitfield) {
+			log.Println(DebugGetFuncName(), "Bitfield length or spare bits mismatch, peer:",
+				peerInfo.Addr)
+			return false
+		}
 
 	case gotrntmessages.MsgTypeRequest, gotrntmessages.MsgTypeCancel:
 		msgData := msgBase.(gotrntmessages.MsgDataRequestCancel)
-		fmt.Println(DebugGetFuncName(), "Index:",
+		debugPrintln(sessionInfo.cfg.DebugOutput, DebugGetFuncName(), "Index:",
 			msgData.PieceIndex, ", byte offset:", msgData.PieceBytesBegin,
 			", byte len:", msgData.PieceBytesLen, ", peer:", peerInfo.Addr)
+		if !sessionInfo.pieceMgr.isReady() {
+			break
+		}
+		var req BlockRequest
+		req.PieceIndex = msgData.PieceIndex
+		req.Begin = msgData.PieceBytesBegin
+		req.Length = msgData.PieceBytesLen
+		if msgType == gotrntmessages.MsgTypeCancel {
+			peerInfo.cancelUpload(req)
+		} else if !peerInfo.queueUpload(sessionInfo, req) {
+			return false
+		}
 
 	case gotrntmessages.MsgTypePiece:
 		msgData := msgBase.(gotrntmessages.MsgDataPiece)
-		fmt.Println(DebugGetFuncName(), "Piece:", msgData.PieceIndex, "chunk offset:",
+		debugPrintln(sessionInfo.cfg.DebugOutput,
+			DebugGetFuncName(), "Piece:", msgData.PieceIndex, "chunk offset:",
 			msgData.PieceBytesBegin, ", peer:", peerInfo.Addr)
-		if peerInfo.getState() == PeerStateWaitForPiece {
-			peerInfo.updateState(PeerStateUnchoked)
+		if !sessionInfo.pieceMgr.isReady() {
+			break
 		}
+		peerInfo.casState(PeerStateWaitForPiece, PeerStateUnchoked)
+		peerInfo.gotBlock()
+		atomic.AddUint64(&peerInfo.Downloaded, uint64(len(msgData.PieceBlock)))
+		atomic.AddUint64(&sessionInfo.Downloaded, uint64(len(msgData.PieceBlock)))
 		// Push piece to piecemgr for writing into file
 		var chunkData PieceChunkData
 		chunkData.peerInfo = peerInfo
 		chunkData.pieceInfo = msgData
-		sessionInfo.pieceMgr.PieceWriterChan <- chunkData
+		if !sessionInfo.pieceMgr.pushChunk(chunkData) {
+			return false
+		}
 
 	case gotrntmessages.MsgTypePort:
 		msgData := msgBase.(gotrntmessages.MsgDataPort)
-		fmt.Println(DebugGetFuncName(), "Port:", msgData.PeerPort, ", peer:",
+		debugPrintln(sessionInfo.cfg.DebugOutput,
+			DebugGetFuncName(), "Port:", msgData.PeerPort, ", peer:",
 			peerInfo.Addr)
+		// Peer's DHT node gets into our routing table if it replies to ping
+		if sessionInfo.client.dhtNode.IsRunning() && (msgData.PeerPort != 0) {
+			if tcpAddr := peerInfo.getTcpAddr(); tcpAddr != nil {
+				addr := new(net.UDPAddr)
+				addr.IP = tcpAddr.IP
+				addr.Port = int(msgData.PeerPort)
+				go sessionInfo.client.dhtNode.Ping(addr)
+			}
+		}
 
 	case gotrntmessages.MsgTypeHandshake:
 		msgData := msgBase.(gotrntmessages.MsgDataHandshake)
@@ -204,7 +480,8 @@ func (peerInfo *PeerInfo) ProcessMsg(sessionInfo *TrntSessionInfo,
 		peerInfo.PeerId = msgData.PeerId
 
 	default:
-		fmt.Println(DebugGetFuncName(), "Unknown msg:", msgType, ", peer:",
+		debugPrintln(sessionInfo.cfg.DebugOutput,
+			DebugGetFuncName(), "Unknown msg:", msgType, ", peer:",
 			peerInfo.Addr)
 	}
 
@@ -214,19 +491,35 @@ func (peerInfo *PeerInfo) ProcessMsg(sessionInfo *TrntSessionInfo,
 func (peerInfo *PeerInfo) SendMsg(sessionInfo *TrntSessionInfo,
 	msgType uint, v ...interface{}) bool {
 	switch msgType {
+	case gotrntmessages.MsgTypeChoke, gotrntmessages.MsgTypeUnchoke:
+		if buf, ok := gotrntmessages.EncodeMessage(msgType, nil); ok {
+			isChoking := msgType == gotrntmessages.MsgTypeChoke
+			if isChoking {
+				// Peer has to request again once it gets unchoked
+				peerInfo.setAmChoking(true)
+				peerInfo.clearUploads()
+			}
+			if peerInfo.send(msgType, buf) {
+				peerInfo.setAmChoking(isChoking)
+				return true
+			}
+		}
+
 	case gotrntmessages.MsgTypeInterested:
-		if peerInfo.getState() == PeerStateChoked {
-			if buf, ok := gotrntmessages.EncodeMessage(msgType, nil); ok {
-				if peerInfo.send(msgType, buf) {
-					peerInfo.updateState(PeerStateWaitForUnchoke)
-					return true
-				}
+		if buf, ok := gotrntmessages.EncodeMessage(msgType, nil); ok {
+			if peerInfo.send(msgType, buf) {
+				peerInfo.AmInterested = true
+				peerInfo.casState(PeerStateChoked, PeerStateWaitForUnchoke)
+				return true
 			}
 		}
 
 	case gotrntmessages.MsgTypeNotInterested:
 		if buf, ok := gotrntmessages.EncodeMessage(msgType, nil); ok {
-			return peerInfo.send(msgType, buf)
+			if peerInfo.send(msgType, buf) {
+				peerInfo.AmInterested = false
+				return true
+			}
 		}
 
 	case gotrntmessages.MsgTypeHave:
@@ -243,7 +536,7 @@ func (peerInfo *PeerInfo) SendMsg(sessionInfo *TrntSessionInfo,
 		}
 
 	case gotrntmessages.MsgTypeBitfield:
-		if sessionInfo.peerMgr.myInfo.BitField.BitLen() > 0 {
+		if sessionInfo.peerMgr.myInfo.BitField.Count() > 0 {
 			var msgData gotrntmessages.MsgDataBitfield
 			msgData.MsgType = msgType
 			msgData.Bitfield = sessionInfo.peerMgr.myInfo.BitField.Bytes()
@@ -252,7 +545,7 @@ func (peerInfo *PeerInfo) SendMsg(sessionInfo *TrntSessionInfo,
 			}
 		}
 
-	case gotrntmessages.MsgTypeRequest:
+	case gotrntmessages.MsgTypeRequest, gotrntmessages.MsgTypeCancel:
 		if len(v) == 3 {
 			var msgData gotrntmessages.MsgDataRequestCancel
 			msgData.MsgType = msgType
@@ -260,27 +553,53 @@ func (peerInfo *PeerInfo) SendMsg(sessionInfo *TrntSessionInfo,
 			msgData.PieceBytesBegin = v[1].(uint32) // piece begin
 			msgData.PieceBytesLen = v[2].(uint32)   // piece len
 			if buf, ok := gotrntmessages.EncodeMessage(msgType, msgData); ok {
-				if peerInfo.send(msgType, buf) {
-					peerInfo.updateState(PeerStateWaitForPiece)
-					return true
-				}
+				return peerInfo.send(msgType, buf)
 			}
 		} else {
 			log.Println(DebugGetFuncName(), "Invalid arg, len:", len(v),
 				", msg:", gotrntmessages.MsgTypeNames[msgType], ", peer:", peerInfo.Addr)
 		}
 
+	case gotrntmessages.MsgTypePiece:
+		if len(v) == 3 {
+			var msgData gotrntmessages.MsgDataPiece
+			msgData.MsgType = msgType
+			msgData.PieceIndex = v[0].(uint32)      // piece index
+			msgData.PieceBytesBegin = v[1].(uint32) // block begin
+			msgData.PieceBlock = v[2].([]byte)      // block data
+			if buf, ok := gotrntmessages.EncodeMessage(msgType, msgData); ok {
+				return peerInfo.send(msgType, buf)
+			}
+		} else {
+			log.Println(DebugGetFuncName(), "Invalid arg, len:", len(v),
+				", msg:", gotrntmessages.MsgTypeNames[msgType], ", peer:", peerInfo.Addr)
+		}
+
+	case gotrntmessages.MsgTypePort:
+		var msgData gotrntmessages.MsgDataPort
+		msgData.MsgType = msgType
+		msgData.PeerPort = sessionInfo.client.dhtNode.getPort()
+		if buf, ok := gotrntmessages.EncodeMessage(msgType, msgData); ok {
+			return peerInfo.send(msgType, buf)
+		}
+
 	case gotrntmessages.MsgTypeHandshake:
 		var msgData gotrntmessages.MsgDataHandshake
 		msgData.MsgType = msgType
-		msgData.PeerId = trntCfg.PeerId
+		msgData.PeerId = sessionInfo.cfg.PeerId
 		msgData.InfoHash = sessionInfo.metaInfo.InfoHash
-		if buf, ok := gotrntmessages.EncodeMessage(msgType, msgData); ok {
+		if buf, ok := gotrntmessages.EncodeMessage(msgType, msgData); ok && (len(buf) == 68) {
+			// Set extension protocol and DHT bits in reserved bytes
+			buf[25] |= 0x10
+			if sessionInfo.client.dhtNode.IsRunning() && !sessionInfo.isPrivate() {
+				buf[27] |= 0x01
+			}
 			return peerInfo.send(msgType, buf)
 		}
 
 	default:
-		fmt.Println(DebugGetFuncName(), "Unknown msg:", msgType, ", peer:",
+		debugPrintln(sessionInfo.cfg.DebugOutput,
+			DebugGetFuncName(), "Unknown msg:", msgType, ", peer:",
 			peerInfo.Addr)
 	}
 
@@ -289,6 +608,11 @@ func (peerInfo *PeerInfo) SendMsg(sessionInfo *TrntSessionInfo,
 
 // Generic method to send a message to peer; message format is raw bytes
 func (peerInfo *PeerInfo) send(msgType uint, buf []byte) bool {
+	return peerInfo.sendBuf(gotrntmessages.MsgTypeNames[msgType], buf)
+}
+
+// Send an encoded message to peer, msgName is for logging
+func (peerInfo *PeerInfo) sendBuf(msgName string, buf []byte) bool {
 	// Sanity checks
 	if len(buf) == 0 {
 		log.Println(DebugGetFuncName(), "Invalid msg length, to peer:",
@@ -296,10 +620,17 @@ func (peerInfo *PeerInfo) send(msgType uint, buf []byte) bool {
 		return false
 	}
 
-	// Write to socket	
-	fmt.Println(DebugGetFuncName(), "Sending:", gotrntmessages.MsgTypeNames[msgType], ", peer:",
+	// Write to socket
+	debugPrintln(peerInfo.debugOutput, DebugGetFuncName(), "Sending:", msgName, ", peer:",
 		peerInfo.Addr)
-	if _, er := peerInfo.Conn.Write(buf); er != nil {
+	conn := peerInfo.getConn()
+	if conn == nil {
+		log.Println(DebugGetFuncName(), "Not connected, peer:", peerInfo.Addr)
+		return false
+	}
+	peerInfo.sendMutex.Lock()
+	defer peerInfo.sendMutex.Unlock()
+	if _, er := conn.Write(buf); er != nil {
 		log.Println(DebugGetFuncName(), er, ", peer:", peerInfo.Addr)
 		return false
 	}
@@ -308,10 +639,60 @@ func (peerInfo *PeerInfo) send(msgType uint, buf []byte) bool {
 
 // Get peer's current state
 func (peerInfo *PeerInfo) getState() uint32 {
-	return peerInfo.State
+	return atomic.LoadUint32(&peerInfo.State)
 }
 
 // Update peer's state based on messages processed
 func (peerInfo *PeerInfo) updateState(newState uint32) {
-	peerInfo.State = newState
+	atomic.StoreUint32(&peerInfo.State, newState)
+}
+
+// Move peer to new state if it's still in old state, so that a choke or
+// unchoke that comes in meanwhile isn't overwritten. Returns false if peer
+// wasn't in old state.
+func (peerInfo *PeerInfo) casState(oldState, newState uint32) bool {
+	return atomic.CompareAndSwapUint32(&peerInfo.State, oldState, newState)
+}
+
+// Note that peer sent a block, which ends its snubbing if any
+func (peerInfo *PeerInfo) gotBlock() {
+	peerInfo.setLastBlockTime(time.Now())
+	if atomic.CompareAndSwapInt32(&peerInfo.snubbed, 1, 0) {
+		log.Println(DebugGetFuncName(), "No longer snubbed, peer:", peerInfo.Addr)
+	}
+}
+
+// Get when peer last sent a block, or when we began waiting on it
+func (peerInfo *PeerInfo) getLastBlockTime() time.Time {
+	return time.Unix(0, atomic.LoadInt64(&peerInfo.lastBlockAt))
+}
+
+// Set when peer last sent a block, or when we began waiting on it
+func (peerInfo *PeerInfo) setLastBlockTime(t time.Time) {
+	atomic.StoreInt64(&peerInfo.lastBlockAt, t.UnixNano())
+}
+
+// Check if peer is interested in us
+func (peerInfo *PeerInfo) isInterested() bool {
+	return atomic.LoadInt32(&peerInfo.IsInterested) != 0
+}
+
+// Note whether peer is interested in us, as told by peer
+func (peerInfo *PeerInfo) setInterested(isInterested bool) {
+	atomic.StoreInt32(&peerInfo.IsInterested, getAtomicBool(isInterested))
+}
+
+// Check if we're choking peer
+func (peerInfo *PeerInfo) amChoking() bool {
+	return atomic.LoadInt32(&peerInfo.AmChoking) != 0
+}
+
+// Note whether we're choking peer
+func (peerInfo *PeerInfo) setAmChoking(amChoking bool) {
+	atomic.StoreInt32(&peerInfo.AmChoking, getAtomicBool(amChoking))
+}
+
+// Check if peer is snubbed, that is it sent no block for SnubTimeout
+func (peerInfo *PeerInfo) isSnubbed() bool {
+	return atomic.LoadInt32(&peerInfo.snubbed) != 0
 }
@@ -1,34 +1,116 @@
-package main
+package gotrnt
 
 import (
-	"fmt"
+	"github.com/swatkat/gotrntmessages"
 	"log"
 	"net"
 )
 
-func StartGoTrntListener() bool {
-	fmt.Println("=======================Starting listener=======================")
-	go goTrntListener()
+// Start accepting connections from peers
+func (client *Client) startListener() bool {
+	debugPrintln(client.cfg.DebugOutput,
+		"=======================Starting listener=======================")
+	listener, er := net.ListenTCP("tcp", client.cfg.MyTCPAddr)
+	if er != nil {
+		log.Println(DebugGetFuncName(), er)
+		return false
+	}
+	debugPrintln(client.cfg.DebugOutput, DebugGetFuncName(), "My address: ", listener.Addr())
+	client.listener = listener
+	client.listenerDone = make(chan bool)
+	go client.acceptPeers(listener, client.listenerDone)
 	return true
 }
 
-func goTrntListener() bool {
-	tcpListener, er := net.ListenTCP("tcp", trntCfg.MyTCPAddr)
-	if er != nil {
-		log.Println(DebugGetFuncName(), er)
+// Stop accepting connections, and wait till listener is done
+func (client *Client) stopListener() bool {
+	if client.listener == nil {
 		return false
 	}
-	fmt.Println("=======================Listener started==================")
-	peerConn, er := tcpListener.AcceptTCP()
-	if er != nil {
+	if er := client.listener.Close(); er != nil {
 		log.Println(DebugGetFuncName(), er)
 	}
-	fmt.Println("Accepted conn from ", peerConn)
+	<-client.listenerDone
+	client.listener = nil
 	return true
 }
 
-func WaitForGoTrntListener() bool {
-	fmt.Println(DebugGetFuncName(), "Waiting on listener chan")
-	done := <-trntCfg.WaitForListener
-	return done
+// Accept connections from peers till listener is closed
+func (client *Client) acceptPeers(listener *net.TCPListener, done chan bool) {
+	debugPrintln(client.cfg.DebugOutput,
+		"=======================Listener started==================")
+	defer close(done)
+	for {
+		peerConn, er := listener.AcceptTCP()
+		if er != nil {
+			log.Println(DebugGetFuncName(), er)
+			return
+		}
+		debugPrintln(client.cfg.DebugOutput, "Accepted conn from ", peerConn.RemoteAddr())
+		go client.handleIncomingPeer(peerConn)
+	}
+}
+
+// Read handshake from a peer that connected to us, and hand it over to the
+// session having the infohash that peer wants
+func (client *Client) handleIncomingPeer(peerConn net.Conn) {
+	peerIpPort := peerConn.RemoteAddr().String()
+	if !client.acquireConn() {
+		log.Println(DebugGetFuncName(), "Too many connections, peer:", peerIpPort)
+		peerConn.Close()
+		return
+	}
+	defer client.releaseConn()
+
+	msgData, reserved, ok := readHandshake(peerConn, client.cfg.HandshakeTimeout)
+	if !ok {
+		log.Println(DebugGetFuncName(), "Error decoding handshake msg, peer:",
+			peerIpPort)
+		peerConn.Close()
+		return
+	}
+	sessionInfo, ok := client.findSession(msgData.(gotrntmessages.MsgDataHandshake).InfoHash)
+	if !ok {
+		log.Println(DebugGetFuncName(), "No session for infohash, peer:", peerIpPort)
+		peerConn.Close()
+		return
+	}
+
+	// Register the peer with its session
+	peerInfo := new(PeerInfo)
+	peerInfo.Init(peerIpPort, sessionInfo.getNumPieces())
+	peerInfo.debugOutput = sessionInfo.cfg.DebugOutput
+	peerInfo.Conn = peerConn
+	peerInfo.SupportsExt = supportsExtensions(reserved)
+	peerInfo.SupportsDht = supportsDht(reserved)
+	if !sessionInfo.peerMgr.addPeer(peerInfo) {
+		log.Println(DebugGetFuncName(), "Already connected, peer:", peerIpPort)
+		peerConn.Close()
+		return
+	}
+
+	peerInfo.acceptMsgs(sessionInfo, msgData)
+	sessionInfo.peerMgr.removePeer(peerIpPort, peerInfo)
+}
+
+// Make a session available to incoming peers
+func (client *Client) registerSession(sessionInfo *TrntSessionInfo) {
+	client.sessionMutex.Lock()
+	client.sessionMap[sessionInfo.metaInfo.InfoHash] = sessionInfo
+	client.sessionMutex.Unlock()
+}
+
+// Stop handing over incoming peers to a session
+func (client *Client) unregisterSession(sessionInfo *TrntSessionInfo) {
+	client.sessionMutex.Lock()
+	delete(client.sessionMap, sessionInfo.metaInfo.InfoHash)
+	client.sessionMutex.Unlock()
+}
+
+// Find session for an infohash
+func (client *Client) findSession(infoHash string) (*TrntSessionInfo, bool) {
+	client.sessionMutex.RLock()
+	defer client.sessionMutex.RUnlock()
+	sessionInfo, ok := client.sessionMap[infoHash]
+	return sessionInfo, ok
 }
@@ -1,14 +1,17 @@
-package main
+package gotrnt
 
 import (
-	"fmt"
 	"log"
+	"sync"
 )
 
 // Peer communication manager
 type PeerMgr struct {
-	peerMap map[string]*PeerInfo // Map of ip:port -> PeerInfo
-	myInfo  PeerInfo             // Our info
+	peerMap    map[string]*PeerInfo // Map of ip:port -> PeerInfo
+	myInfo     PeerInfo             // Our info
+	candidates map[string]uint8     // Peers learned from other peers, not yet connected; ip:port -> pex flags
+	mutex      sync.RWMutex         // Guards peerMap and candidates
+	quit       chan bool            // Closed to stop peer exchange
 }
 
 // Start peermgr
@@ -19,34 +22,149 @@ func (peerMgr *PeerMgr) Start(sessionInfo *TrntSessionInfo) bool {
 		return false
 	}
 
-	fmt.Println(DebugGetFuncName(), "PeerMgr")
+	debugPrintln(sessionInfo.cfg.DebugOutput, DebugGetFuncName(), "PeerMgr")
 
 	// Init our state
-	peerMgr.myInfo.Init("")
+	numPieces := sessionInfo.getNumPieces()
+	peerMgr.myInfo.Init("", numPieces)
 
-	// Loop through all peers obtained from tracker, and then
-	// build a map of ip:port as key and PeerInfo struct as value
+	// Map of ip:port as key and PeerInfo struct as value, peers are added
+	// as announcer gets them from tracker
+	peerMgr.mutex.Lock()
 	peerMgr.peerMap = make(map[string]*PeerInfo)
-	peerIpPortList := sessionInfo.trackerInfo.GetIpPortListFromPeers()
+	peerMgr.candidates = make(map[string]uint8)
+	peerMgr.mutex.Unlock()
+
+	// Exchange peers with peers, private torrents get peers only from tracker
+	peerMgr.quit = make(chan bool)
+	if !sessionInfo.isPrivate() {
+		go peerMgr.pexSender(sessionInfo, peerMgr.quit)
+	}
+
+	return true
+}
+
+// Add peers obtained from tracker, and connect to the ones that are new
+func (peerMgr *PeerMgr) AddPeers(sessionInfo *TrntSessionInfo,
+	peerIpPortList []string) {
+	numPieces := sessionInfo.getNumPieces()
+	var newPeers []*PeerInfo
+	peerMgr.mutex.Lock()
 	for _, val := range peerIpPortList {
+		if _, ok := peerMgr.peerMap[val]; ok || (peerMgr.peerMap == nil) {
+			continue
+		}
 		peerInfo := new(PeerInfo)
-		peerInfo.Init(val)
+		peerInfo.Init(val, numPieces)
+		peerInfo.debugOutput = sessionInfo.cfg.DebugOutput
 		peerMgr.peerMap[peerInfo.Addr] = peerInfo
+		newPeers = append(newPeers, peerInfo)
 	}
+	peerMgr.mutex.Unlock()
 
-	// Loop through all peers and connect to them
-	for _, val := range peerMgr.peerMap {
-		val.Connect(sessionInfo)
+	// Connect to new peers
+	for _, val := range newPeers {
+		go val.Connect(sessionInfo)
 	}
-
-	return true
 }
 
 // Stop peermgr
 func (peerMgr *PeerMgr) Stop() bool {
+	if peerMgr.quit != nil {
+		close(peerMgr.quit)
+		peerMgr.quit = nil
+	}
+
 	// Loop through all peers of this session and disconnect them
-	for _, val := range peerMgr.peerMap {
+	for _, val := range peerMgr.getPeers() {
 		val.Disconnect()
 	}
 	return true
 }
+
+// Get a snapshot of all peers of this session
+func (peerMgr *PeerMgr) getPeers() []*PeerInfo {
+	peerMgr.mutex.RLock()
+	defer peerMgr.mutex.RUnlock()
+	peers := make([]*PeerInfo, 0, len(peerMgr.peerMap))
+	for _, val := range peerMgr.peerMap {
+		peers = append(peers, val)
+	}
+	return peers
+}
+
+// Add a peer that connected to us. Returns false if we already have a peer
+// with same ip:port.
+func (peerMgr *PeerMgr) addPeer(peerInfo *PeerInfo) bool {
+	peerMgr.mutex.Lock()
+	defer peerMgr.mutex.Unlock()
+	if peerMgr.peerMap == nil {
+		return false
+	}
+	if _, ok := peerMgr.peerMap[peerInfo.Addr]; ok {
+		return false
+	}
+	peerMgr.peerMap[peerInfo.Addr] = peerInfo
+	return true
+}
+
+// Remove a peer from this session. Peer is removed only if it's still the
+// one mapped to ip:port, peermgr may have been restarted in between.
+func (peerMgr *PeerMgr) removePeer(peerIpPort string, peerInfo *PeerInfo) {
+	peerMgr.mutex.Lock()
+	if peerMgr.peerMap[peerIpPort] == peerInfo {
+		delete(peerMgr.peerMap, peerIpPort)
+	}
+	peerMgr.mutex.Unlock()
+}
+
+// Add peers learned from other peers to candidate pool, pool doesn't grow
+// beyond MaxCandidates
+func (peerMgr *PeerMgr) addCandidates(sessionInfo *TrntSessionInfo,
+	candidates map[string]uint8) {
+	peerMgr.mutex.Lock()
+	defer peerMgr.mutex.Unlock()
+	if peerMgr.candidates == nil {
+		return
+	}
+	for peerIpPort, flags := range candidates {
+		if len(peerMgr.candidates) >= sessionInfo.cfg.MaxCandidates {
+			break
+		}
+		if _, ok := peerMgr.peerMap[peerIpPort]; ok {
+			continue
+		}
+		peerMgr.candidates[peerIpPort] = flags
+	}
+}
+
+// Remove peers that went away from candidate pool
+func (peerMgr *PeerMgr) removeCandidates(peerIpPortList []string) {
+	peerMgr.mutex.Lock()
+	for _, val := range peerIpPortList {
+		delete(peerMgr.candidates, val)
+	}
+	peerMgr.mutex.Unlock()
+}
+
+// Connect to peers from candidate pool, till we have MaxPeers peers.
+// Reachable peers are tried first.
+func (peerMgr *PeerMgr) connectCandidates(sessionInfo *TrntSessionInfo) {
+	var peerIpPortList []string
+	peerMgr.mutex.Lock()
+	numPeers := sessionInfo.cfg.MaxPeers - len(peerMgr.peerMap)
+	for _, reachable := range []bool{true, false} {
+		for peerIpPort, flags := range peerMgr.candidates {
+			if len(peerIpPortList) >= numPeers {
+				break
+			}
+			if ((flags & PexFlagReachable) != 0) == reachable {
+				peerIpPortList = append(peerIpPortList, peerIpPort)
+				delete(peerMgr.candidates, peerIpPort)
+			}
+		}
+	}
+	peerMgr.mutex.Unlock()
+
+	peerMgr.AddPeers(sessionInfo, peerIpPortList)
+}
@@ -0,0 +1,104 @@
+package gotrnt
+
+import (
+	"github.com/swatkat/gotrntmessages"
+	"log"
+	"sync/atomic"
+)
+
+// Queue a block requested by peer, to be sent by uploader
+func (peerInfo *PeerInfo) queueUpload(sessionInfo *TrntSessionInfo,
+	req BlockRequest) bool {
+	// Requests are honoured only while we're unchoking peer
+	if peerInfo.amChoking() {
+		debugPrintln(sessionInfo.cfg.DebugOutput,
+			DebugGetFuncName(), "Request while choked, piece:",
+			req.PieceIndex, ", peer:", peerInfo.Addr)
+		return true
+	}
+	if !sessionInfo.pieceMgr.isValidUploadRequest(sessionInfo, req) {
+		log.Println(DebugGetFuncName(), "Invalid request, piece:", req.PieceIndex,
+			", offset:", req.Begin, ", len:", req.Length, ", peer:", peerInfo.Addr)
+		return false
+	}
+
+	peerInfo.uploadMutex.Lock()
+	defer peerInfo.uploadMutex.Unlock()
+	if len(peerInfo.uploadQueue) >= int(sessionInfo.cfg.MaxUploadQueue) {
+		log.Println(DebugGetFuncName(), "Upload queue full, peer:", peerInfo.Addr)
+		return false
+	}
+	for _, val := range peerInfo.uploadQueue {
+		if val == req {
+			return true
+		}
+	}
+	peerInfo.uploadQueue = append(peerInfo.uploadQueue, req)
+	select {
+	case peerInfo.uploadWake <- true:
+	default:
+	}
+	return true
+}
+
+// Remove a block from upload queue, peer doesn't want it anymore
+func (peerInfo *PeerInfo) cancelUpload(req BlockRequest) {
+	peerInfo.uploadMutex.Lock()
+	defer peerInfo.uploadMutex.Unlock()
+	for i, val := range peerInfo.uploadQueue {
+		if val == req {
+			peerInfo.uploadQueue = append(peerInfo.uploadQueue[:i],
+				peerInfo.uploadQueue[i+1:]...)
+			return
+		}
+	}
+}
+
+// Drop all queued uploads, peer will have to request them again
+func (peerInfo *PeerInfo) clearUploads() {
+	peerInfo.uploadMutex.Lock()
+	peerInfo.uploadQueue = nil
+	peerInfo.uploadMutex.Unlock()
+}
+
+// Take next block to be uploaded off the queue
+func (peerInfo *PeerInfo) nextUpload() (BlockRequest, bool) {
+	peerInfo.uploadMutex.Lock()
+	defer peerInfo.uploadMutex.Unlock()
+	if peerInfo.amChoking() || (len(peerInfo.uploadQueue) == 0) {
+		return BlockRequest{}, false
+	}
+	req := peerInfo.uploadQueue[0]
+	peerInfo.uploadQueue = peerInfo.uploadQueue[1:]
+	return req, true
+}
+
+// Reads requested blocks from storage and sends them to peer, till quit is
+// closed
+func (peerInfo *PeerInfo) uploader(sessionInfo *TrntSessionInfo,
+	wake chan bool, quit chan bool) {
+	for {
+		select {
+		case <-wake:
+		case <-quit:
+			return
+		}
+
+		for {
+			req, ok := peerInfo.nextUpload()
+			if !ok {
+				break
+			}
+			block, ok := sessionInfo.pieceMgr.readBlock(sessionInfo, req)
+			if !ok {
+				continue
+			}
+			if !peerInfo.SendMsg(sessionInfo, gotrntmessages.MsgTypePiece,
+				req.PieceIndex, req.Begin, block) {
+				break
+			}
+			atomic.AddUint64(&peerInfo.Uploaded, uint64(len(block)))
+			atomic.AddUint64(&sessionInfo.Uploaded, uint64(len(block)))
+		}
+	}
+}
@@ -0,0 +1,247 @@
+package gotrnt
+
+import (
+	"log"
+	"net"
+	"strconv"
+	"time"
+)
+
+// Flags of a peer in peer exchange msgs
+const (
+	PexFlagEncryption = 0x01 // Peer prefers encryption
+	PexFlagSeed       = 0x02 // Peer is a seed
+	PexFlagUtp        = 0x04 // Peer supports uTP
+	PexFlagHolepunch  = 0x08 // Peer supports holepunch extension
+	PexFlagReachable  = 0x10 // Peer accepts incoming connections
+)
+
+// Send peer exchange msgs to peers periodically, and connect to peers that
+// we learn from them
+func (peerMgr *PeerMgr) pexSender(sessionInfo *TrntSessionInfo, quit chan bool) {
+	ticker := time.NewTicker(sessionInfo.cfg.PexInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			peerMgr.sendPex(sessionInfo)
+			peerMgr.connectCandidates(sessionInfo)
+		case <-quit:
+			return
+		}
+	}
+}
+
+// Tell each peer supporting ut_pex about peers that we got connected to or
+// dropped, since last msg to it
+func (peerMgr *PeerMgr) sendPex(sessionInfo *TrntSessionInfo) {
+	// Connected peers that others can connect to, with their flags
+	peers := peerMgr.getPeers()
+	current := make(map[string]uint8)
+	for _, val := range peers {
+		if peerIpPort, ok := val.getListenAddr(); ok {
+			current[peerIpPort] = val.getPexFlags()
+		}
+	}
+
+	for _, val := range peers {
+		extMsgId := val.getExtensionId("ut_pex")
+		if !val.isConnected() || (extMsgId == 0) {
+			continue
+		}
+		self, _ := val.getListenAddr()
+		added := make(map[string]uint8)
+		var dropped []string
+		val.pexMutex.Lock()
+		for peerIpPort, flags := range current {
+			if (len(added) < sessionInfo.cfg.MaxPexPeers) && (peerIpPort != self) &&
+				!val.pexPeers[peerIpPort] {
+				added[peerIpPort] = flags
+			}
+		}
+		for peerIpPort := range val.pexPeers {
+			if _, ok := current[peerIpPort]; !ok && (len(dropped) < sessionInfo.cfg.MaxPexPeers) {
+				dropped = append(dropped, peerIpPort)
+			}
+		}
+		val.pexMutex.Unlock()
+		if (len(added) == 0) && (len(dropped) == 0) {
+			continue
+		}
+		if val.sendPexMsg(extMsgId, added, dropped) {
+			val.pexMutex.Lock()
+			for peerIpPort := range added {
+				val.pexPeers[peerIpPort] = true
+			}
+			for _, peerIpPort := range dropped {
+				delete(val.pexPeers, peerIpPort)
+			}
+			val.pexMutex.Unlock()
+		}
+	}
+}
+
+// Send a ut_pex msg, peers are in compact form with IPv4 and IPv6 peers in
+// separate lists
+func (peerInfo *PeerInfo) sendPexMsg(extMsgId uint8, added map[string]uint8,
+	dropped []string) bool {
+	var added4, added4Flags, added6, added6Flags, dropped4, dropped6 []byte
+	for peerIpPort, flags := range added {
+		compactPeer, ok := getCompactPeer(peerIpPort)
+		if !ok {
+			continue
+		}
+		if len(compactPeer) == net.IPv4len+2 {
+			added4 = append(added4, compactPeer...)
+			added4Flags = append(added4Flags, flags)
+		} else {
+			added6 = append(added6, compactPeer...)
+			added6Flags = append(added6Flags, flags)
+		}
+	}
+	for _, peerIpPort := range dropped {
+		compactPeer, ok := getCompactPeer(peerIpPort)
+		if !ok {
+			continue
+		}
+		if len(compactPeer) == net.IPv4len+2 {
+			dropped4 = append(dropped4, compactPeer...)
+		} else {
+			dropped6 = append(dropped6, compactPeer...)
+		}
+	}
+
+	dict := make(map[string]interface{})
+	dict["added"] = string(added4)
+	dict["added.f"] = string(added4Flags)
+	dict["added6"] = string(added6)
+	dict["added6.f"] = string(added6Flags)
+	dict["dropped"] = string(dropped4)
+	dict["dropped6"] = string(dropped6)
+	payload, ok := encodeBencode(dict)
+	if !ok {
+		return false
+	}
+	debugPrintln(peerInfo.debugOutput,
+		DebugGetFuncName(), "Pex, added:", len(added), ", dropped:", len(dropped),
+		", peer:", peerInfo.Addr)
+	return peerInfo.sendExtMsg(extMsgId, payload)
+}
+
+// Process a ut_pex msg. Added peers go to candidate pool, only a few of them
+// are taken from a msg, and a peer sending msgs too often is ignored.
+func processPexMsg(sessionInfo *TrntSessionInfo, peerInfo *PeerInfo,
+	payload []byte) bool {
+	peerInfo.pexMutex.Lock()
+	tooSoon := time.Since(peerInfo.lastPexRecv) < sessionInfo.cfg.PexInterval/2
+	if !tooSoon {
+		peerInfo.lastPexRecv = time.Now()
+	}
+	peerInfo.pexMutex.Unlock()
+	if tooSoon {
+		log.Println(DebugGetFuncName(), "Pex msg too soon, peer:", peerInfo.Addr)
+		return true
+	}
+	dict, ok := decodeBencodeDict(payload)
+	if !ok {
+		return false
+	}
+
+	candidates := make(map[string]uint8)
+	for _, key := range []string{"added", "added6"} {
+		peers, _ := dict[key].(string)
+		flags, _ := dict[key+".f"].(string)
+		ipLen := net.IPv4len
+		if key == "added6" {
+			ipLen = net.IPv6len
+		}
+		for i, val := range parseCompactPeers(peers, ipLen) {
+			if len(candidates) >= sessionInfo.cfg.MaxPexPeers {
+				break
+			}
+			if !isValidPeerAddr(val) {
+				continue
+			}
+			candidates[val] = 0
+			if i < len(flags) {
+				candidates[val] = flags[i]
+			}
+		}
+	}
+
+	var dropped []string
+	for _, key := range []string{"dropped", "dropped6"} {
+		peers, _ := dict[key].(string)
+		ipLen := net.IPv4len
+		if key == "dropped6" {
+			ipLen = net.IPv6len
+		}
+		dropped = append(dropped, parseCompactPeers(peers, ipLen)...)
+	}
+	debugPrintln(sessionInfo.cfg.DebugOutput,
+		DebugGetFuncName(), "Pex, added:", len(candidates), ", dropped:",
+		len(dropped), ", peer:", peerInfo.Addr)
+
+	sessionInfo.peerMgr.removeCandidates(dropped)
+	sessionInfo.peerMgr.addCandidates(sessionInfo, candidates)
+	sessionInfo.peerMgr.connectCandidates(sessionInfo)
+	return true
+}
+
+// Get ip:port on which peer accepts connections. That's the address we
+// connected to, or the port that peer told in extended handshake.
+func (peerInfo *PeerInfo) getListenAddr() (string, bool) {
+	if !peerInfo.isConnected() {
+		return "", false
+	}
+	if peerInfo.Outgoing {
+		return peerInfo.Addr, len(peerInfo.Addr) > 0
+	}
+	host, _, er := net.SplitHostPort(peerInfo.Addr)
+	if (er != nil) || (peerInfo.ListenPort == 0) {
+		return "", false
+	}
+	return net.JoinHostPort(host, strconv.Itoa(int(peerInfo.ListenPort))), true
+}
+
+// Get flags of a peer to be sent in peer exchange msgs
+func (peerInfo *PeerInfo) getPexFlags() uint8 {
+	var flags uint8
+	if (peerInfo.BitField.Len() > 0) && peerInfo.BitField.IsComplete() {
+		flags |= PexFlagSeed
+	}
+	if peerInfo.Outgoing {
+		flags |= PexFlagReachable
+	}
+	return flags
+}
+
+// Get compact form of ip:port, IP address followed by 2 byte port in network
+// byte order
+func getCompactPeer(peerIpPort string) ([]byte, bool) {
+	host, portStr, er := net.SplitHostPort(peerIpPort)
+	if er != nil {
+		return nil, false
+	}
+	port, er := strconv.ParseUint(portStr, 10, 16)
+	ip := net.ParseIP(host)
+	if (er != nil) || (ip == nil) {
+		return nil, false
+	}
+	if ip4 := ip.To4(); ip4 != nil {
+		ip = ip4
+	}
+	compactPeer := make([]byte, 0, len(ip)+2)
+	compactPeer = append(compactPeer, ip...)
+	return append(compactPeer, getBytesFromUint16(uint16(port))...), true
+}
+
+// Check that a peer address got from another peer is worth connecting to
+func isValidPeerAddr(peerIpPort string) bool {
+	host, portStr, er := net.SplitHostPort(peerIpPort)
+	if er != nil {
+		return false
+	}
+	ip := net.ParseIP(host)
+	return (ip != nil) && !ip.IsUnspecified() && !ip.IsMulticast() && (portStr != "0")
+}
@@ -1,13 +1,11 @@
-package main
+package gotrnt
 
 import (
-	"bytes"
-	"fmt"
+	"crypto/sha1"
 	"github.com/swatkat/gotrntmessages"
 	"log"
-	"math/big"
-	"os"
-	"runtime"
+	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -17,11 +15,62 @@ type PieceChunkData struct {
 	pieceInfo gotrntmessages.MsgDataPiece // Actual piece
 }
 
+// A block of a piece, as requested from a peer
+type BlockRequest struct {
+	PieceIndex uint32 // Piece index
+	Begin      uint32 // Byte offset of block within piece
+	Length     uint32 // Block length
+}
+
+// Piece being assembled from downloaded blocks, kept in memory until verified
+type PieceProgress struct {
+	Index          uint32             // Piece index
+	Data           []byte             // Piece data, filled in as blocks arrive
+	BlockRequested []bool             // Blocks requested from some peer, and not yet received
+	BlockDone      []bool             // Blocks received so far
+	BlocksLeft     int                // Number of blocks yet to be received
+	Peers          map[*PeerInfo]bool // Peers that sent blocks of this piece
+}
+
 // Piece download/upload manager
 type PieceMgr struct {
-	PieceWriterChan chan PieceChunkData // Incoming pieces downloaded from peers
-	PieceMap        map[int64]uint32    // Piece index -> piece offset map
-	Files           []*os.File          // List of file handles
+	PieceWriterChan chan PieceChunkData       // Incoming pieces downloaded from peers
+	storage         Storage                   // Where torrent data is kept, files on disk by default
+	Pieces          map[uint32]*PieceProgress // Pieces being downloaded
+	mutex           sync.Mutex                // Guards Pieces, quit and requests of all peers
+	wakeRequester   chan bool                 // Signals requester that a peer has room for requests
+	picker          PiecePicker               // Decides which piece to download next
+	quit            chan bool                 // Closed to stop requesting pieces and saving resume state
+	ready           int32                     // Set once piecemgr is started, updated atomically
+	blockLen        uint32                    // Length of blocks that pieces are requested in
+	workers         sync.WaitGroup            // Goroutines started by Start, Stop waits for them
+	endgame         int32                     // Set while in endgame, updated atomically
+}
+
+// Init piecemgr, must be done before peers start sending their pieces info
+func (pieceMgr *PieceMgr) Init(sessionInfo *TrntSessionInfo) bool {
+	// Sanity checks
+	if sessionInfo == nil {
+		log.Println(DebugGetFuncName(), "Invalid param")
+		return false
+	}
+
+	// Open storage, peers may start requesting pieces right away
+	storage, er := sessionInfo.openStorage()
+	if er != nil {
+		log.Println(DebugGetFuncName(), er)
+		return false
+	}
+	pieceMgr.storage = storage
+
+	pieceMgr.blockLen = sessionInfo.cfg.PieceBlockLen
+	pieceMgr.PieceWriterChan = make(chan PieceChunkData, 5)
+	pieceMgr.Pieces = make(map[uint32]*PieceProgress)
+	pieceMgr.wakeRequester = make(chan bool, 1)
+	picker := new(RarestFirstPicker)
+	picker.Init(sessionInfo.getNumPieces(), sessionInfo.cfg.RandomFirstPieces)
+	pieceMgr.picker = picker
+	return true
 }
 
 // Start piecemgr
@@ -29,190 +78,579 @@ func (pieceMgr *PieceMgr) Start(sessionInfo *TrntSessionInfo) bool {
 	// Sanity checks
 	if sessionInfo == nil {
 		log.Println(DebugGetFuncName(), "Invalid param")
+		return false
 	}
 
-	fmt.Println(DebugGetFuncName(), "PieceMgr")
-	pieceMgr.PieceWriterChan = make(chan PieceChunkData, 5)
-	pieceMgr.PieceMap = make(map[int64]uint32)
+	debugPrintln(sessionInfo.cfg.DebugOutput, DebugGetFuncName(), "PieceMgr")
+
+	// Find out which pieces we already have
+	pieceMgr.loadPieces(sessionInfo)
+	if sessionInfo.peerMgr.myInfo.BitField.IsComplete() {
+		sessionInfo.setCompleted()
+	}
 
 	// Start torrenting
-	go pieceMgr.pieceRequester(sessionInfo)
-	go pieceMgr.pieceReceiver(sessionInfo)
+	quit := make(chan bool)
+	pieceMgr.mutex.Lock()
+	pieceMgr.quit = quit
+	pieceMgr.mutex.Unlock()
+	pieceMgr.workers.Add(3)
+	go pieceMgr.pieceRequester(sessionInfo, quit)
+	go pieceMgr.pieceReceiver(sessionInfo, quit)
+	go pieceMgr.resumeSaver(sessionInfo, quit)
+	atomic.StoreInt32(&pieceMgr.ready, 1)
 
 	return true
 }
 
-func (pieceMgr *PieceMgr) Stop() bool {
-	fmt.Println(DebugGetFuncName(), "Stop")
+func (pieceMgr *PieceMgr) Stop(sessionInfo *TrntSessionInfo) bool {
+	debugPrintln(sessionInfo.cfg.DebugOutput, DebugGetFuncName(), "Stop")
+	atomic.StoreInt32(&pieceMgr.ready, 0)
+	atomic.StoreInt32(&pieceMgr.endgame, 0)
+	pieceMgr.mutex.Lock()
+	quit := pieceMgr.quit
+	pieceMgr.quit = nil
+	pieceMgr.mutex.Unlock()
+	if quit != nil {
+		close(quit)
+		pieceMgr.workers.Wait()
+		pieceMgr.saveResume(sessionInfo)
+	}
+	if pieceMgr.storage != nil {
+		pieceMgr.storage.Close()
+	}
 	return true
 }
 
+// Check if piecemgr is started. It isn't till we have metadata, so msgs
+// about pieces are ignored till then.
+func (pieceMgr *PieceMgr) isReady() bool {
+	return atomic.LoadInt32(&pieceMgr.ready) == 1
+}
+
 // Sends piece requests to peers
-func (pieceMgr *PieceMgr) pieceRequester(sessionInfo *TrntSessionInfo) {
+func (pieceMgr *PieceMgr) pieceRequester(sessionInfo *TrntSessionInfo, quit chan bool) {
+	defer pieceMgr.workers.Done()
+
 	// Plan:
-	// 1. Find rare pieces
-	// 2. Send Interested to all peers with rare pieces
-	// 3. Wait for Unchoke message from peers
-	// 4. Send request for pieces
-	// 5. Repeat
+	// 1. Let peers know whether they have pieces that we don't
+	// 2. Wait for Unchoke message from peers
+	// 3. Keep requesting blocks of pieces that are already being downloaded
+	// 4. Ask picker for more pieces to download, and request their blocks.
+	//    Requests are sent few at a time to each peer.
+	// 5. Once all remaining blocks are requested, go into endgame. Remaining
+	//    blocks are requested from every peer that has them, so that a slow
+	//    peer doesn't hold up the last pieces.
+	// 6. Take back requests that peers didn't answer in time, so that they
+	//    are requested again. Peers that send nothing are snubbed.
+	// 7. Repeat
+	myBitField := sessionInfo.peerMgr.myInfo.BitField
 	for {
-		rarePieces := pieceMgr.findRarePieces(sessionInfo)
-		for i := 0; i < rarePieces.BitLen(); i++ {
-			if rarePieces.Bit(i) == 0 {
+		pieceMgr.updateEndgame(sessionInfo)
+		peers := sessionInfo.peerMgr.getPeers()
+		pieceMgr.expireRequests(sessionInfo, peers)
+		for _, val := range peers {
+			if !val.isConnected() {
 				continue
 			}
-			peerInfo, ok := pieceMgr.findPeerForPiece(sessionInfo, uint32(i))
-			if !ok {
-				continue
+			isInteresting := pieceMgr.isPeerInteresting(sessionInfo, val)
+			if isInteresting && !val.AmInterested {
+				val.SendMsg(sessionInfo, gotrntmessages.MsgTypeInterested)
+			} else if !isInteresting && val.AmInterested {
+				val.SendMsg(sessionInfo, gotrntmessages.MsgTypeNotInterested)
 			}
-			switch peerInfo.State {
-			case PeerStateChoked:
-				peerInfo.SendMsg(sessionInfo, gotrntmessages.MsgTypeInterested)
 
+			switch val.getState() {
 			case PeerStateUnchoked:
-				pieceIdx := uint32(peerInfo.BitField.BitLen() - i)
-				pieceOffset := uint32(0)
-				pieceLen := uint32(trntCfg.PieceBlockLen)
-				peerInfo.SendMsg(sessionInfo, gotrntmessages.MsgTypeRequest, pieceIdx, pieceOffset,
-					pieceLen)
+				// Pieces in progress first, so that they get completed soon
+				pieceMgr.requestBlocks(sessionInfo, val, nil)
+				for val.getState() == PeerStateUnchoked {
+					pieceMgr.mutex.Lock()
+					pieceIdx, ok := pieceMgr.picker.PickPiece(myBitField, val.BitField,
+						func(i uint32) bool {
+							_, inProgress := pieceMgr.Pieces[i]
+							return inProgress
+						})
+					pieceMgr.mutex.Unlock()
+					if !ok || (pieceMgr.requestBlocks(sessionInfo, val, &pieceIdx) == 0) {
+						break
+					}
+				}
 			}
+		}
 
-			// Let peer go routines do their stuff now
-			runtime.Gosched()
+		// Wait till a peer has room for more requests, we don't want to hog CPU
+		select {
+		case <-pieceMgr.wakeRequester:
+		case <-time.After(sessionInfo.cfg.RequestInterval):
+		case <-quit:
+			return
 		}
+	}
+}
 
-		// We don't want to hog CPU
-		runtime.Gosched()
+// Check if peer has any piece that we don't
+func (pieceMgr *PieceMgr) isPeerInteresting(sessionInfo *TrntSessionInfo,
+	peerInfo *PeerInfo) bool {
+	return peerInfo.BitField.AndNot(sessionInfo.peerMgr.myInfo.BitField).Count() > 0
+}
+
+// Update piece availability from a peer's bitfield. Returns false if
+// bitfield isn't valid for this torrent.
+func (pieceMgr *PieceMgr) peerBitField(peerInfo *PeerInfo, bitField []byte) bool {
+	newBitField := NewBitfield(peerInfo.BitField.Len())
+	if !newBitField.SetBytes(bitField) {
+		return false
 	}
+	pieceMgr.picker.RemovePeerPieces(peerInfo.BitField)
+	peerInfo.BitField.SetBytes(bitField)
+	pieceMgr.picker.AddPeerPieces(peerInfo.BitField)
+	return true
+}
 
-	return
+// Update piece availability from a peer's have message
+func (pieceMgr *PieceMgr) peerHave(peerInfo *PeerInfo, pieceIdx uint32) bool {
+	if pieceIdx >= peerInfo.BitField.Len() {
+		return false
+	}
+	if !peerInfo.BitField.Get(pieceIdx) {
+		peerInfo.BitField.Set(pieceIdx)
+		pieceMgr.picker.AddPeerPiece(pieceIdx)
+	}
+	return true
 }
 
-// Build a bitfield containing rare pieces, that is pieces which very few peers have
-func (pieceMgr *PieceMgr) findRarePieces(sessionInfo *TrntSessionInfo) *big.Int {
-	rarePieces := big.NewInt(sessionInfo.peerMgr.myInfo.BitField.Int64())
-	for _, val := range sessionInfo.peerMgr.peerMap {
-		rarePieces.Xor(rarePieces, val.BitField)
+// Peer went away, its pieces are no longer available and its requests
+// must go to other peers
+func (pieceMgr *PieceMgr) peerDisconnected(peerInfo *PeerInfo) {
+	if !pieceMgr.isReady() {
+		return
 	}
-	return rarePieces
+	pieceMgr.picker.RemovePeerPieces(peerInfo.BitField)
+	pieceMgr.releaseRequests(peerInfo)
 }
 
-// Find a peer having required piece
-func (pieceMgr *PieceMgr) findPeerForPiece(sessionInfo *TrntSessionInfo,
-	pieceIdx uint32) (*PeerInfo, bool) {
-	for _, val := range sessionInfo.peerMgr.peerMap {
-		if val.BitField.Bit(int(pieceIdx)) != 0 {
-			return val, true
+// Send requests for blocks to a peer, till its request pipeline is full.
+// Blocks are taken from given piece, or from pieces in progress if piece
+// is nil. Returns number of requests sent.
+func (pieceMgr *PieceMgr) requestBlocks(sessionInfo *TrntSessionInfo,
+	peerInfo *PeerInfo, pieceIdx *uint32) int {
+	// Pick blocks to request
+	var requests []BlockRequest
+	pieceMgr.mutex.Lock()
+	if pieceIdx != nil {
+		piece, ok := pieceMgr.Pieces[*pieceIdx]
+		if !ok {
+			piece = pieceMgr.newPieceProgress(sessionInfo, *pieceIdx)
+			pieceMgr.Pieces[*pieceIdx] = piece
+		}
+		requests = pieceMgr.addBlockRequests(sessionInfo, peerInfo, piece, requests)
+	} else {
+		for _, piece := range pieceMgr.Pieces {
+			if peerInfo.BitField.Get(piece.Index) {
+				requests = pieceMgr.addBlockRequests(sessionInfo, peerInfo, piece, requests)
+			}
+		}
+	}
+	if len(peerInfo.Requests) >= pieceMgr.getMaxRequests(sessionInfo, peerInfo) {
+		peerInfo.casState(PeerStateUnchoked, PeerStateWaitForPiece)
+	}
+	pieceMgr.mutex.Unlock()
+
+	// Send requests, and take back the ones that couldn't be sent
+	for i, req := range requests {
+		if !peerInfo.SendMsg(sessionInfo, gotrntmessages.MsgTypeRequest,
+			req.PieceIndex, req.Begin, req.Length) {
+			pieceMgr.releaseRequests(peerInfo)
+			return i
 		}
 	}
-	fmt.Println(DebugGetFuncName(), "No peers have piece:", pieceIdx)
-	return nil, false
+	return len(requests)
 }
 
-// Writes downloaded pieces to file
-func (pieceMgr *PieceMgr) pieceReceiver(sessionInfo *TrntSessionInfo) {
-	// Open files
-	if !pieceMgr.openFiles(sessionInfo) {
-		return
+// Mark unrequested blocks of a piece as requested from peer, till peer's
+// request pipeline is full. In endgame, blocks already requested from other
+// peers are taken too. Caller must hold piecemgr lock.
+func (pieceMgr *PieceMgr) addBlockRequests(sessionInfo *TrntSessionInfo,
+	peerInfo *PeerInfo, piece *PieceProgress, requests []BlockRequest) []BlockRequest {
+	pieceLen := sessionInfo.getPieceLength(piece.Index)
+	endgame := pieceMgr.isEndgame()
+	maxRequests := pieceMgr.getMaxRequests(sessionInfo, peerInfo)
+	for blockIdx := range piece.BlockDone {
+		if len(peerInfo.Requests) >= maxRequests {
+			break
+		}
+		if piece.BlockDone[blockIdx] || (piece.BlockRequested[blockIdx] && !endgame) {
+			continue
+		}
+		var req BlockRequest
+		req.PieceIndex = piece.Index
+		req.Begin = uint32(blockIdx) * pieceMgr.blockLen
+		req.Length = pieceMgr.getBlockLength(pieceLen, req.Begin)
+		if _, ok := peerInfo.Requests[req]; ok {
+			continue
+		}
+		if piece.BlockRequested[blockIdx] {
+			atomic.AddUint64(&sessionInfo.Duplicates, 1)
+		}
+		// Peer's wait for a block starts with first request
+		if len(peerInfo.Requests) == 0 {
+			peerInfo.setLastBlockTime(time.Now())
+		}
+		piece.BlockRequested[blockIdx] = true
+		peerInfo.Requests[req] = time.Now()
+		requests = append(requests, req)
 	}
-	for _, f := range pieceMgr.Files {
-		defer f.Close()
+	return requests
+}
+
+// Go into endgame once every missing block is requested from some peer, and
+// come out of it if that's no longer so, e.g. a piece failed hash check
+func (pieceMgr *PieceMgr) updateEndgame(sessionInfo *TrntSessionInfo) {
+	numMissing := sessionInfo.getNumPieces() - sessionInfo.peerMgr.myInfo.BitField.Count()
+	pieceMgr.mutex.Lock()
+	endgame := (numMissing > 0) && (uint32(len(pieceMgr.Pieces)) >= numMissing)
+	for _, piece := range pieceMgr.Pieces {
+		if !endgame {
+			break
+		}
+		for blockIdx, done := range piece.BlockDone {
+			if !done && !piece.BlockRequested[blockIdx] {
+				endgame = false
+				break
+			}
+		}
 	}
-	pieceMgr.loadPieceMap(sessionInfo)
+	pieceMgr.mutex.Unlock()
 
-	for {
-		select {
-		case chunkData := <-pieceMgr.PieceWriterChan:
-			/*// Update piece map
-			newChunkOffset := chunkData.pieceInfo.PieceBytesBegin + uint32(len(chunkData.pieceInfo.PieceBlock))
-			pieceMgr.updatePieceMap(sessionInfo, int64(chunkData.pieceInfo.PieceIndex), newChunkOffset)
-
-			// Update our own bitfield
-			if newChunkOffset >= uint32(sessionInfo.metaInfo.Info.PieceLength) {
-				idx := chunkData.peerInfo.BitField.BitLen() - int(chunkData.pieceInfo.PieceIndex)
-				sessionInfo.peerMgr.myInfo.BitField.SetBit(sessionInfo.peerMgr.myInfo.BitField, idx, 1)
-			}*/
-
-			// Write to file
-			fileByteOffset := (sessionInfo.metaInfo.Info.PieceLength *
-				int64(chunkData.pieceInfo.PieceIndex)) + int64(chunkData.pieceInfo.PieceBytesBegin)
-			bytesWritten, er := pieceMgr.Files[0].WriteAt(chunkData.pieceInfo.PieceBlock, fileByteOffset)
-			if er != nil {
-				log.Println(DebugGetFuncName(), er)
+	if endgame && !pieceMgr.isEndgame() {
+		debugPrintln(sessionInfo.cfg.DebugOutput,
+			DebugGetFuncName(), "Endgame, pieces left:", numMissing)
+	}
+	if endgame {
+		atomic.StoreInt32(&pieceMgr.endgame, 1)
+	} else {
+		atomic.StoreInt32(&pieceMgr.endgame, 0)
+	}
+}
+
+// Check if we're in endgame
+func (pieceMgr *PieceMgr) isEndgame() bool {
+	return atomic.LoadInt32(&pieceMgr.endgame) == 1
+}
+
+// Cancel requests for a block with peers other than the one that sent it.
+// Peers are let go of waiting for the block, as it may have been all that
+// they were sending us.
+func (pieceMgr *PieceMgr) cancelDuplicates(sessionInfo *TrntSessionInfo,
+	peers []*PeerInfo, sender *PeerInfo, req BlockRequest) {
+	var cancelPeers []*PeerInfo
+	pieceMgr.mutex.Lock()
+	for _, val := range peers {
+		if _, ok := val.Requests[req]; ok && (val != sender) {
+			delete(val.Requests, req)
+			cancelPeers = append(cancelPeers, val)
+		}
+	}
+	pieceMgr.mutex.Unlock()
+
+	for _, val := range cancelPeers {
+		val.casState(PeerStateWaitForPiece, PeerStateUnchoked)
+		val.SendMsg(sessionInfo, gotrntmessages.MsgTypeCancel, req.PieceIndex, req.Begin,
+			req.Length)
+	}
+}
+
+// Get size of a peer's request pipeline, a snubbed peer gets one request at
+// a time
+func (pieceMgr *PieceMgr) getMaxRequests(sessionInfo *TrntSessionInfo,
+	peerInfo *PeerInfo) int {
+	if peerInfo.isSnubbed() {
+		return 1
+	}
+	return int(sessionInfo.cfg.MaxPeerRequests)
+}
+
+// Get time within which a peer should send a block requested from it. It's
+// twice the time that peer takes to send all its outstanding blocks at its
+// observed rate, but no less than RequestTimeout. A peer that has sent
+// nothing yet gets SnubTimeout. Caller must hold piecemgr lock.
+func (pieceMgr *PieceMgr) getRequestTimeout(sessionInfo *TrntSessionInfo,
+	peerInfo *PeerInfo) time.Duration {
+	rate := atomic.LoadUint64(&peerInfo.downloadBps)
+	if rate == 0 {
+		return sessionInfo.cfg.SnubTimeout
+	}
+	queueLen := uint64(len(peerInfo.Requests)) * uint64(pieceMgr.blockLen)
+	timeout := 2 * time.Duration(queueLen*uint64(time.Second)/rate)
+	if timeout < sessionInfo.cfg.RequestTimeout {
+		timeout = sessionInfo.cfg.RequestTimeout
+	}
+	return timeout
+}
+
+// Take back requests that peers didn't answer in time, so that those blocks
+// get requested again, from other peers if need be. A peer that sends no
+// block for SnubTimeout is snubbed; all its requests are taken back, and it
+// gets one request at a time till it sends a block again.
+func (pieceMgr *PieceMgr) expireRequests(sessionInfo *TrntSessionInfo, peers []*PeerInfo) {
+	now := time.Now()
+	expired := make(map[*PeerInfo][]BlockRequest)
+	pieceMgr.mutex.Lock()
+	for _, val := range peers {
+		if len(val.Requests) == 0 {
+			continue
+		}
+		snub := !val.isSnubbed() &&
+			(now.Sub(val.getLastBlockTime()) >= sessionInfo.cfg.SnubTimeout)
+		if snub {
+			atomic.StoreInt32(&val.snubbed, 1)
+			log.Println(DebugGetFuncName(), "Snubbed, peer:", val.Addr)
+		}
+		timeout := pieceMgr.getRequestTimeout(sessionInfo, val)
+		for req, requestedAt := range val.Requests {
+			if !snub && (now.Sub(requestedAt) < timeout) {
 				continue
 			}
-			fmt.Println(DebugGetFuncName(), "Write to file, piece:",
-				chunkData.pieceInfo.PieceIndex, ", offset:", fileByteOffset,
-				", bytes written:", bytesWritten /*, ", data:", chunkData.pieceInfo.PieceBlock*/)
+			if piece, ok := pieceMgr.Pieces[req.PieceIndex]; ok {
+				piece.BlockRequested[req.Begin/pieceMgr.blockLen] = false
+			}
+			delete(val.Requests, req)
+			expired[val] = append(expired[val], req)
+		}
+	}
+	pieceMgr.mutex.Unlock()
 
-		case <-time.Tick(time.Nanosecond):
+	for peerInfo, requests := range expired {
+		debugPrintln(sessionInfo.cfg.DebugOutput,
+			DebugGetFuncName(), "Requests timed out:", len(requests), ", peer:",
+			peerInfo.Addr)
+		peerInfo.casState(PeerStateWaitForPiece, PeerStateUnchoked)
+		for _, req := range requests {
+			peerInfo.SendMsg(sessionInfo, gotrntmessages.MsgTypeCancel, req.PieceIndex,
+				req.Begin, req.Length)
 		}
+	}
+}
 
-		// Let other go routines do their stuff
-		runtime.Gosched()
+// Forget all requests outstanding with a peer, so that those blocks can be
+// requested from other peers. Used when peer chokes us or goes away.
+func (pieceMgr *PieceMgr) releaseRequests(peerInfo *PeerInfo) {
+	pieceMgr.mutex.Lock()
+	defer pieceMgr.mutex.Unlock()
+	for req := range peerInfo.Requests {
+		if piece, ok := pieceMgr.Pieces[req.PieceIndex]; ok {
+			piece.BlockRequested[req.Begin/pieceMgr.blockLen] = false
+		}
+		delete(peerInfo.Requests, req)
 	}
 }
 
-// Open files on disk, don't close handles yet
-func (pieceMgr *PieceMgr) openFiles(sessionInfo *TrntSessionInfo) bool {
-	var er error
-	var fileNames []string
+// Create download state of a piece. Caller must hold piecemgr lock.
+func (pieceMgr *PieceMgr) newPieceProgress(sessionInfo *TrntSessionInfo,
+	pieceIdx uint32) *PieceProgress {
+	pieceLen := sessionInfo.getPieceLength(pieceIdx)
+	numBlocks := int((pieceLen + pieceMgr.blockLen - 1) / pieceMgr.blockLen)
+	piece := new(PieceProgress)
+	piece.Index = pieceIdx
+	piece.Data = make([]byte, pieceLen)
+	piece.BlockRequested = make([]bool, numBlocks)
+	piece.BlockDone = make([]bool, numBlocks)
+	piece.BlocksLeft = numBlocks
+	piece.Peers = make(map[*PeerInfo]bool)
+	return piece
+}
 
-	// Build a list of file names
-	if len(sessionInfo.metaInfo.Info.Name) > 0 {
-		fileNames = append(fileNames, sessionInfo.metaInfo.Info.Name)
-	} else {
-		for _, fileInfo := range sessionInfo.metaInfo.Info.Files {
-			fileNames = append(fileNames, fileInfo.Path[0])
-		}
+// Get length of block starting at given offset in a piece, last block of a
+// piece may be shorter than the rest
+func (pieceMgr *PieceMgr) getBlockLength(pieceLen, blockBegin uint32) uint32 {
+	if pieceLen-blockBegin < pieceMgr.blockLen {
+		return pieceLen - blockBegin
 	}
+	return pieceMgr.blockLen
+}
 
-	if len(fileNames) <= 0 {
-		log.Println(DebugGetFuncName(), "No files found")
+// Hand a downloaded block over to piece receiver. Returns false if piecemgr
+// is stopped, as there's nobody left to take it.
+func (pieceMgr *PieceMgr) pushChunk(chunkData PieceChunkData) bool {
+	pieceMgr.mutex.Lock()
+	quit := pieceMgr.quit
+	pieceMgr.mutex.Unlock()
+	if quit == nil {
 		return false
 	}
+	select {
+	case pieceMgr.PieceWriterChan <- chunkData:
+		return true
+	case <-quit:
+		return false
+	}
+}
+
+// Writes downloaded pieces to file
+func (pieceMgr *PieceMgr) pieceReceiver(sessionInfo *TrntSessionInfo, quit chan bool) {
+	defer pieceMgr.workers.Done()
+	for {
+		select {
+		case chunkData := <-pieceMgr.PieceWriterChan:
+			pieceMgr.processChunk(sessionInfo, chunkData)
 
-	// Open these files
-	pieceMgr.Files = make([]*os.File, len(fileNames))
-	for i, f := range fileNames {
-		if pieceMgr.Files[i], er = os.Open(f); er != nil {
-			pieceMgr.Files[i], er = os.Create(f)
+		case <-quit:
+			return
 		}
-		if er != nil {
-			for j := 0; j < i; j++ {
-				pieceMgr.Files[j].Close()
-			}
-			log.Println(DebugGetFuncName(), er)
-			return false
+	}
+}
+
+// Adds a downloaded block to its piece, and verifies the piece once all its
+// blocks are in
+func (pieceMgr *PieceMgr) processChunk(sessionInfo *TrntSessionInfo,
+	chunkData PieceChunkData) bool {
+	pieceIdx := chunkData.pieceInfo.PieceIndex
+	blockBegin := chunkData.pieceInfo.PieceBytesBegin
+	block := chunkData.pieceInfo.PieceBlock
+
+	// Sanity checks
+	if pieceIdx >= sessionInfo.getNumPieces() {
+		log.Println(DebugGetFuncName(), "Invalid piece index:", pieceIdx,
+			", peer:", chunkData.peerInfo.Addr)
+		return false
+	}
+	pieceLen := sessionInfo.getPieceLength(pieceIdx)
+	if (blockBegin%pieceMgr.blockLen != 0) || (blockBegin >= pieceLen) ||
+		(uint32(len(block)) != pieceMgr.getBlockLength(pieceLen, blockBegin)) {
+		log.Println(DebugGetFuncName(), "Invalid block, piece:", pieceIdx,
+			", offset:", blockBegin, ", len:", len(block), ", peer:",
+			chunkData.peerInfo.Addr)
+		return false
+	}
+
+	// In endgame, other peers may have been asked for this block too
+	var peers []*PeerInfo
+	if pieceMgr.isEndgame() {
+		peers = sessionInfo.peerMgr.getPeers()
+	}
+
+	// Peer has room for one more request now
+	var req BlockRequest
+	req.PieceIndex = pieceIdx
+	req.Begin = blockBegin
+	req.Length = uint32(len(block))
+	pieceMgr.mutex.Lock()
+	delete(chunkData.peerInfo.Requests, req)
+	select {
+	case pieceMgr.wakeRequester <- true:
+	default:
+	}
+
+	// Find the piece this block belongs to, we only take blocks of pieces
+	// that are being downloaded
+	piece, ok := pieceMgr.Pieces[pieceIdx]
+	blockIdx := blockBegin / pieceMgr.blockLen
+	if !ok || piece.BlockDone[blockIdx] {
+		pieceMgr.mutex.Unlock()
+		atomic.AddUint64(&sessionInfo.Wasted, uint64(len(block)))
+		return true
+	}
+
+	// Copy block into piece
+	copy(piece.Data[blockBegin:], block)
+	piece.BlockDone[blockIdx] = true
+	piece.BlockRequested[blockIdx] = false
+	piece.BlocksLeft--
+	piece.Peers[chunkData.peerInfo] = true
+	pieceMgr.mutex.Unlock()
+	if len(peers) > 0 {
+		pieceMgr.cancelDuplicates(sessionInfo, peers, chunkData.peerInfo, req)
+	}
+	if piece.BlocksLeft > 0 {
+		return true
+	}
+
+	// All blocks are in, so verify and commit the piece. Piece stays in the
+	// list till then, so that none of its blocks get requested again.
+	ok = pieceMgr.verifyPiece(sessionInfo, piece)
+	if ok {
+		ok = pieceMgr.commitPiece(sessionInfo, piece)
+	} else {
+		for peerInfo := range piece.Peers {
+			peerInfo.HashFails++
+			log.Println(DebugGetFuncName(), "Hash check failed, piece:", pieceIdx,
+				", peer:", peerInfo.Addr, ", hash fails:", peerInfo.HashFails)
 		}
 	}
-	return true
+
+	// A piece that failed is dropped, and gets requested again from scratch
+	pieceMgr.mutex.Lock()
+	delete(pieceMgr.Pieces, pieceIdx)
+	pieceMgr.mutex.Unlock()
+	return ok
 }
 
-func (pieceMgr *PieceMgr) loadPieceMap(sessionInfo *TrntSessionInfo) bool {
-	var zeroByte [1]byte
-	zeroByte[0] = '0'
-	pieceIdx := int64(0)
-	buf := make([]byte, sessionInfo.metaInfo.Info.PieceLength)
-	for _, f := range pieceMgr.Files {
-		for {
-			if _, er := f.Read(buf); er != nil {
-				log.Println(DebugGetFuncName(), er)
-				break
-			}
-			if pieceByteOffset := bytes.LastIndex(buf, zeroByte[0:]); pieceByteOffset >= 0 {
-				pieceMgr.PieceMap[pieceIdx] = uint32(pieceByteOffset)
-				fmt.Println(DebugGetFuncName(), "Piece index:", pieceIdx,
-					", piece byte offset:", pieceByteOffset)
-			}
-			pieceIdx++
+// Checks SHA-1 hash of an assembled piece against the hash in metainfo
+func (pieceMgr *PieceMgr) verifyPiece(sessionInfo *TrntSessionInfo,
+	piece *PieceProgress) bool {
+	pieceHash, ok := sessionInfo.getPieceHash(piece.Index)
+	if !ok {
+		return false
+	}
+	hash := sha1.Sum(piece.Data)
+	return string(hash[0:]) == pieceHash
+}
+
+// Writes a verified piece to storage, and marks it as available in our
+// bitfield
+func (pieceMgr *PieceMgr) commitPiece(sessionInfo *TrntSessionInfo,
+	piece *PieceProgress) bool {
+	if er := pieceMgr.storage.WriteBlock(piece.Index, 0, piece.Data); er != nil {
+		log.Println(DebugGetFuncName(), er)
+		return false
+	}
+	if er := pieceMgr.storage.MarkComplete(piece.Index); er != nil {
+		log.Println(DebugGetFuncName(), er)
+		return false
+	}
+	debugPrintln(sessionInfo.cfg.DebugOutput,
+		DebugGetFuncName(), "Write to storage, piece:", piece.Index,
+		", bytes written:", len(piece.Data))
+
+	// Update our own bitfield and let peers know we have this piece
+	sessionInfo.peerMgr.myInfo.BitField.Set(piece.Index)
+	if sessionInfo.peerMgr.myInfo.BitField.IsComplete() {
+		sessionInfo.setCompleted()
+		sessionInfo.announcer.Completed()
+	}
+	for _, val := range sessionInfo.peerMgr.getPeers() {
+		if val.isConnected() {
+			val.SendMsg(sessionInfo, gotrntmessages.MsgTypeHave, piece.Index)
 		}
 	}
 	return true
 }
 
-func (pieceMgr *PieceMgr) updatePieceMap(sessionInfo *TrntSessionInfo,
-	pieceIdx int64, newChunkOffsetInPiece uint32) bool {
-	pieceMgr.PieceMap[pieceIdx] = newChunkOffsetInPiece
-	return true
+// Check that a block requested by peer lies within a piece that we have
+func (pieceMgr *PieceMgr) isValidUploadRequest(sessionInfo *TrntSessionInfo,
+	req BlockRequest) bool {
+	if (req.PieceIndex >= sessionInfo.getNumPieces()) || (req.Length == 0) ||
+		(req.Length > sessionInfo.cfg.MaxRequestLen) {
+		return false
+	}
+	pieceLen := sessionInfo.getPieceLength(req.PieceIndex)
+	if (req.Begin >= pieceLen) || (req.Length > pieceLen-req.Begin) {
+		return false
+	}
+	return sessionInfo.peerMgr.myInfo.BitField.Get(req.PieceIndex)
+}
+
+// Read a block of a piece that we have, from storage
+func (pieceMgr *PieceMgr) readBlock(sessionInfo *TrntSessionInfo,
+	req BlockRequest) ([]byte, bool) {
+	if !pieceMgr.isValidUploadRequest(sessionInfo, req) {
+		return nil, false
+	}
+	block := make([]byte, req.Length)
+	if er := pieceMgr.storage.ReadBlock(req.PieceIndex, req.Begin, block); er != nil {
+		log.Println(DebugGetFuncName(), er)
+		return nil, false
+	}
+	return block, true
 }
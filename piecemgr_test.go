@@ -0,0 +1,283 @@
+package gotrnt
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"github.com/swatkat/gotrntmessages"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// Piece and block lengths of test torrent. Last piece is short, and has a
+// single short block.
+const (
+	testPieceLen = 0x8000
+	testBlockLen = 0x4000
+	testDataLen  = (2 * testPieceLen) + 14464
+)
+
+// Get made up torrent data, and a session whose piecemgr keeps it in memory
+func newTestPieceSession(t *testing.T) (*TrntSessionInfo, []byte) {
+	data := make([]byte, testDataLen)
+	for i := range data {
+		data[i] = byte(i * 7)
+	}
+	var pieces bytes.Buffer
+	for offset := 0; offset < len(data); offset += testPieceLen {
+		end := offset + testPieceLen
+		if end > len(data) {
+			end = len(data)
+		}
+		hash := sha1.Sum(data[offset:end])
+		pieces.Write(hash[0:])
+	}
+
+	cfg := DefaultGoTorrentCfg(6881)
+	cfg.PieceBlockLen = testBlockLen
+	cfg.NewStorage = OpenMemoryStorage
+	sessionInfo := new(TrntSessionInfo)
+	sessionInfo.client = NewClient(cfg)
+	sessionInfo.cfg = &sessionInfo.client.cfg
+	sessionInfo.metaInfo.Info.Name = "test"
+	sessionInfo.metaInfo.Info.Length = testDataLen
+	sessionInfo.metaInfo.Info.PieceLength = testPieceLen
+	sessionInfo.metaInfo.Info.Pieces = pieces.String()
+	sessionInfo.done = make(chan bool)
+	sessionInfo.peerMgr.myInfo.Init("", sessionInfo.getNumPieces())
+	if !sessionInfo.pieceMgr.Init(sessionInfo) {
+		t.Fatal("Failed to init piecemgr")
+	}
+	return sessionInfo, data
+}
+
+// Start downloading a piece, as requester would
+func startTestPiece(sessionInfo *TrntSessionInfo, pieceIdx uint32) *PieceProgress {
+	pieceMgr := &sessionInfo.pieceMgr
+	pieceMgr.mutex.Lock()
+	defer pieceMgr.mutex.Unlock()
+	piece := pieceMgr.newPieceProgress(sessionInfo, pieceIdx)
+	pieceMgr.Pieces[pieceIdx] = piece
+	return piece
+}
+
+// Hand a block from peer over to piecemgr
+func sendTestBlock(sessionInfo *TrntSessionInfo, peerInfo *PeerInfo, pieceIdx,
+	begin uint32, block []byte) bool {
+	var chunkData PieceChunkData
+	chunkData.peerInfo = peerInfo
+	chunkData.pieceInfo = gotrntmessages.MsgDataPiece{PieceIndex: pieceIdx,
+		PieceBytesBegin: begin, PieceBlock: block}
+	return sessionInfo.pieceMgr.processChunk(sessionInfo, chunkData)
+}
+
+// Read a piece back from storage
+func readTestPiece(t *testing.T, sessionInfo *TrntSessionInfo, pieceIdx uint32) []byte {
+	buf := make([]byte, sessionInfo.getPieceLength(pieceIdx))
+	if er := sessionInfo.pieceMgr.storage.ReadBlock(pieceIdx, 0, buf); er != nil {
+		t.Fatal(er)
+	}
+	return buf
+}
+
+func TestPieceMgrGoodPiece(t *testing.T) {
+	sessionInfo, data := newTestPieceSession(t)
+	var peerInfo PeerInfo
+	peerInfo.Init("127.0.0.1:1", sessionInfo.getNumPieces())
+	startTestPiece(sessionInfo, 1)
+
+	// Blocks may come in any order, piece is committed once last one is in
+	piece := data[testPieceLen : 2*testPieceLen]
+	if !sendTestBlock(sessionInfo, &peerInfo, 1, testBlockLen, piece[testBlockLen:]) {
+		t.Fatal("Second block rejected")
+	}
+	if sessionInfo.peerMgr.myInfo.BitField.Get(1) {
+		t.Fatal("Piece committed before all blocks are in")
+	}
+	if !sendTestBlock(sessionInfo, &peerInfo, 1, 0, piece[:testBlockLen]) {
+		t.Fatal("First block rejected")
+	}
+	if !sessionInfo.peerMgr.myInfo.BitField.Get(1) {
+		t.Fatal("Piece not committed")
+	}
+	if !bytes.Equal(readTestPiece(t, sessionInfo, 1), piece) {
+		t.Fatal("Wrong piece data in storage")
+	}
+	if _, ok := sessionInfo.pieceMgr.Pieces[1]; ok || (peerInfo.HashFails != 0) {
+		t.Fatal("Piece still being downloaded, hash fails:", peerInfo.HashFails)
+	}
+
+	// Block of a piece that isn't being downloaded is wasted
+	if !sendTestBlock(sessionInfo, &peerInfo, 1, 0, piece[:testBlockLen]) {
+		t.Fatal("Late block rejected")
+	}
+	if n := atomic.LoadUint64(&sessionInfo.Wasted); n != testBlockLen {
+		t.Fatal("Wrong wasted bytes:", n)
+	}
+}
+
+func TestPieceMgrHashFail(t *testing.T) {
+	sessionInfo, data := newTestPieceSession(t)
+	var goodPeer, badPeer PeerInfo
+	goodPeer.Init("127.0.0.1:1", sessionInfo.getNumPieces())
+	badPeer.Init("127.0.0.1:2", sessionInfo.getNumPieces())
+	startTestPiece(sessionInfo, 0)
+
+	// Both peers that sent blocks of piece are blamed, as we can't tell
+	// which block is bad
+	block := append([]byte(nil), data[testBlockLen:testPieceLen]...)
+	block[100] ^= 0xff
+	sendTestBlock(sessionInfo, &goodPeer, 0, 0, data[:testBlockLen])
+	if sendTestBlock(sessionInfo, &badPeer, 0, testBlockLen, block) {
+		t.Fatal("Corrupt piece passed")
+	}
+	if sessionInfo.peerMgr.myInfo.BitField.Get(0) {
+		t.Fatal("Corrupt piece committed")
+	}
+	if (goodPeer.HashFails != 1) || (badPeer.HashFails != 1) {
+		t.Fatal("Wrong hash fails:", goodPeer.HashFails, badPeer.HashFails)
+	}
+	if !bytes.Equal(readTestPiece(t, sessionInfo, 0), make([]byte, testPieceLen)) {
+		t.Fatal("Corrupt piece written to storage")
+	}
+
+	// Failed piece is dropped, and starts from scratch
+	if _, ok := sessionInfo.pieceMgr.Pieces[0]; ok {
+		t.Fatal("Failed piece still being downloaded")
+	}
+	if sessionInfo.pieceMgr.verifyPiece(sessionInfo, &PieceProgress{Index: 3}) {
+		t.Fatal("Piece out of range verified")
+	}
+}
+
+func TestPieceMgrShortLastPiece(t *testing.T) {
+	sessionInfo, data := newTestPieceSession(t)
+	var peerInfo PeerInfo
+	peerInfo.Init("127.0.0.1:1", sessionInfo.getNumPieces())
+	lastPiece := startTestPiece(sessionInfo, 2)
+	if (len(lastPiece.Data) != testDataLen-(2*testPieceLen)) || (lastPiece.BlocksLeft != 1) {
+		t.Fatal("Wrong last piece, len:", len(lastPiece.Data), ", blocks:", lastPiece.BlocksLeft)
+	}
+
+	// A full length block doesn't fit in last piece
+	if sendTestBlock(sessionInfo, &peerInfo, 2, 0, make([]byte, testBlockLen)) {
+		t.Fatal("Full length block taken for last piece")
+	}
+	if !sendTestBlock(sessionInfo, &peerInfo, 2, 0, data[2*testPieceLen:]) {
+		t.Fatal("Last piece rejected")
+	}
+	if !bytes.Equal(readTestPiece(t, sessionInfo, 2), data[2*testPieceLen:]) {
+		t.Fatal("Wrong last piece data in storage")
+	}
+
+	// Torrent is complete once verified pieces are committed
+	for pieceIdx := uint32(0); pieceIdx < 2; pieceIdx++ {
+		piece := startTestPiece(sessionInfo, pieceIdx)
+		copy(piece.Data, data[pieceIdx*testPieceLen:])
+		if !sessionInfo.pieceMgr.verifyPiece(sessionInfo, piece) ||
+			!sessionInfo.pieceMgr.commitPiece(sessionInfo, piece) {
+			t.Fatal("Failed to commit piece:", pieceIdx)
+		}
+	}
+	if !sessionInfo.isCompleted() {
+		t.Fatal("Torrent not completed")
+	}
+}
+
+func TestPieceMgrInvalidBlocks(t *testing.T) {
+	sessionInfo, data := newTestPieceSession(t)
+	var peerInfo PeerInfo
+	peerInfo.Init("127.0.0.1:1", sessionInfo.getNumPieces())
+	piece := startTestPiece(sessionInfo, 0)
+
+	invalidBlocks := []struct {
+		pieceIdx uint32
+		begin    uint32
+		length   int
+	}{
+		{3, 0, testBlockLen},                 // Piece out of range
+		{0, 1, testBlockLen},                 // Misaligned
+		{0, testPieceLen, testBlockLen},      // Past end of piece
+		{0, 0, testBlockLen - 1},             // Short block
+		{0, testBlockLen, testBlockLen + 1},  // Long block
+		{2, testBlockLen, testDataLen % 100}, // Past end of last piece
+	}
+	for _, val := range invalidBlocks {
+		if sendTestBlock(sessionInfo, &peerInfo, val.pieceIdx, val.begin, data[:val.length]) {
+			t.Fatal("Invalid block taken:", val)
+		}
+	}
+	if (piece.BlocksLeft != 2) || (len(piece.Peers) != 0) {
+		t.Fatal("Invalid block changed piece, blocks left:", piece.BlocksLeft)
+	}
+	if n := atomic.LoadUint64(&sessionInfo.Wasted); n != 0 {
+		t.Fatal("Invalid block counted as wasted:", n)
+	}
+}
+
+func TestPieceMgrCancelKeepsChoke(t *testing.T) {
+	sessionInfo, _ := newTestPieceSession(t)
+	var sender, waiting, choked PeerInfo
+	sender.Init("127.0.0.1:1", sessionInfo.getNumPieces())
+	waiting.Init("127.0.0.1:2", sessionInfo.getNumPieces())
+	choked.Init("127.0.0.1:3", sessionInfo.getNumPieces())
+	req := BlockRequest{PieceIndex: 0, Begin: 0, Length: testBlockLen}
+	waiting.Requests[req] = time.Now()
+	waiting.updateState(PeerStateWaitForPiece)
+	choked.Requests[req] = time.Now()
+
+	// Peer that choked us stays choked, when its duplicate request is
+	// cancelled
+	peers := []*PeerInfo{&sender, &waiting, &choked}
+	sessionInfo.pieceMgr.cancelDuplicates(sessionInfo, peers, &sender, req)
+	if (waiting.getState() != PeerStateUnchoked) || (len(waiting.Requests) != 0) {
+		t.Fatal("Waiting peer not let go, state:", waiting.getState())
+	}
+	if (choked.getState() != PeerStateChoked) || (len(choked.Requests) != 0) {
+		t.Fatal("Choked peer changed, state:", choked.getState())
+	}
+}
+
+func TestPieceMgrExpireKeepsChoke(t *testing.T) {
+	sessionInfo, _ := newTestPieceSession(t)
+	var waiting, choked PeerInfo
+	waiting.Init("127.0.0.1:1", sessionInfo.getNumPieces())
+	choked.Init("127.0.0.1:2", sessionInfo.getNumPieces())
+	longAgo := time.Now().Add(-2 * sessionInfo.cfg.SnubTimeout)
+	for _, val := range []*PeerInfo{&waiting, &choked} {
+		val.Requests[BlockRequest{PieceIndex: 0, Begin: 0, Length: testBlockLen}] = longAgo
+		val.setLastBlockTime(longAgo)
+	}
+	waiting.updateState(PeerStateWaitForPiece)
+
+	// Both peers are snubbed and lose their requests, but only the one
+	// waiting for blocks is let go of waiting
+	sessionInfo.pieceMgr.expireRequests(sessionInfo, []*PeerInfo{&waiting, &choked})
+	if !waiting.isSnubbed() || (len(waiting.Requests) != 0) ||
+		(waiting.getState() != PeerStateUnchoked) {
+		t.Fatal("Waiting peer not expired, state:", waiting.getState())
+	}
+	if !choked.isSnubbed() || (len(choked.Requests) != 0) ||
+		(choked.getState() != PeerStateChoked) {
+		t.Fatal("Choked peer not expired or changed, state:", choked.getState())
+	}
+}
+
+func TestPieceMgrPushAfterStop(t *testing.T) {
+	sessionInfo, _ := newTestPieceSession(t)
+	var chunkData PieceChunkData
+	if sessionInfo.pieceMgr.pushChunk(chunkData) {
+		t.Fatal("Block taken before start")
+	}
+
+	// Piece receiver is gone and its chan is full, block is dropped rather
+	// than blocking peer forever
+	sessionInfo.pieceMgr.quit = make(chan bool)
+	for i := 0; i < cap(sessionInfo.pieceMgr.PieceWriterChan); i++ {
+		sessionInfo.pieceMgr.PieceWriterChan <- chunkData
+	}
+	close(sessionInfo.pieceMgr.quit)
+	if sessionInfo.pieceMgr.pushChunk(chunkData) {
+		t.Fatal("Block taken after stop")
+	}
+}
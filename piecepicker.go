@@ -0,0 +1,103 @@
+package gotrnt
+
+import (
+	"math/rand"
+	"sync"
+	"time"
+)
+
+// Decides which piece to download next. Availability of pieces is fed in as
+// peers send their bitfields and have messages, and as they go away.
+type PiecePicker interface {
+	AddPeerPieces(bitField *Bitfield)    // Peer sent its bitfield
+	RemovePeerPieces(bitField *Bitfield) // Peer went away
+	AddPeerPiece(pieceIdx uint32)        // Peer sent have message
+	// Pick a piece that peer has and we don't, skipping pieces for which skip
+	// returns true
+	PickPiece(myPieces, peerPieces *Bitfield, skip func(uint32) bool) (uint32, bool)
+}
+
+// Picks pieces that fewest peers have. Until first few pieces are complete,
+// random pieces are picked instead, so that we've something to share soon.
+type RarestFirstPicker struct {
+	numPieces    uint32     // Number of pieces in torrent
+	availability []int      // Piece index -> number of peers having that piece
+	randomFirst  int        // Pick random pieces till we have these many pieces
+	rnd          *rand.Rand // Used for random picks and tie breaking
+	mutex        sync.Mutex // Guards availability and rnd
+}
+
+// Initialize picker for a torrent
+func (picker *RarestFirstPicker) Init(numPieces uint32, randomFirst int) {
+	picker.numPieces = numPieces
+	picker.availability = make([]int, numPieces)
+	picker.randomFirst = randomFirst
+	picker.rnd = rand.New(rand.NewSource(time.Now().UnixNano()))
+}
+
+func (picker *RarestFirstPicker) AddPeerPieces(bitField *Bitfield) {
+	picker.updateAvailability(bitField, 1)
+}
+
+func (picker *RarestFirstPicker) RemovePeerPieces(bitField *Bitfield) {
+	picker.updateAvailability(bitField, -1)
+}
+
+func (picker *RarestFirstPicker) AddPeerPiece(pieceIdx uint32) {
+	picker.mutex.Lock()
+	defer picker.mutex.Unlock()
+	if pieceIdx < picker.numPieces {
+		picker.availability[pieceIdx]++
+	}
+}
+
+func (picker *RarestFirstPicker) PickPiece(myPieces, peerPieces *Bitfield,
+	skip func(uint32) bool) (uint32, bool) {
+	picker.mutex.Lock()
+	defer picker.mutex.Unlock()
+
+	// Pick at random till we have first few pieces
+	isRandom := int(myPieces.Count()) < picker.randomFirst
+
+	// Walk through candidate pieces, keeping the rarest one. Ties are broken
+	// by picking each of the tied pieces with equal probability.
+	pieceIdx := uint32(0)
+	minAvail := -1
+	numTied := 0
+	peerPieces.AndNot(myPieces).ForEach(func(i uint32) bool {
+		if (i >= picker.numPieces) || ((skip != nil) && skip(i)) {
+			return true
+		}
+		avail := picker.availability[i]
+		if isRandom {
+			avail = 0
+		}
+		if (minAvail < 0) || (avail < minAvail) {
+			pieceIdx = i
+			minAvail = avail
+			numTied = 1
+		} else if avail == minAvail {
+			numTied++
+			if picker.rnd.Intn(numTied) == 0 {
+				pieceIdx = i
+			}
+		}
+		return true
+	})
+	return pieceIdx, minAvail >= 0
+}
+
+// Add delta to availability of every piece in bitfield
+func (picker *RarestFirstPicker) updateAvailability(bitField *Bitfield, delta int) {
+	picker.mutex.Lock()
+	defer picker.mutex.Unlock()
+	bitField.ForEach(func(i uint32) bool {
+		if i < picker.numPieces {
+			picker.availability[i] += delta
+			if picker.availability[i] < 0 {
+				picker.availability[i] = 0
+			}
+		}
+		return true
+	})
+}
@@ -0,0 +1,130 @@
+package gotrnt
+
+import (
+	"testing"
+)
+
+// Get a bitfield with given pieces set
+func newTestBitfield(length uint32, pieces ...uint32) *Bitfield {
+	bitField := NewBitfield(length)
+	for _, val := range pieces {
+		bitField.Set(val)
+	}
+	return bitField
+}
+
+func TestRarestFirstPicker(t *testing.T) {
+	const numPieces = 10
+	tests := []struct {
+		name        string
+		peers       [][]uint32 // Pieces of other peers, that feed availability
+		haves       []uint32   // Have messages from other peers
+		gone        [][]uint32 // Pieces of peers that went away
+		myPieces    []uint32
+		peerPieces  []uint32
+		skip        []uint32
+		randomFirst int
+		want        []uint32 // Any of these may be picked, none if empty
+	}{
+		{
+			name:       "rarest",
+			peers:      [][]uint32{{0, 1, 2}, {0, 1}, {0}},
+			peerPieces: []uint32{0, 1, 2},
+			want:       []uint32{2},
+		},
+		{
+			name:       "have msgs count",
+			peers:      [][]uint32{{0, 1}},
+			haves:      []uint32{1, 1},
+			peerPieces: []uint32{0, 1},
+			want:       []uint32{0},
+		},
+		{
+			name:       "gone peers don't count",
+			peers:      [][]uint32{{0}, {1}, {1}, {1}},
+			gone:       [][]uint32{{1}, {1}},
+			peerPieces: []uint32{0, 1},
+			want:       []uint32{0, 1},
+		},
+		{
+			name:       "skip my pieces",
+			peers:      [][]uint32{{0, 1}, {0}},
+			myPieces:   []uint32{1},
+			peerPieces: []uint32{0, 1},
+			want:       []uint32{0},
+		},
+		{
+			name:       "skip func",
+			peers:      [][]uint32{{0, 1, 2}, {0, 1}, {0}},
+			peerPieces: []uint32{0, 1, 2},
+			skip:       []uint32{2},
+			want:       []uint32{1},
+		},
+		{
+			name:       "tie",
+			peers:      [][]uint32{{3, 7, 9}, {9}},
+			peerPieces: []uint32{3, 7, 9},
+			want:       []uint32{3, 7},
+		},
+		{
+			name:        "random first",
+			peers:       [][]uint32{{0, 1}, {0}},
+			peerPieces:  []uint32{0, 1},
+			randomFirst: 1,
+			want:        []uint32{0, 1},
+		},
+		{
+			name:        "rarest after random first",
+			peers:       [][]uint32{{0, 1}, {0}},
+			myPieces:    []uint32{5},
+			peerPieces:  []uint32{0, 1},
+			randomFirst: 1,
+			want:        []uint32{1},
+		},
+		{
+			name:       "peer has nothing we need",
+			peers:      [][]uint32{{0, 1}},
+			myPieces:   []uint32{0, 1},
+			peerPieces: []uint32{0, 1},
+		},
+		{
+			name:       "all skipped",
+			peerPieces: []uint32{4},
+			skip:       []uint32{4},
+		},
+	}
+	for _, test := range tests {
+		var picker RarestFirstPicker
+		picker.Init(numPieces, test.randomFirst)
+		for _, val := range test.peers {
+			picker.AddPeerPieces(newTestBitfield(numPieces, val...))
+		}
+		for _, val := range test.haves {
+			picker.AddPeerPiece(val)
+		}
+		for _, val := range test.gone {
+			picker.RemovePeerPieces(newTestBitfield(numPieces, val...))
+		}
+		skipped := newTestBitfield(numPieces, test.skip...)
+		skip := func(pieceIdx uint32) bool { return skipped.Get(pieceIdx) }
+
+		// Ties are broken at random, every tied piece must come up
+		picked := make(map[uint32]bool)
+		for i := 0; i < 100; i++ {
+			pieceIdx, ok := picker.PickPiece(newTestBitfield(numPieces, test.myPieces...),
+				newTestBitfield(numPieces, test.peerPieces...), skip)
+			if !ok {
+				break
+			}
+			picked[pieceIdx] = true
+		}
+		if len(picked) != len(test.want) {
+			t.Fatal(test.name, ", picked:", picked)
+		}
+		for _, val := range test.want {
+			if !picked[val] {
+				t.Fatal(test.name, ", picked:", picked)
+			}
+		}
+	}
+}
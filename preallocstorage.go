@@ -0,0 +1,154 @@
+package gotrnt
+
+import (
+	"errors"
+	"github.com/swatkat/gotrntmetainfoparser"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// Keeps all data of a torrent in a single file, sized to full torrent length
+// up front. Files of torrent aren't laid out on disk, which suits torrents
+// with lots of small files, and stores that are read back through gotrnt.
+type PreallocStorage struct {
+	Path        string       // Path of data file
+	BaseDir     string       // Directory in which data file is stored
+	TotalLength int64        // Length of torrent
+	PieceLength int64        // Piece length, to map blocks to byte offsets
+	handle      *os.File     // Data file, valid while storage is open
+	mutex       sync.RWMutex // Guards handle, so that it isn't closed under a read or write
+}
+
+// Open single data file of a torrent, as a StorageOpener. Data file is named
+// after torrent.
+func OpenPreallocStorage(metaInfo *gotrntmetainfoparser.MetaInfo, baseDir string) (Storage, error) {
+	var layout storageLayout
+	if !layout.init(metaInfo, baseDir) {
+		return nil, errors.New("invalid metainfo")
+	}
+	storage := new(PreallocStorage)
+	storage.Path = getPreallocPath(metaInfo, baseDir)
+	storage.BaseDir = baseDir
+	storage.TotalLength = layout.TotalLength
+	storage.PieceLength = layout.PieceLength
+	if er := storage.open(); er != nil {
+		return nil, er
+	}
+	return storage, nil
+}
+
+// Get path of data file of a torrent, it's named after torrent
+func getPreallocPath(metaInfo *gotrntmetainfoparser.MetaInfo, baseDir string) string {
+	return filepath.Join(baseDir, metaInfo.Info.Name+".gotrnt-data")
+}
+
+// Open data file, growing it to full torrent length if it's short. Caller
+// holds lock, if storage is shared.
+func (storage *PreallocStorage) open() error {
+	if er := os.MkdirAll(filepath.Dir(storage.Path), 0755); er != nil {
+		log.Println(DebugGetFuncName(), er)
+		return er
+	}
+	handle, er := os.OpenFile(storage.Path, os.O_RDWR|os.O_CREATE, 0644)
+	if er != nil {
+		log.Println(DebugGetFuncName(), er)
+		return er
+	}
+	fileInfo, er := handle.Stat()
+	if (er == nil) && (fileInfo.Size() < storage.TotalLength) {
+		er = handle.Truncate(storage.TotalLength)
+	}
+	if er != nil {
+		log.Println(DebugGetFuncName(), er)
+		handle.Close()
+		return er
+	}
+	storage.handle = handle
+	return nil
+}
+
+// Read a block of a piece
+func (storage *PreallocStorage) ReadBlock(pieceIdx, begin uint32, buf []byte) error {
+	storage.mutex.RLock()
+	defer storage.mutex.RUnlock()
+	offset, er := storage.getBlockOffset(pieceIdx, begin, len(buf))
+	if er != nil {
+		return er
+	}
+	if _, er = storage.handle.ReadAt(buf, offset); er == io.EOF {
+		er = io.ErrUnexpectedEOF
+	}
+	return er
+}
+
+// Write a block of a piece
+func (storage *PreallocStorage) WriteBlock(pieceIdx, begin uint32, buf []byte) error {
+	storage.mutex.RLock()
+	defer storage.mutex.RUnlock()
+	offset, er := storage.getBlockOffset(pieceIdx, begin, len(buf))
+	if er != nil {
+		return er
+	}
+	_, er = storage.handle.WriteAt(buf, offset)
+	return er
+}
+
+// Nothing to do once a piece is complete, data is already in file
+func (storage *PreallocStorage) MarkComplete(pieceIdx uint32) error {
+	return nil
+}
+
+// Close data file
+func (storage *PreallocStorage) Close() error {
+	storage.mutex.Lock()
+	defer storage.mutex.Unlock()
+	return storage.closeFile()
+}
+
+// Close data file, caller holds lock
+func (storage *PreallocStorage) closeFile() error {
+	if storage.handle == nil {
+		return nil
+	}
+	er := storage.handle.Close()
+	storage.handle = nil
+	return er
+}
+
+// Move data file to another directory, and open it there
+func (storage *PreallocStorage) Move(baseDir string) error {
+	storage.mutex.Lock()
+	defer storage.mutex.Unlock()
+	storage.closeFile()
+	newPath := filepath.Join(baseDir, filepath.Base(storage.Path))
+	er := moveFile(storage.Path, newPath)
+	if er == nil {
+		storage.Path = newPath
+		storage.BaseDir = baseDir
+	}
+	if openEr := storage.open(); er == nil {
+		er = openEr
+	}
+	return er
+}
+
+// Get path of data file
+func (storage *PreallocStorage) getFilePaths() []string {
+	return []string{storage.Path}
+}
+
+// Get byte offset of a block in data file, checking that block lies within
+// torrent and that file is open
+func (storage *PreallocStorage) getBlockOffset(pieceIdx, begin uint32, length int) (int64, error) {
+	offset := (storage.PieceLength * int64(pieceIdx)) + int64(begin)
+	if offset+int64(length) > storage.TotalLength {
+		return 0, errors.New("invalid byte range")
+	}
+	if storage.handle == nil {
+		return 0, errors.New("file not open: " + storage.Path)
+	}
+	return offset, nil
+}
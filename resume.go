@@ -0,0 +1,349 @@
+package gotrnt
+
+import (
+	"bytes"
+	"code.google.com/p/bencode-go"
+	"crypto/sha1"
+	"log"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"time"
+)
+
+// Fast resume state is saved in a file next to torrent data, so that
+// restarts don't have to hash all pieces again. It's a bencoded dictionary:
+//   info hash  - torrent infohash
+//   bitfield   - verified pieces, in wire format
+//   partial    - list of {index, blocks, data} of pieces being downloaded;
+//                blocks lists indices of received blocks and data has those
+//                blocks, back to back
+//   files      - list of {path, size, mtime} of files as of saving, path is
+//                relative to download directory; {path, missing} for a file
+//                that verify found missing, as none of its pieces are in
+//                bitfield it isn't checked
+//   uploaded   - total bytes uploaded
+//   downloaded - total bytes downloaded
+// Resume state is trusted only if files still have the same size and mtime.
+// Storage that doesn't keep data in files has no resume state, its pieces
+// are hashed on each start.
+
+// Get path of resume file of a torrent
+func getResumeFilePath(sessionInfo *TrntSessionInfo) string {
+	return filepath.Join(sessionInfo.dataDir, sessionInfo.metaInfo.Info.Name+".gotrnt-resume")
+}
+
+// Get files of storage that resume state is checked against
+func getResumeFiles(sessionInfo *TrntSessionInfo) ([]string, bool) {
+	storage, ok := sessionInfo.pieceMgr.storage.(fileBackedStorage)
+	if !ok {
+		return nil, false
+	}
+	return getRelPaths(sessionInfo, storage.getFilePaths())
+}
+
+// Get paths relative to download directory
+func getRelPaths(sessionInfo *TrntSessionInfo, paths []string) ([]string, bool) {
+	var relPaths []string
+	for _, path := range paths {
+		relPath, er := filepath.Rel(sessionInfo.dataDir, path)
+		if er != nil {
+			return nil, false
+		}
+		relPaths = append(relPaths, relPath)
+	}
+	return relPaths, true
+}
+
+// Load fast resume state, falling back to hashing all pieces if resume
+// state doesn't match files on disk
+func (pieceMgr *PieceMgr) loadPieces(sessionInfo *TrntSessionInfo) {
+	if pieceMgr.loadResume(sessionInfo) {
+		debugPrintln(sessionInfo.cfg.DebugOutput, DebugGetFuncName(), "Resumed, pieces:",
+			sessionInfo.peerMgr.myInfo.BitField.Count(), ", partial pieces:",
+			len(pieceMgr.Pieces))
+		return
+	}
+	debugPrintln(sessionInfo.cfg.DebugOutput, DebugGetFuncName(), "Checking all pieces")
+	pieceMgr.checkPieces(sessionInfo)
+	debugPrintln(sessionInfo.cfg.DebugOutput, DebugGetFuncName(), "Checked, pieces:",
+		sessionInfo.peerMgr.myInfo.BitField.Count())
+}
+
+// Save fast resume state of torrent
+func (pieceMgr *PieceMgr) saveResume(sessionInfo *TrntSessionInfo) bool {
+	resumeFiles, ok := getResumeFiles(sessionInfo)
+	if !ok {
+		return false
+	}
+
+	dict := make(map[string]interface{})
+	dict["info hash"] = sessionInfo.metaInfo.InfoHash
+	dict["uploaded"] = int64(atomic.LoadUint64(&sessionInfo.Uploaded))
+	dict["downloaded"] = int64(atomic.LoadUint64(&sessionInfo.Downloaded))
+	dict["bitfield"] = string(sessionInfo.peerMgr.myInfo.BitField.Bytes())
+
+	// Received blocks of pieces that are still being downloaded
+	partial := make([]interface{}, 0)
+	pieceMgr.mutex.Lock()
+	for _, piece := range pieceMgr.Pieces {
+		blocks := make([]interface{}, 0)
+		var data bytes.Buffer
+		for blockIdx, done := range piece.BlockDone {
+			if !done {
+				continue
+			}
+			begin := uint32(blockIdx) * pieceMgr.blockLen
+			blockLen := pieceMgr.getBlockLength(uint32(len(piece.Data)), begin)
+			blocks = append(blocks, int64(blockIdx))
+			data.Write(piece.Data[begin : begin+blockLen])
+		}
+		if len(blocks) > 0 {
+			partial = append(partial, map[string]interface{}{
+				"index":  int64(piece.Index),
+				"blocks": blocks,
+				"data":   data.String(),
+			})
+		}
+	}
+	pieceMgr.mutex.Unlock()
+	dict["partial"] = partial
+
+	// Files as they're now. A piece written after taking bitfield changes
+	// files without being in bitfield, so it's only downloaded again. Pieces
+	// are written before they're set in bitfield, so it never claims a piece
+	// that isn't in files.
+	files, ok := getResumeFileStats(sessionInfo, resumeFiles, false)
+	if !ok {
+		return false
+	}
+	dict["files"] = files
+	return writeResumeFile(sessionInfo, dict)
+}
+
+// Get size and mtime of files, for resume state. A missing file fails it,
+// unless allowMissing is set.
+func getResumeFileStats(sessionInfo *TrntSessionInfo, relPaths []string,
+	allowMissing bool) ([]interface{}, bool) {
+	files := make([]interface{}, 0)
+	for _, relPath := range relPaths {
+		fileInfo, er := os.Stat(filepath.Join(sessionInfo.dataDir, relPath))
+		if allowMissing && os.IsNotExist(er) {
+			files = append(files, map[string]interface{}{
+				"path":    relPath,
+				"missing": int64(1),
+			})
+			continue
+		} else if er != nil {
+			log.Println(DebugGetFuncName(), er)
+			return nil, false
+		}
+		files = append(files, map[string]interface{}{
+			"path":  relPath,
+			"size":  fileInfo.Size(),
+			"mtime": fileInfo.ModTime().UnixNano(),
+		})
+	}
+	return files, true
+}
+
+// Write resume state of torrent to its resume file
+func writeResumeFile(sessionInfo *TrntSessionInfo, dict map[string]interface{}) bool {
+	// Write to a temporary file first, so that a crash doesn't leave a
+	// broken resume file behind
+	resumeFilePath := getResumeFilePath(sessionInfo)
+	var buf bytes.Buffer
+	if er := bencode.Marshal(&buf, dict); er != nil {
+		log.Println(DebugGetFuncName(), er)
+		return false
+	}
+	if er := os.WriteFile(resumeFilePath+".tmp", buf.Bytes(), 0644); er != nil {
+		log.Println(DebugGetFuncName(), er)
+		return false
+	}
+	if er := os.Rename(resumeFilePath+".tmp", resumeFilePath); er != nil {
+		log.Println(DebugGetFuncName(), er)
+		return false
+	}
+	return true
+}
+
+// Load fast resume state of torrent. Returns false if there's no resume
+// file, or if it doesn't match torrent or files on disk.
+func (pieceMgr *PieceMgr) loadResume(sessionInfo *TrntSessionInfo) bool {
+	resumeFiles, ok := getResumeFiles(sessionInfo)
+	if !ok {
+		return false
+	}
+	dict, ok := readResumeFile(sessionInfo)
+	if !ok {
+		return false
+	}
+
+	// Files must be same as when resume state was saved
+	files, _ := dict["files"].([]interface{})
+	if len(files) != len(resumeFiles) {
+		log.Println(DebugGetFuncName(), "Files mismatch")
+		return false
+	}
+	for i, val := range files {
+		fileDict, _ := val.(map[string]interface{})
+		path, _ := fileDict["path"].(string)
+		size, _ := fileDict["size"].(int64)
+		mtime, _ := fileDict["mtime"].(int64)
+		if _, missing := fileDict["missing"]; missing && (path == resumeFiles[i]) {
+			continue
+		}
+		fileInfo, er := os.Stat(filepath.Join(sessionInfo.dataDir, resumeFiles[i]))
+		if (er != nil) || (path != resumeFiles[i]) ||
+			(size != fileInfo.Size()) || (mtime != fileInfo.ModTime().UnixNano()) {
+			log.Println(DebugGetFuncName(), "File changed:", resumeFiles[i])
+			return false
+		}
+	}
+
+	bitField := NewBitfield(sessionInfo.getNumPieces())
+	bitFieldBytes, _ := dict["bitfield"].(string)
+	if !bitField.SetBytes([]byte(bitFieldBytes)) {
+		log.Println(DebugGetFuncName(), "Invalid bitfield")
+		return false
+	}
+
+	// Rebuild pieces being downloaded from their received blocks
+	pieces := make(map[uint32]*PieceProgress)
+	partial, _ := dict["partial"].([]interface{})
+	for _, val := range partial {
+		pieceDict, _ := val.(map[string]interface{})
+		pieceIdx, _ := pieceDict["index"].(int64)
+		blocks, _ := pieceDict["blocks"].([]interface{})
+		data, _ := pieceDict["data"].(string)
+		if (pieceIdx < 0) || (pieceIdx >= int64(bitField.Len())) ||
+			bitField.Get(uint32(pieceIdx)) {
+			return false
+		}
+		piece := pieceMgr.newPieceProgress(sessionInfo, uint32(pieceIdx))
+		offset := 0
+		for _, blockVal := range blocks {
+			blockIdx, _ := blockVal.(int64)
+			if (blockIdx < 0) || (blockIdx >= int64(len(piece.BlockDone))) ||
+				piece.BlockDone[blockIdx] {
+				return false
+			}
+			begin := uint32(blockIdx) * pieceMgr.blockLen
+			blockLen := int(pieceMgr.getBlockLength(uint32(len(piece.Data)), begin))
+			if offset+blockLen > len(data) {
+				return false
+			}
+			copy(piece.Data[begin:], data[offset:offset+blockLen])
+			offset += blockLen
+			piece.BlockDone[blockIdx] = true
+			piece.BlocksLeft--
+		}
+		// A piece with all blocks in was being verified, get it again
+		if piece.BlocksLeft > 0 {
+			pieces[piece.Index] = piece
+		}
+	}
+
+	// All good, take resume state
+	sessionInfo.peerMgr.myInfo.BitField.SetBytes(bitField.Bytes())
+	pieceMgr.mutex.Lock()
+	pieceMgr.Pieces = pieces
+	pieceMgr.mutex.Unlock()
+	uploaded, _ := dict["uploaded"].(int64)
+	downloaded, _ := dict["downloaded"].(int64)
+	atomic.StoreUint64(&sessionInfo.Uploaded, uint64(uploaded))
+	atomic.StoreUint64(&sessionInfo.Downloaded, uint64(downloaded))
+	return true
+}
+
+// Read resume file of torrent. Returns false if there's no resume file, or
+// if it's of some other torrent.
+func readResumeFile(sessionInfo *TrntSessionInfo) (map[string]interface{}, bool) {
+	f, er := os.Open(getResumeFilePath(sessionInfo))
+	if er != nil {
+		return nil, false
+	}
+	defer f.Close()
+	data, er := bencode.Decode(f)
+	if er != nil {
+		log.Println(DebugGetFuncName(), er)
+		return nil, false
+	}
+	dict, ok := data.(map[string]interface{})
+	if !ok {
+		return nil, false
+	}
+	if infoHash, _ := dict["info hash"].(string); infoHash != sessionInfo.metaInfo.InfoHash {
+		log.Println(DebugGetFuncName(), "Infohash mismatch")
+		return nil, false
+	}
+	return dict, true
+}
+
+// Rebuild resume state from verified pieces, keeping transfer stats of old
+// resume state. Pieces being downloaded are dropped. Resume state is checked
+// against given data files, those that are missing are noted as such.
+// Session must be stopped.
+func (pieceMgr *PieceMgr) rebuildResume(sessionInfo *TrntSessionInfo, filePaths []string,
+	bitField *Bitfield) bool {
+	relPaths, ok := getRelPaths(sessionInfo, filePaths)
+	if !ok {
+		return false
+	}
+	files, ok := getResumeFileStats(sessionInfo, relPaths, true)
+	if !ok {
+		return false
+	}
+
+	pieceMgr.Pieces = nil
+	sessionInfo.peerMgr.myInfo.Init("", bitField.Len())
+	sessionInfo.peerMgr.myInfo.BitField.SetBytes(bitField.Bytes())
+	dict := make(map[string]interface{})
+	dict["info hash"] = sessionInfo.metaInfo.InfoHash
+	dict["uploaded"] = int64(0)
+	dict["downloaded"] = int64(0)
+	if oldDict, ok := readResumeFile(sessionInfo); ok {
+		uploaded, _ := oldDict["uploaded"].(int64)
+		downloaded, _ := oldDict["downloaded"].(int64)
+		atomic.StoreUint64(&sessionInfo.Uploaded, uint64(uploaded))
+		atomic.StoreUint64(&sessionInfo.Downloaded, uint64(downloaded))
+		dict["uploaded"] = uploaded
+		dict["downloaded"] = downloaded
+	}
+	dict["bitfield"] = string(bitField.Bytes())
+	dict["partial"] = make([]interface{}, 0)
+	dict["files"] = files
+	return writeResumeFile(sessionInfo, dict)
+}
+
+// Hash all pieces on disk, and mark the good ones as available
+func (pieceMgr *PieceMgr) checkPieces(sessionInfo *TrntSessionInfo) {
+	numPieces := sessionInfo.getNumPieces()
+	buf := make([]byte, sessionInfo.metaInfo.Info.PieceLength)
+	for pieceIdx := uint32(0); pieceIdx < numPieces; pieceIdx++ {
+		pieceBuf := buf[:sessionInfo.getPieceLength(pieceIdx)]
+		if er := pieceMgr.storage.ReadBlock(pieceIdx, 0, pieceBuf); er != nil {
+			continue
+		}
+		pieceHash, _ := sessionInfo.getPieceHash(pieceIdx)
+		if hash := sha1.Sum(pieceBuf); string(hash[0:]) == pieceHash {
+			sessionInfo.peerMgr.myInfo.BitField.Set(pieceIdx)
+		}
+	}
+}
+
+// Save fast resume state periodically, till quit is closed
+func (pieceMgr *PieceMgr) resumeSaver(sessionInfo *TrntSessionInfo, quit chan bool) {
+	defer pieceMgr.workers.Done()
+	ticker := time.NewTicker(sessionInfo.cfg.ResumeSaveInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			pieceMgr.saveResume(sessionInfo)
+		case <-quit:
+			return
+		}
+	}
+}
@@ -0,0 +1,209 @@
+package gotrnt
+
+import (
+	"code.google.com/p/bencode-go"
+	"errors"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+)
+
+// Torrent stats got from tracker in a scrape
+type ScrapeInfo struct {
+	Seeders   int64 // Number of peers having complete torrent (complete)
+	Completed int64 // Number of times torrent was downloaded completely (downloaded)
+	Leechers  int64 // Number of peers still downloading (incomplete)
+}
+
+// Get stats of torrents from a tracker, using the protocol in announce URL.
+// Returns map of infohash -> stats, for torrents that tracker knows of.
+func ScrapeTracker(cfg *GoTorrentCfg, announceUrl string,
+	infoHashes []string) (map[string]ScrapeInfo, error) {
+	return scrapeTracker(cfg, new(udpConnIdCache), announceUrl, infoHashes, nil)
+}
+
+// Scrape a tracker, reusing UDP tracker connection ids from given cache.
+// Closing quit cuts short a UDP scrape, it may be nil.
+func scrapeTracker(cfg *GoTorrentCfg, connIds *udpConnIdCache, announceUrl string,
+	infoHashes []string, quit chan bool) (map[string]ScrapeInfo, error) {
+	// Sanity checks
+	if len(infoHashes) == 0 {
+		return nil, errors.New("no infohashes to scrape")
+	}
+
+	switch {
+	case strings.HasPrefix(announceUrl, "udp://"):
+		return scrapeUdpAll(cfg, connIds, announceUrl, infoHashes, quit)
+	case strings.HasPrefix(announceUrl, "http://"), strings.HasPrefix(announceUrl, "https://"):
+		scrapeUrl, ok := getScrapeUrl(announceUrl)
+		if !ok {
+			return nil, errors.New("tracker doesn't support scrape: " + announceUrl)
+		}
+		return scrapeHttp(cfg, scrapeUrl, infoHashes)
+	}
+	return nil, errors.New("unsupported tracker: " + announceUrl)
+}
+
+// Get scrape URL of an HTTP tracker from its announce URL. By convention,
+// "announce" in last path segment is replaced with "scrape"; a tracker whose
+// announce URL doesn't have it doesn't support scrape.
+func getScrapeUrl(announceUrl string) (string, bool) {
+	idx := strings.LastIndex(announceUrl, "/")
+	if (idx < 0) || !strings.HasPrefix(announceUrl[idx+1:], "announce") {
+		return "", false
+	}
+	return announceUrl[:idx+1] + "scrape" + announceUrl[idx+1+len("announce"):], true
+}
+
+// Scrape an HTTP tracker, all infohashes go in one request
+func scrapeHttp(cfg *GoTorrentCfg, scrapeUrl string,
+	infoHashes []string) (map[string]ScrapeInfo, error) {
+	params := url.Values{}
+	for _, val := range infoHashes {
+		params.Add("info_hash", val)
+	}
+	sep := "?"
+	if strings.Contains(scrapeUrl, "?") {
+		sep = "&"
+	}
+
+	// Send request and decode response
+	client := http.Client{Timeout: cfg.TrackerTimeout}
+	httpResp, er := client.Get(scrapeUrl + sep + params.Encode())
+	if er != nil {
+		return nil, er
+	}
+	defer httpResp.Body.Close()
+	data, er := bencode.Decode(httpResp.Body)
+	if er != nil {
+		return nil, er
+	}
+	dict, ok := data.(map[string]interface{})
+	if !ok {
+		return nil, errors.New("invalid tracker response")
+	}
+	if failure, ok := dict["failure reason"].(string); ok {
+		return nil, errors.New("tracker failure: " + failure)
+	}
+	files, ok := dict["files"].(map[string]interface{})
+	if !ok {
+		return nil, errors.New("invalid tracker response")
+	}
+
+	stats := make(map[string]ScrapeInfo)
+	for _, infoHash := range infoHashes {
+		fileDict, ok := files[infoHash].(map[string]interface{})
+		if !ok {
+			continue
+		}
+		var scrapeInfo ScrapeInfo
+		scrapeInfo.Seeders, _ = fileDict["complete"].(int64)
+		scrapeInfo.Completed, _ = fileDict["downloaded"].(int64)
+		scrapeInfo.Leechers, _ = fileDict["incomplete"].(int64)
+		stats[infoHash] = scrapeInfo
+	}
+	return stats, nil
+}
+
+// Scrape a UDP tracker, infohashes are sent in as many requests as needed
+func scrapeUdpAll(cfg *GoTorrentCfg, connIds *udpConnIdCache, announceUrl string,
+	infoHashes []string, quit chan bool) (map[string]ScrapeInfo, error) {
+	stats := make(map[string]ScrapeInfo)
+	for len(infoHashes) > 0 {
+		numHashes := len(infoHashes)
+		if numHashes > udpMaxScrapeHashes {
+			numHashes = udpMaxScrapeHashes
+		}
+		statsList, er := scrapeUdp(cfg, connIds, announceUrl, infoHashes[:numHashes], quit)
+		if er != nil {
+			return nil, er
+		}
+		for i, val := range statsList {
+			stats[infoHashes[i]] = val
+		}
+		infoHashes = infoHashes[numHashes:]
+	}
+	return stats, nil
+}
+
+// Scrape all trackers of torrent in parallel. Returns stats got from each
+// tracker, keyed by announce URL. Swarm stats of session are updated with
+// the largest numbers that any tracker reported.
+func (sessionInfo *TrntSessionInfo) Scrape() map[string]ScrapeInfo {
+	infoHash := sessionInfo.metaInfo.InfoHash
+	trackerStats := make(map[string]ScrapeInfo)
+	var mutex sync.Mutex
+	var wg sync.WaitGroup
+	for _, announceUrl := range sessionInfo.getTrackerUrls() {
+		wg.Add(1)
+		go func(announceUrl string) {
+			defer wg.Done()
+			stats, er := scrapeTracker(sessionInfo.cfg, &sessionInfo.client.udpConnIds,
+				announceUrl, []string{infoHash}, nil)
+			if er != nil {
+				log.Println(DebugGetFuncName(), er)
+				return
+			}
+			scrapeInfo, ok := stats[infoHash]
+			if !ok {
+				log.Println(DebugGetFuncName(), "Torrent not known to tracker:", announceUrl)
+				return
+			}
+			debugPrintln(sessionInfo.cfg.DebugOutput,
+				DebugGetFuncName(), "Scrape:", announceUrl, ", seeders:",
+				scrapeInfo.Seeders, ", leechers:", scrapeInfo.Leechers, ", completed:",
+				scrapeInfo.Completed)
+			mutex.Lock()
+			trackerStats[announceUrl] = scrapeInfo
+			mutex.Unlock()
+		}(announceUrl)
+	}
+	wg.Wait()
+
+	var swarmInfo ScrapeInfo
+	for _, val := range trackerStats {
+		if val.Seeders > swarmInfo.Seeders {
+			swarmInfo.Seeders = val.Seeders
+		}
+		if val.Completed > swarmInfo.Completed {
+			swarmInfo.Completed = val.Completed
+		}
+		if val.Leechers > swarmInfo.Leechers {
+			swarmInfo.Leechers = val.Leechers
+		}
+	}
+	if len(trackerStats) > 0 {
+		sessionInfo.swarmMutex.Lock()
+		sessionInfo.swarmInfo = swarmInfo
+		sessionInfo.swarmMutex.Unlock()
+	}
+	return trackerStats
+}
+
+// Get swarm stats of torrent, as of last scrape
+func (sessionInfo *TrntSessionInfo) GetSwarmInfo() ScrapeInfo {
+	sessionInfo.swarmMutex.Lock()
+	defer sessionInfo.swarmMutex.Unlock()
+	return sessionInfo.swarmInfo
+}
+
+// Get announce URLs of all trackers of torrent, from announce-list or
+// announce URL if there's no list
+func (sessionInfo *TrntSessionInfo) getTrackerUrls() []string {
+	urlSet := make(map[string]bool)
+	var announceUrls []string
+	for _, tier := range sessionInfo.metaInfo.AnnounceList {
+		for _, val := range tier {
+			if (len(val) > 0) && !urlSet[val] {
+				urlSet[val] = true
+				announceUrls = append(announceUrls, val)
+			}
+		}
+	}
+	if (len(announceUrls) == 0) && (len(sessionInfo.metaInfo.Announce) > 0) {
+		announceUrls = append(announceUrls, sessionInfo.metaInfo.Announce)
+	}
+	return announceUrls
+}
@@ -0,0 +1,108 @@
+package gotrnt
+
+import (
+	"log"
+	"sort"
+	"sync/atomic"
+)
+
+// Take a connection slot, for a peer that we connect to or that connects to
+// us. Returns false if client already has MaxConnections connections.
+func (client *Client) acquireConn() bool {
+	numConns := atomic.AddInt32(&client.numConns, 1)
+	if (client.cfg.MaxConnections > 0) && (int(numConns) > client.cfg.MaxConnections) {
+		atomic.AddInt32(&client.numConns, -1)
+		return false
+	}
+	return true
+}
+
+// Give back a connection slot, once peer is gone
+func (client *Client) releaseConn() {
+	atomic.AddInt32(&client.numConns, -1)
+}
+
+// Wait for a half-open slot, before dialing a peer
+func (client *Client) acquireHalfOpen() {
+	if client.halfOpen != nil {
+		client.halfOpen <- true
+	}
+}
+
+// Give back a half-open slot, once dial is done
+func (client *Client) releaseHalfOpen() {
+	if client.halfOpen != nil {
+		<-client.halfOpen
+	}
+}
+
+// Get number of peer connections of all torrents
+func (client *Client) NumConnections() int {
+	return int(atomic.LoadInt32(&client.numConns))
+}
+
+// Start queued torrents, once a torrent completes or goes away
+func (client *Client) scheduleTorrents() {
+	client.queueMutex.Lock()
+	client.scheduleTorrentsLocked()
+	client.queueMutex.Unlock()
+}
+
+// Hand out download and seed slots. Running torrents keep their slots,
+// except for a completed download that finds no seed slot; it goes back to
+// queue. Queued torrents get remaining slots, in the order they were queued.
+// queueMutex must be held.
+func (client *Client) scheduleTorrentsLocked() {
+	torrents := client.Torrents()
+	sort.SliceStable(torrents, func(i, j int) bool {
+		return torrents[i].queuedAt < torrents[j].queuedAt
+	})
+
+	numDownloads, numSeeds := 0, 0
+	takeSlot := func(torrent *Torrent) bool {
+		if torrent.session.isCompleted() {
+			if (client.cfg.MaxActiveSeeds > 0) && (numSeeds >= client.cfg.MaxActiveSeeds) {
+				return false
+			}
+			numSeeds++
+			return true
+		}
+		if (client.cfg.MaxActiveDownloads > 0) && (numDownloads >= client.cfg.MaxActiveDownloads) {
+			return false
+		}
+		numDownloads++
+		return true
+	}
+
+	for _, val := range torrents {
+		if !val.running || takeSlot(val) {
+			continue
+		}
+		val.session.Stop()
+		val.mutex.Lock()
+		val.running = false
+		val.queued = true
+		val.mutex.Unlock()
+		client.queueSeq++
+		val.queuedAt = client.queueSeq
+	}
+
+	for _, val := range torrents {
+		if !val.queued || !takeSlot(val) {
+			continue
+		}
+		ok := val.session.Start()
+		if !ok {
+			log.Println(DebugGetFuncName(), "Failed to start torrent:", val.Name())
+			if val.session.isCompleted() {
+				numSeeds--
+			} else {
+				numDownloads--
+			}
+		}
+		val.mutex.Lock()
+		val.running = ok
+		val.queued = false
+		val.mutex.Unlock()
+	}
+}
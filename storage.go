@@ -0,0 +1,375 @@
+package gotrnt
+
+import (
+	"errors"
+	"fmt"
+	"github.com/swatkat/gotrntmetainfoparser"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// Storage of torrent data. Blocks are addressed by piece index and byte
+// offset within piece, a block may span several files. Storage must be safe
+// for use by several goroutines at once.
+type Storage interface {
+	ReadBlock(pieceIdx, begin uint32, buf []byte) error  // Read a block of a piece
+	WriteBlock(pieceIdx, begin uint32, buf []byte) error // Write a block of a piece
+	MarkComplete(pieceIdx uint32) error                  // Piece is written in full and verified
+	Close() error                                        // Release storage, it isn't used after this
+	Move(baseDir string) error                           // Move torrent data to another directory
+}
+
+// Opens storage of a torrent, keeping its data under baseDir
+type StorageOpener func(metaInfo *gotrntmetainfoparser.MetaInfo, baseDir string) (Storage, error)
+
+// Storage that keeps torrent data in files on disk. Fast resume state is
+// trusted only if these files are unchanged.
+type fileBackedStorage interface {
+	Storage
+	getFilePaths() []string // Paths of files that hold torrent data
+}
+
+// A file of torrent, along with its place in torrent's byte stream
+type StorageFile struct {
+	Path   string   // File path on disk
+	Length int64    // File length
+	Offset int64    // Offset of first byte of this file in torrent
+	Handle *os.File // File handle, valid while storage is open
+}
+
+// Part of a byte range of torrent that lies within a single file
+type FileSegment struct {
+	File   *StorageFile // File containing this segment
+	Offset int64        // Byte offset within file
+	Length int64        // Number of bytes
+}
+
+// Files of a torrent, laid out back to back in torrent's byte stream
+type storageLayout struct {
+	BaseDir     string         // Directory in which torrent data is stored
+	Files       []*StorageFile // Files in the order they appear in metainfo
+	TotalLength int64          // Sum of lengths of all files
+	PieceLength int64          // Piece length, to map blocks to byte offsets
+}
+
+// Maps torrent byte offsets to files on disk
+type FileStorage struct {
+	storageLayout
+	mutex sync.RWMutex // Guards file handles, so that they aren't closed under a read or write
+}
+
+// Open plain files of a torrent, as a StorageOpener
+func OpenFileStorage(metaInfo *gotrntmetainfoparser.MetaInfo, baseDir string) (Storage, error) {
+	storage := new(FileStorage)
+	if !storage.Open(metaInfo, baseDir) {
+		return nil, errors.New("failed to open files")
+	}
+	return storage, nil
+}
+
+// Build list of files from metainfo, create directories and open the files
+func (storage *FileStorage) Open(metaInfo *gotrntmetainfoparser.MetaInfo,
+	baseDir string) bool {
+	if !storage.init(metaInfo, baseDir) {
+		return false
+	}
+	storage.mutex.Lock()
+	defer storage.mutex.Unlock()
+	return storage.openFiles()
+}
+
+// Create directories and open files, caller holds lock
+func (storage *FileStorage) openFiles() bool {
+	for i, f := range storage.Files {
+		var er error
+		if er = os.MkdirAll(filepath.Dir(f.Path), 0755); er == nil {
+			f.Handle, er = os.OpenFile(f.Path, os.O_RDWR|os.O_CREATE, 0644)
+		}
+		if er != nil {
+			for j := 0; j < i; j++ {
+				storage.Files[j].Handle.Close()
+				storage.Files[j].Handle = nil
+			}
+			log.Println(DebugGetFuncName(), er)
+			return false
+		}
+	}
+	return true
+}
+
+// Close all open files
+func (storage *FileStorage) Close() error {
+	storage.mutex.Lock()
+	defer storage.mutex.Unlock()
+	return storage.closeFiles()
+}
+
+// Close all open files, caller holds lock
+func (storage *FileStorage) closeFiles() error {
+	var firstEr error
+	for _, f := range storage.Files {
+		if f.Handle == nil {
+			continue
+		}
+		if er := f.Handle.Close(); er != nil {
+			log.Println(DebugGetFuncName(), er)
+			if firstEr == nil {
+				firstEr = er
+			}
+		}
+		f.Handle = nil
+	}
+	return firstEr
+}
+
+// Write a buffer at given torrent byte offset, it may span several files
+func (storage *FileStorage) WriteAt(buf []byte, offset int64) (int, error) {
+	storage.mutex.RLock()
+	defer storage.mutex.RUnlock()
+	segments, er := storage.getSegments(offset, int64(len(buf)))
+	if er != nil {
+		return 0, er
+	}
+	bytesWritten := 0
+	for _, seg := range segments {
+		if seg.File.Handle == nil {
+			return bytesWritten, errors.New("file not open: " + seg.File.Path)
+		}
+		n, er := seg.File.Handle.WriteAt(buf[bytesWritten:bytesWritten+int(seg.Length)],
+			seg.Offset)
+		bytesWritten += n
+		if er != nil {
+			return bytesWritten, er
+		}
+	}
+	return bytesWritten, nil
+}
+
+// Read a buffer from given torrent byte offset, it may span several files
+func (storage *FileStorage) ReadAt(buf []byte, offset int64) (int, error) {
+	storage.mutex.RLock()
+	defer storage.mutex.RUnlock()
+	segments, er := storage.getSegments(offset, int64(len(buf)))
+	if er != nil {
+		return 0, er
+	}
+	bytesRead := 0
+	for _, seg := range segments {
+		if seg.File.Handle == nil {
+			return bytesRead, errors.New("file not open: " + seg.File.Path)
+		}
+		n, er := seg.File.Handle.ReadAt(buf[bytesRead:bytesRead+int(seg.Length)],
+			seg.Offset)
+		bytesRead += n
+		if er != nil {
+			if er == io.EOF {
+				er = io.ErrUnexpectedEOF
+			}
+			return bytesRead, er
+		}
+	}
+	return bytesRead, nil
+}
+
+// Read a block of a piece
+func (storage *FileStorage) ReadBlock(pieceIdx, begin uint32, buf []byte) error {
+	_, er := storage.ReadAt(buf, storage.getBlockOffset(pieceIdx, begin))
+	return er
+}
+
+// Write a block of a piece
+func (storage *FileStorage) WriteBlock(pieceIdx, begin uint32, buf []byte) error {
+	_, er := storage.WriteAt(buf, storage.getBlockOffset(pieceIdx, begin))
+	return er
+}
+
+// Nothing to do once a piece is complete, data is already in files
+func (storage *FileStorage) MarkComplete(pieceIdx uint32) error {
+	return nil
+}
+
+// Move files to another directory, and open them there
+func (storage *FileStorage) Move(baseDir string) error {
+	storage.mutex.Lock()
+	defer storage.mutex.Unlock()
+	storage.closeFiles()
+	er := storage.moveFiles(baseDir)
+	if !storage.openFiles() && (er == nil) {
+		er = errors.New("failed to open files")
+	}
+	return er
+}
+
+// Get paths of files that hold torrent data
+func (storage *FileStorage) getFilePaths() []string {
+	return storage.getLayoutPaths()
+}
+
+// Build list of files from metainfo, rejecting paths that escape baseDir
+func (layout *storageLayout) init(metaInfo *gotrntmetainfoparser.MetaInfo,
+	baseDir string) bool {
+	// Sanity checks
+	if metaInfo == nil {
+		log.Println(DebugGetFuncName(), "Invalid param")
+		return false
+	}
+	if !isValidPathElement(metaInfo.Info.Name) {
+		log.Println(DebugGetFuncName(), "Invalid torrent name:", metaInfo.Info.Name)
+		return false
+	}
+
+	layout.BaseDir = baseDir
+	layout.Files = nil
+	layout.TotalLength = 0
+	layout.PieceLength = metaInfo.Info.PieceLength
+
+	// Single file torrents store data in a file called name, and multi file
+	// torrents store data in a directory tree under name
+	if len(metaInfo.Info.Files) == 0 {
+		layout.addFile(filepath.Join(baseDir, metaInfo.Info.Name),
+			metaInfo.Info.Length)
+		return true
+	}
+	for _, fileInfo := range metaInfo.Info.Files {
+		if len(fileInfo.Path) == 0 {
+			log.Println(DebugGetFuncName(), "Empty file path")
+			return false
+		}
+		pathElems := []string{baseDir, metaInfo.Info.Name}
+		for _, elem := range fileInfo.Path {
+			if !isValidPathElement(elem) {
+				log.Println(DebugGetFuncName(), "Invalid file path:", fileInfo.Path)
+				return false
+			}
+			pathElems = append(pathElems, elem)
+		}
+		layout.addFile(filepath.Join(pathElems...), fileInfo.Length)
+	}
+	return true
+}
+
+// Get torrent byte offset of a block of a piece
+func (layout *storageLayout) getBlockOffset(pieceIdx, begin uint32) int64 {
+	return (layout.PieceLength * int64(pieceIdx)) + int64(begin)
+}
+
+// Split a torrent byte range into per file segments
+func (layout *storageLayout) getSegments(offset, length int64) ([]FileSegment, error) {
+	if (offset < 0) || (length < 0) || (offset+length > layout.TotalLength) {
+		return nil, fmt.Errorf("invalid byte range, offset: %d, len: %d", offset, length)
+	}
+
+	var segments []FileSegment
+	for _, f := range layout.Files {
+		if length == 0 {
+			break
+		}
+		if (f.Length == 0) || (offset >= f.Offset+f.Length) {
+			continue
+		}
+		var seg FileSegment
+		seg.File = f
+		seg.Offset = offset - f.Offset
+		seg.Length = f.Length - seg.Offset
+		if seg.Length > length {
+			seg.Length = length
+		}
+		segments = append(segments, seg)
+		offset += seg.Length
+		length -= seg.Length
+	}
+	return segments, nil
+}
+
+// Append a file to the list, it starts where the previous file ends
+func (layout *storageLayout) addFile(path string, length int64) {
+	f := new(StorageFile)
+	f.Path = path
+	f.Length = length
+	f.Offset = layout.TotalLength
+	layout.Files = append(layout.Files, f)
+	layout.TotalLength += length
+}
+
+// Get paths of all files
+func (layout *storageLayout) getLayoutPaths() []string {
+	var paths []string
+	for _, f := range layout.Files {
+		paths = append(paths, f.Path)
+	}
+	return paths
+}
+
+// Move closed files to another directory, keeping their paths relative to
+// base directory. Directories left empty are removed.
+func (layout *storageLayout) moveFiles(baseDir string) error {
+	for _, f := range layout.Files {
+		relPath, er := filepath.Rel(layout.BaseDir, f.Path)
+		if er != nil {
+			return er
+		}
+		newPath := filepath.Join(baseDir, relPath)
+		if er := moveFile(f.Path, newPath); er != nil {
+			return er
+		}
+		removeEmptyDirs(filepath.Dir(f.Path), layout.BaseDir)
+		f.Path = newPath
+	}
+	layout.BaseDir = baseDir
+	return nil
+}
+
+// Move a file, copying it if it can't be renamed, e.g. across filesystems.
+// Copy keeps mtime, so that fast resume state stays good.
+func moveFile(oldPath, newPath string) error {
+	if er := os.MkdirAll(filepath.Dir(newPath), 0755); er != nil {
+		return er
+	}
+	if os.Rename(oldPath, newPath) == nil {
+		return nil
+	}
+	src, er := os.Open(oldPath)
+	if er != nil {
+		return er
+	}
+	defer src.Close()
+	fileInfo, er := src.Stat()
+	if er != nil {
+		return er
+	}
+	dst, er := os.OpenFile(newPath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if er != nil {
+		return er
+	}
+	if _, er = io.Copy(dst, src); er != nil {
+		dst.Close()
+		return er
+	}
+	if er = dst.Close(); er != nil {
+		return er
+	}
+	if er = os.Chtimes(newPath, fileInfo.ModTime(), fileInfo.ModTime()); er != nil {
+		return er
+	}
+	return os.Remove(oldPath)
+}
+
+// Remove a directory and its parents up to stopDir, as long as they're empty
+func removeEmptyDirs(dir, stopDir string) {
+	for (dir != stopDir) && (len(dir) > len(stopDir)) {
+		if os.Remove(dir) != nil {
+			return
+		}
+		dir = filepath.Dir(dir)
+	}
+}
+
+// Path elements from metainfo must not escape the torrent directory
+func isValidPathElement(elem string) bool {
+	return (len(elem) > 0) && (elem != ".") && (elem != "..") &&
+		!strings.ContainsAny(elem, "/\\")
+}
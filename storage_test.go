@@ -0,0 +1,108 @@
+package gotrnt
+
+import (
+	"github.com/swatkat/gotrntmetainfoparser"
+	"path/filepath"
+	"testing"
+)
+
+// Get metainfo of a multi file torrent, with an empty file in the middle
+func newTestStorageMetaInfo() *gotrntmetainfoparser.MetaInfo {
+	metaInfo := new(gotrntmetainfoparser.MetaInfo)
+	metaInfo.Info.Name = "test"
+	metaInfo.Info.PieceLength = 16
+	metaInfo.Info.Files = []gotrntmetainfoparser.FileDict{
+		{Length: 10, Path: []string{"a"}},
+		{Length: 0, Path: []string{"empty"}},
+		{Length: 20, Path: []string{"dir", "b"}},
+		{Length: 5, Path: []string{"c"}},
+	}
+	return metaInfo
+}
+
+func TestStorageSegments(t *testing.T) {
+	var layout storageLayout
+	if !layout.init(newTestStorageMetaInfo(), "base") {
+		t.Fatal("Failed to init layout")
+	}
+	if layout.TotalLength != 35 {
+		t.Fatal("Wrong total length:", layout.TotalLength)
+	}
+	if layout.Files[2].Path != filepath.Join("base", "test", "dir", "b") {
+		t.Fatal("Wrong file path:", layout.Files[2].Path)
+	}
+
+	// Segment is file index, offset within file and length
+	type testSegment struct {
+		fileIdx int
+		offset  int64
+		length  int64
+	}
+	tests := []struct {
+		offset   int64
+		length   int64
+		segments []testSegment
+	}{
+		{0, 10, []testSegment{{0, 0, 10}}},
+		{3, 4, []testSegment{{0, 3, 4}}},
+		{8, 4, []testSegment{{0, 8, 2}, {2, 0, 2}}},
+		{10, 20, []testSegment{{2, 0, 20}}},
+		{16, 16, []testSegment{{2, 6, 14}, {3, 0, 2}}},
+		{0, 35, []testSegment{{0, 0, 10}, {2, 0, 20}, {3, 0, 5}}},
+		{34, 1, []testSegment{{3, 4, 1}}},
+		{35, 0, nil},
+	}
+	for _, test := range tests {
+		segments, er := layout.getSegments(test.offset, test.length)
+		if er != nil {
+			t.Fatal("Offset:", test.offset, ", len:", test.length, ", error:", er)
+		}
+		if len(segments) != len(test.segments) {
+			t.Fatal("Offset:", test.offset, ", len:", test.length, ", segments:", segments)
+		}
+		for i, seg := range segments {
+			want := test.segments[i]
+			if (seg.File != layout.Files[want.fileIdx]) || (seg.Offset != want.offset) ||
+				(seg.Length != want.length) {
+				t.Fatal("Offset:", test.offset, ", len:", test.length, ", segment:", i,
+					", got:", seg.File.Path, seg.Offset, seg.Length)
+			}
+		}
+	}
+
+	// Ranges outside torrent are rejected
+	for _, test := range [][2]int64{{-1, 2}, {0, -1}, {30, 6}, {36, 0}} {
+		if _, er := layout.getSegments(test[0], test[1]); er == nil {
+			t.Fatal("Range accepted, offset:", test[0], ", len:", test[1])
+		}
+	}
+
+	// Blocks are addressed by piece
+	if offset := layout.getBlockOffset(1, 4); offset != 20 {
+		t.Fatal("Wrong block offset:", offset)
+	}
+}
+
+func TestStorageRejectsEscapingPaths(t *testing.T) {
+	tests := []struct {
+		name string
+		path []string
+	}{
+		{"test", []string{".."}},
+		{"test", []string{"dir", "..", "x"}},
+		{"test", []string{"a/b"}},
+		{"test", []string{"a\\b"}},
+		{"test", []string{}},
+		{"..", []string{"a"}},
+		{"", []string{"a"}},
+	}
+	for _, test := range tests {
+		metaInfo := newTestStorageMetaInfo()
+		metaInfo.Info.Name = test.name
+		metaInfo.Info.Files[0].Path = test.path
+		var layout storageLayout
+		if layout.init(metaInfo, "base") {
+			t.Fatal("Path accepted, name:", test.name, ", path:", test.path)
+		}
+	}
+}
@@ -0,0 +1,330 @@
+package gotrnt
+
+import (
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Number of peers sent in an announce response, if peer doesn't ask for a
+// number, and the most that it can ask for
+const (
+	TrackerDefaultNumWant = 50
+	TrackerMaxNumWant     = 200
+)
+
+// A peer of a torrent, as known to tracker
+type trackerPeer struct {
+	PeerId    string    // Peer id, raw 20 bytes
+	Ip        net.IP    // Address that peer announced from
+	Port      uint16    // Port on which peer accepts connections
+	Left      uint64    // Bytes left for peer to download, 0 for a seed
+	LastSeen  time.Time // When peer last announced
+	Completed bool      // Set once peer's completed event is counted
+}
+
+// Peers of a torrent, and how many times it was downloaded completely
+type trackerTorrent struct {
+	peers     map[string]*trackerPeer // Map of peer id + IP -> peer
+	completed int64                   // Number of completed events got
+}
+
+// HTTP tracker, serves /announce and /scrape. Peers that miss announces for
+// PeerExpiry are dropped.
+type TrackerServer struct {
+	Addr        string          // Address on which tracker listens
+	Interval    time.Duration   // Announce interval sent to peers
+	MinInterval time.Duration   // Peers mustn't announce more often than this
+	PeerExpiry  time.Duration   // Peer is dropped if it doesn't announce for this long
+	Whitelist   map[string]bool // Raw infohashes that are tracked, any torrent if empty; set before Start
+	DebugOutput io.Writer       // Debug output goes here, stdout if nil
+	torrents    map[string]*trackerTorrent
+	mutex       sync.Mutex   // Guards torrents
+	listener    net.Listener // Listener that server accepts requests on
+	server      *http.Server // HTTP server
+	quit        chan bool    // Closed to stop expiring peers
+}
+
+// Start serving tracker requests
+func (trackerServer *TrackerServer) Start() bool {
+	// Sanity checks
+	if (trackerServer.Interval <= 0) || (trackerServer.PeerExpiry <= 0) {
+		log.Println(DebugGetFuncName(), "Invalid param")
+		return false
+	}
+
+	listener, er := net.Listen("tcp", trackerServer.Addr)
+	if er != nil {
+		log.Println(DebugGetFuncName(), er)
+		return false
+	}
+	debugPrintln(trackerServer.DebugOutput,
+		DebugGetFuncName(), "Tracker listening on", listener.Addr())
+
+	trackerServer.torrents = make(map[string]*trackerTorrent)
+	mux := http.NewServeMux()
+	mux.HandleFunc("/announce", trackerServer.handleAnnounce)
+	mux.HandleFunc("/scrape", trackerServer.handleScrape)
+	trackerServer.listener = listener
+	trackerServer.server = &http.Server{Handler: mux}
+	trackerServer.quit = make(chan bool)
+	go trackerServer.server.Serve(listener)
+	go trackerServer.expirePeers(trackerServer.quit)
+	return true
+}
+
+// Stop serving tracker requests, tracked peers are forgotten
+func (trackerServer *TrackerServer) Stop() {
+	if trackerServer.server == nil {
+		return
+	}
+	close(trackerServer.quit)
+	trackerServer.server.Close()
+	trackerServer.server = nil
+}
+
+// Get address on which tracker is listening, useful when Addr has port 0
+func (trackerServer *TrackerServer) ListenAddr() net.Addr {
+	if trackerServer.listener == nil {
+		return nil
+	}
+	return trackerServer.listener.Addr()
+}
+
+// Drop peers that haven't announced for a while, and torrents without peers
+func (trackerServer *TrackerServer) expirePeers(quit chan bool) {
+	ticker := time.NewTicker(trackerServer.PeerExpiry / 2)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			trackerServer.mutex.Lock()
+			for infoHash, torrent := range trackerServer.torrents {
+				for peerKey, val := range torrent.peers {
+					if time.Since(val.LastSeen) > trackerServer.PeerExpiry {
+						delete(torrent.peers, peerKey)
+					}
+				}
+				if (len(torrent.peers) == 0) && (torrent.completed == 0) {
+					delete(trackerServer.torrents, infoHash)
+				}
+			}
+			trackerServer.mutex.Unlock()
+		case <-quit:
+			return
+		}
+	}
+}
+
+// Process an announce, and send back peers of torrent
+func (trackerServer *TrackerServer) handleAnnounce(w http.ResponseWriter, r *http.Request) {
+	params := r.URL.Query()
+	infoHash := params.Get("info_hash")
+	peerId := params.Get("peer_id")
+	port, er := strconv.ParseUint(params.Get("port"), 10, 16)
+	if (len(infoHash) != 20) || (len(peerId) != 20) || (er != nil) || (port == 0) {
+		trackerServer.sendFailure(w, "invalid announce")
+		return
+	}
+	if !trackerServer.isTracked(infoHash) {
+		trackerServer.sendFailure(w, "torrent not tracked")
+		return
+	}
+	host, _, er := net.SplitHostPort(r.RemoteAddr)
+	ip := net.ParseIP(host)
+	if (er != nil) || (ip == nil) {
+		trackerServer.sendFailure(w, "invalid peer address")
+		return
+	}
+	if ip4 := ip.To4(); ip4 != nil {
+		ip = ip4
+	}
+	left, _ := strconv.ParseUint(params.Get("left"), 10, 64)
+	numWant := TrackerDefaultNumWant
+	if val, er := strconv.Atoi(params.Get("numwant")); (er == nil) && (val >= 0) {
+		numWant = val
+	}
+	if numWant > TrackerMaxNumWant {
+		numWant = TrackerMaxNumWant
+	}
+	event := params.Get("event")
+
+	// Peer is known by its id and address, so that it can't be taken over by
+	// someone announcing its id from elsewhere
+	peerKey := peerId + string(ip)
+
+	// Update peer, and pick peers for response. Seeds aren't sent to a seed.
+	trackerServer.mutex.Lock()
+	torrent, ok := trackerServer.torrents[infoHash]
+	if !ok {
+		torrent = new(trackerTorrent)
+		torrent.peers = make(map[string]*trackerPeer)
+		trackerServer.torrents[infoHash] = torrent
+	}
+	if event == AnnounceEventStopped {
+		delete(torrent.peers, peerKey)
+		numWant = 0
+	} else {
+		peer, ok := torrent.peers[peerKey]
+		if !ok {
+			peer = new(trackerPeer)
+			peer.PeerId = peerId
+			peer.Ip = ip
+			torrent.peers[peerKey] = peer
+		}
+		peer.Port = uint16(port)
+		peer.Left = left
+		peer.LastSeen = time.Now()
+		// A peer that sends completed again is counted only once
+		if (event == AnnounceEventCompleted) && !peer.Completed {
+			peer.Completed = true
+			torrent.completed++
+		}
+	}
+	var peers []trackerPeer
+	for key, val := range torrent.peers {
+		if len(peers) >= numWant {
+			break
+		}
+		if (key != peerKey) && ((left > 0) || (val.Left > 0)) {
+			peers = append(peers, *val)
+		}
+	}
+	scrapeInfo := torrent.getScrapeInfo()
+	trackerServer.mutex.Unlock()
+
+	dict := make(map[string]interface{})
+	dict["interval"] = int64(trackerServer.Interval / time.Second)
+	if trackerServer.MinInterval > 0 {
+		dict["min interval"] = int64(trackerServer.MinInterval / time.Second)
+	}
+	dict["complete"] = scrapeInfo.Seeders
+	dict["incomplete"] = scrapeInfo.Leechers
+	if params.Get("compact") == "1" {
+		// IPv4 peers in peers, IPv6 peers in peers6
+		var peers4, peers6 []byte
+		for _, val := range peers {
+			compactPeer := append([]byte(nil), val.Ip...)
+			compactPeer = append(compactPeer, getBytesFromUint16(val.Port)...)
+			if len(val.Ip) == net.IPv4len {
+				peers4 = append(peers4, compactPeer...)
+			} else {
+				peers6 = append(peers6, compactPeer...)
+			}
+		}
+		dict["peers"] = string(peers4)
+		if len(peers6) > 0 {
+			dict["peers6"] = string(peers6)
+		}
+	} else {
+		peerList := make([]interface{}, 0, len(peers))
+		for _, val := range peers {
+			peerDict := make(map[string]interface{})
+			if params.Get("no_peer_id") != "1" {
+				peerDict["peer id"] = val.PeerId
+			}
+			peerDict["ip"] = val.Ip.String()
+			peerDict["port"] = int64(val.Port)
+			peerList = append(peerList, peerDict)
+		}
+		dict["peers"] = peerList
+	}
+	trackerServer.sendResponse(w, dict)
+}
+
+// Send stats of torrents asked for, or of all torrents if none is asked for
+func (trackerServer *TrackerServer) handleScrape(w http.ResponseWriter, r *http.Request) {
+	infoHashes := r.URL.Query()["info_hash"]
+	files := make(map[string]interface{})
+	trackerServer.mutex.Lock()
+	if len(infoHashes) == 0 {
+		for infoHash := range trackerServer.torrents {
+			infoHashes = append(infoHashes, infoHash)
+		}
+	}
+	for _, infoHash := range infoHashes {
+		torrent, ok := trackerServer.torrents[infoHash]
+		if !ok {
+			continue
+		}
+		scrapeInfo := torrent.getScrapeInfo()
+		fileDict := make(map[string]interface{})
+		fileDict["complete"] = scrapeInfo.Seeders
+		fileDict["downloaded"] = scrapeInfo.Completed
+		fileDict["incomplete"] = scrapeInfo.Leechers
+		files[infoHash] = fileDict
+	}
+	trackerServer.mutex.Unlock()
+
+	dict := make(map[string]interface{})
+	dict["files"] = files
+	trackerServer.sendResponse(w, dict)
+}
+
+// Check if tracker serves a torrent
+func (trackerServer *TrackerServer) isTracked(infoHash string) bool {
+	return (len(trackerServer.Whitelist) == 0) || trackerServer.Whitelist[infoHash]
+}
+
+// Send a bencoded response
+func (trackerServer *TrackerServer) sendResponse(w http.ResponseWriter,
+	dict map[string]interface{}) {
+	buf, ok := encodeBencode(dict)
+	if !ok {
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain")
+	w.Write(buf)
+}
+
+// Send a failure reason, peers expect it with HTTP status 200
+func (trackerServer *TrackerServer) sendFailure(w http.ResponseWriter, reason string) {
+	dict := make(map[string]interface{})
+	dict["failure reason"] = reason
+	trackerServer.sendResponse(w, dict)
+}
+
+// Get stats of torrent, as sent in announce and scrape responses
+func (torrent *trackerTorrent) getScrapeInfo() ScrapeInfo {
+	var scrapeInfo ScrapeInfo
+	for _, val := range torrent.peers {
+		if val.Left == 0 {
+			scrapeInfo.Seeders++
+		} else {
+			scrapeInfo.Leechers++
+		}
+	}
+	scrapeInfo.Completed = torrent.completed
+	return scrapeInfo
+}
+
+// Read tracker whitelist from a file having an infohash per line, in hex or
+// base32. Blank lines and lines starting with # are skipped.
+func LoadTrackerWhitelist(fileNameWithPath string) (map[string]bool, bool) {
+	data, er := os.ReadFile(fileNameWithPath)
+	if er != nil {
+		log.Println(DebugGetFuncName(), er)
+		return nil, false
+	}
+	whitelist := make(map[string]bool)
+	for _, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSpace(line)
+		if (len(line) == 0) || strings.HasPrefix(line, "#") {
+			continue
+		}
+		infoHash, ok := ParseInfoHash(line)
+		if !ok {
+			log.Println(DebugGetFuncName(), "Invalid infohash:", line)
+			return nil, false
+		}
+		whitelist[infoHash] = true
+	}
+	return whitelist, true
+}
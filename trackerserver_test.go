@@ -0,0 +1,267 @@
+package gotrnt
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Start tracker on given loopback address, it stops with test. Returns its
+// announce URL.
+func startTestTracker(t *testing.T, trackerServer *TrackerServer, addr string) string {
+	trackerServer.Addr = addr
+	if trackerServer.Interval == 0 {
+		trackerServer.Interval = time.Minute
+	}
+	if trackerServer.PeerExpiry == 0 {
+		trackerServer.PeerExpiry = time.Hour
+	}
+	if !trackerServer.Start() {
+		t.Skip("Can't listen on", addr)
+	}
+	t.Cleanup(trackerServer.Stop)
+	return "http://" + trackerServer.ListenAddr().String() + "/announce"
+}
+
+// Get config with short tracker timeout, for a tracker on loopback
+func getTestTrackerCfg() *GoTorrentCfg {
+	cfg := DefaultGoTorrentCfg(6881)
+	cfg.TrackerTimeout = 5 * time.Second
+	return &cfg
+}
+
+// Announce a peer of a torrent, to be seen by tracker as a seed if left is 0
+func announceTestPeer(t *testing.T, cfg *GoTorrentCfg, announceUrl string, infoHash string,
+	peerId byte, port uint16, left uint64, event string) AnnounceResponse {
+	var req AnnounceRequest
+	req.InfoHash = infoHash
+	req.PeerId = strings.Repeat(string(peerId), 20)
+	req.Port = port
+	req.Left = left
+	req.Event = event
+	resp, er := announceTracker(cfg, new(udpConnIdCache), announceUrl, req, nil)
+	if er != nil {
+		t.Fatal(er)
+	}
+	return resp
+}
+
+func TestTrackerServerAnnounceScrape(t *testing.T) {
+	cfg := getTestTrackerCfg()
+	var trackerServer TrackerServer
+	trackerServer.MinInterval = 10 * time.Second
+	announceUrl := startTestTracker(t, &trackerServer, "127.0.0.1:0")
+	infoHash := strings.Repeat("a", 20)
+
+	resp := announceTestPeer(t, cfg, announceUrl, infoHash, '1', 1000, 0, AnnounceEventStarted)
+	if (resp.Interval != time.Minute) || (resp.MinInterval != 10*time.Second) ||
+		(resp.Seeders != 1) || (len(resp.Peers) != 0) {
+		t.Fatal("Wrong response to first peer:", resp)
+	}
+	resp = announceTestPeer(t, cfg, announceUrl, infoHash, '2', 2000, 5, AnnounceEventStarted)
+	if (resp.Seeders != 1) || (resp.Leechers != 1) || (len(resp.Peers) != 1) ||
+		(resp.Peers[0] != "127.0.0.1:1000") {
+		t.Fatal("Wrong response to second peer:", resp)
+	}
+
+	// Seed doesn't get seeds
+	resp = announceTestPeer(t, cfg, announceUrl, infoHash, '2', 2000, 0, AnnounceEventCompleted)
+	if len(resp.Peers) != 0 {
+		t.Fatal("Seed got seeds:", resp.Peers)
+	}
+	stats, er := ScrapeTracker(cfg, announceUrl, []string{infoHash})
+	if er != nil {
+		t.Fatal(er)
+	}
+	if (stats[infoHash].Seeders != 2) || (stats[infoHash].Leechers != 0) ||
+		(stats[infoHash].Completed != 1) {
+		t.Fatal("Wrong scrape response:", stats)
+	}
+
+	// Stopped peer is dropped
+	announceTestPeer(t, cfg, announceUrl, infoHash, '1', 1000, 0, AnnounceEventStopped)
+	stats, _ = ScrapeTracker(cfg, announceUrl, []string{infoHash})
+	if stats[infoHash].Seeders != 1 {
+		t.Fatal("Stopped peer not dropped:", stats)
+	}
+}
+
+func TestTrackerServerPeerList(t *testing.T) {
+	cfg := getTestTrackerCfg()
+	var trackerServer TrackerServer
+	announceUrl := startTestTracker(t, &trackerServer, "127.0.0.1:0")
+	infoHash := strings.Repeat("a", 20)
+	announceTestPeer(t, cfg, announceUrl, infoHash, '1', 1000, 0, AnnounceEventStarted)
+
+	// Peers as a list of dictionaries, if compact form isn't asked for
+	params := "?info_hash=" + infoHash + "&peer_id=" + strings.Repeat("2", 20) +
+		"&port=2000&left=5"
+	for _, noPeerId := range []bool{false, true} {
+		reqUrl := announceUrl + params
+		if noPeerId {
+			reqUrl += "&no_peer_id=1"
+		}
+		httpResp, er := http.Get(reqUrl)
+		if er != nil {
+			t.Fatal(er)
+		}
+		buf := make([]byte, 1024)
+		bytesRead, _ := httpResp.Body.Read(buf)
+		httpResp.Body.Close()
+		dict, ok := decodeBencodeDict(buf[:bytesRead])
+		if !ok {
+			t.Fatal("Invalid response:", string(buf[:bytesRead]))
+		}
+		peers, _ := dict["peers"].([]interface{})
+		if len(peers) != 1 {
+			t.Fatal("Wrong peers:", dict["peers"])
+		}
+		peerDict, _ := peers[0].(map[string]interface{})
+		if (peerDict["ip"] != "127.0.0.1") || (peerDict["port"] != int64(1000)) {
+			t.Fatal("Wrong peer:", peerDict)
+		}
+		if peerId, ok := peerDict["peer id"]; (ok == noPeerId) ||
+			(!noPeerId && (peerId != strings.Repeat("1", 20))) {
+			t.Fatal("Wrong peer id:", peerDict)
+		}
+	}
+}
+
+func TestTrackerServerPeers6(t *testing.T) {
+	if listener, er := net.Listen("tcp", "[::1]:0"); er != nil {
+		t.Skip("No IPv6 loopback")
+	} else {
+		listener.Close()
+	}
+	cfg := getTestTrackerCfg()
+	var trackerServer TrackerServer
+	announceUrl := startTestTracker(t, &trackerServer, "[::1]:0")
+	infoHash := strings.Repeat("a", 20)
+
+	announceTestPeer(t, cfg, announceUrl, infoHash, '1', 1000, 0, AnnounceEventStarted)
+	resp := announceTestPeer(t, cfg, announceUrl, infoHash, '2', 2000, 5, AnnounceEventStarted)
+	if (len(resp.Peers) != 1) || (resp.Peers[0] != "[::1]:1000") {
+		t.Fatal("Wrong peers6:", resp.Peers)
+	}
+}
+
+func TestTrackerServerWhitelist(t *testing.T) {
+	cfg := getTestTrackerCfg()
+	var trackerServer TrackerServer
+	infoHash := strings.Repeat("a", 20)
+	trackerServer.Whitelist = map[string]bool{infoHash: true}
+	announceUrl := startTestTracker(t, &trackerServer, "127.0.0.1:0")
+
+	announceTestPeer(t, cfg, announceUrl, infoHash, '1', 1000, 0, AnnounceEventStarted)
+	var req AnnounceRequest
+	req.InfoHash = strings.Repeat("b", 20)
+	req.PeerId = strings.Repeat("1", 20)
+	req.Port = 1000
+	if _, er := announceTracker(cfg, new(udpConnIdCache), announceUrl, req, nil); (er == nil) ||
+		!strings.Contains(er.Error(), "not tracked") {
+		t.Fatal("Expected torrent not tracked, got:", er)
+	}
+}
+
+func TestTrackerServerPeerExpiry(t *testing.T) {
+	cfg := getTestTrackerCfg()
+	var trackerServer TrackerServer
+	trackerServer.PeerExpiry = 200 * time.Millisecond
+	announceUrl := startTestTracker(t, &trackerServer, "127.0.0.1:0")
+	infoHash := strings.Repeat("a", 20)
+
+	announceTestPeer(t, cfg, announceUrl, infoHash, '1', 1000, 5, AnnounceEventStarted)
+	stats, _ := ScrapeTracker(cfg, announceUrl, []string{infoHash})
+	if stats[infoHash].Leechers != 1 {
+		t.Fatal("Peer not tracked:", stats)
+	}
+	time.Sleep(3 * trackerServer.PeerExpiry)
+	stats, _ = ScrapeTracker(cfg, announceUrl, []string{infoHash})
+	if _, ok := stats[infoHash]; ok {
+		t.Fatal("Peer not expired:", stats)
+	}
+}
+
+func TestTrackerServerAnnouncer(t *testing.T) {
+	cfg := getTestTrackerCfg()
+	var trackerServer TrackerServer
+	announceUrl := startTestTracker(t, &trackerServer, "127.0.0.1:0")
+	infoHash := strings.Repeat("a", 20)
+
+	// Session without metadata, announcer sends started event on start and
+	// stopped event on stop
+	sessionInfo := new(TrntSessionInfo)
+	sessionInfo.client = NewClient(*cfg)
+	sessionInfo.cfg = cfg
+	sessionInfo.metaInfo.Announce = announceUrl
+	sessionInfo.metaInfo.InfoHash = infoHash
+	if !sessionInfo.announcer.Start(sessionInfo) {
+		t.Fatal("Failed to start announcer")
+	}
+	var stats map[string]ScrapeInfo
+	for i := 0; i < 50; i++ {
+		stats, _ = ScrapeTracker(cfg, announceUrl, []string{infoHash})
+		if stats[infoHash].Leechers == 1 {
+			break
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	if stats[infoHash].Leechers != 1 {
+		t.Fatal("Started event not sent:", stats)
+	}
+
+	sessionInfo.announcer.Stop()
+	trackers := sessionInfo.announcer.GetTrackers()
+	if (len(trackers) != 1) || (len(trackers[0].LastError) > 0) {
+		t.Fatal("Wrong tracker state:", trackers)
+	}
+	stats, _ = ScrapeTracker(cfg, announceUrl, []string{infoHash})
+	if stats[infoHash].Leechers != 0 {
+		t.Fatal("Stopped event not sent:", stats)
+	}
+}
+
+// Hand an announce from given address straight to tracker
+func announceTestAddr(trackerServer *TrackerServer, remoteAddr string, infoHash string,
+	peerId byte, port uint16, event string) {
+	params := url.Values{}
+	params.Set("info_hash", infoHash)
+	params.Set("peer_id", strings.Repeat(string(peerId), 20))
+	params.Set("port", strconv.Itoa(int(port)))
+	params.Set("left", "0")
+	params.Set("event", event)
+	r := httptest.NewRequest("GET", "/announce?"+params.Encode(), nil)
+	r.RemoteAddr = remoteAddr
+	trackerServer.handleAnnounce(httptest.NewRecorder(), r)
+}
+
+func TestTrackerServerPeerKey(t *testing.T) {
+	var trackerServer TrackerServer
+	trackerServer.Interval = time.Minute
+	trackerServer.torrents = make(map[string]*trackerTorrent)
+	infoHash := strings.Repeat("a", 20)
+
+	// Completed is counted once per peer
+	announceTestAddr(&trackerServer, "10.0.0.1:5000", infoHash, '1', 1000, AnnounceEventCompleted)
+	announceTestAddr(&trackerServer, "10.0.0.1:5000", infoHash, '1', 1000, AnnounceEventCompleted)
+	// Same peer id from another address doesn't take over the peer
+	announceTestAddr(&trackerServer, "10.0.0.2:5000", infoHash, '1', 2000, AnnounceEventStarted)
+
+	torrent := trackerServer.torrents[infoHash]
+	if torrent.completed != 1 {
+		t.Fatal("Wrong completed:", torrent.completed)
+	}
+	if len(torrent.peers) != 2 {
+		t.Fatal("Wrong peers:", len(torrent.peers))
+	}
+	for _, val := range torrent.peers {
+		if (val.Ip.String() == "10.0.0.1") && (val.Port != 1000) {
+			t.Fatal("Peer taken over:", val)
+		}
+	}
+}
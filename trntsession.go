@@ -1,19 +1,40 @@
-package main
+package gotrnt
 
 import (
+	"crypto/sha1"
 	"github.com/swatkat/gotrntmetainfoparser"
-	"github.com/swatkat/gotrnttrackerquery"
 	"log"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
 )
 
 type TrntSessionInfo struct {
-	metaInfo    gotrntmetainfoparser.MetaInfo      // Torrent metafile content
-	trackerInfo gotrnttrackerquery.TrackerResponse // Tracker response
-	peerMgr     PeerMgr                            // Peer communication manager
-	pieceMgr    PieceMgr                           // Manages downloading and seeding pieces
+	cfg        *GoTorrentCfg                 // Config of client that session belongs to
+	client     *Client                       // Client that session belongs to
+	dataDir    string                        // Directory in which torrent data is stored
+	metaInfo   gotrntmetainfoparser.MetaInfo // Torrent metafile content
+	infoMutex  sync.RWMutex                  // Guards metaInfo.Info while it may be switched in from fetched metadata
+	magnet     MagnetLink                    // Magnet link, if session was started from one
+	metadata   MetadataMgr                   // Fetches and serves info dictionary
+	hasInfo    int32                         // Set once info dictionary is known, updated atomically
+	announcer  Announcer                     // Announces to tracker and gets a list of peers
+	peerMgr    PeerMgr                       // Peer communication manager
+	pieceMgr   PieceMgr                      // Manages downloading and seeding pieces
+	choker     Choker                        // Decides which peers we upload to
+	dhtQuit    chan bool                     // Closed to stop looking up peers on DHT
+	Uploaded   uint64                        // Bytes uploaded in this session, updated atomically
+	Downloaded uint64                        // Bytes downloaded in this session, updated atomically
+	Duplicates uint64                        // Requests for blocks already requested from other peers, in endgame; updated atomically
+	Wasted     uint64                        // Bytes of blocks received that we already had, updated atomically
+	swarmInfo  ScrapeInfo                    // Swarm stats got in last scrape
+	swarmMutex sync.Mutex                    // Guards swarmInfo
+	done       chan bool                     // Closed once all pieces are in
+	doneOnce   sync.Once                     // Guards closing done
 }
 
-// Read .torrent file, send request to tracker and get a list of peers
+// Read .torrent file
 func (sessionInfo *TrntSessionInfo) Init(fileNameWithPath string) bool {
 	// Read torrent file
 	if !sessionInfo.metaInfo.ReadTorrentMetaInfoFile(fileNameWithPath) {
@@ -21,20 +42,66 @@ func (sessionInfo *TrntSessionInfo) Init(fileNameWithPath string) bool {
 		return false
 	}
 	sessionInfo.metaInfo.DumpTorrentMetaInfo()
+	atomic.StoreInt32(&sessionInfo.hasInfo, 1)
 
-	// Get tracker info for this torrent
-	if !sessionInfo.trackerInfo.GetTrackerInfo(sessionInfo.metaInfo.Announce,
-		sessionInfo.metaInfo.InfoHash, trntCfg.PeerId, uint64(trntCfg.Port)) {
-		log.Println(DebugGetFuncName(), "Failed to get tracker response")
+	// Keep raw info dictionary around, for peers that fetch metadata from us
+	sessionInfo.loadInfoBytes(fileNameWithPath)
+
+	return true
+}
+
+// Read metainfo from contents of a .torrent file. Infohash is the hash of
+// info dictionary as is.
+func (sessionInfo *TrntSessionInfo) InitBytes(buf []byte) bool {
+	dict, ok := decodeBencodeDict(buf)
+	if !ok {
+		log.Println(DebugGetFuncName(), "Failed to decode torrent")
+		return false
+	}
+	infoBytes, ok := getBencodeDictValue(buf, "info")
+	if !ok {
+		log.Println(DebugGetFuncName(), "No info dictionary")
+		return false
+	}
+	info, ok := parseInfoDict(infoBytes)
+	if !ok {
+		log.Println(DebugGetFuncName(), "Invalid info dictionary")
 		return false
 	}
-	sessionInfo.trackerInfo.DumpTrackerResponse()
 
+	infoHash := sha1.Sum(infoBytes)
+	sessionInfo.metaInfo.InfoHash = string(infoHash[:])
+	sessionInfo.metaInfo.Info = info
+	sessionInfo.metaInfo.Announce, _ = dict["announce"].(string)
+	announceList, _ := dict["announce-list"].([]interface{})
+	for _, val := range announceList {
+		tierList, _ := val.([]interface{})
+		var tier []string
+		for _, elem := range tierList {
+			if announceUrl, ok := elem.(string); ok {
+				tier = append(tier, announceUrl)
+			}
+		}
+		if len(tier) > 0 {
+			sessionInfo.metaInfo.AnnounceList = append(sessionInfo.metaInfo.AnnounceList, tier)
+		}
+	}
+	atomic.StoreInt32(&sessionInfo.hasInfo, 1)
+	sessionInfo.metadata.InfoBytes = infoBytes
 	return true
 }
 
 // Start torrenting
 func (sessionInfo *TrntSessionInfo) Start() bool {
+	// Without metadata, all we can do is fetch it from peers
+	if !sessionInfo.hasMetaInfo() {
+		return sessionInfo.startMetadata()
+	}
+
+	// Piece mgr must be ready before peers send their pieces info
+	if !sessionInfo.pieceMgr.Init(sessionInfo) {
+		return false
+	}
 
 	// Kick start peer mgr
 	sessionInfo.peerMgr.Start(sessionInfo)
@@ -42,17 +109,241 @@ func (sessionInfo *TrntSessionInfo) Start() bool {
 	// Kick start piece mgr
 	sessionInfo.pieceMgr.Start(sessionInfo)
 
+	// Kick start choker
+	sessionInfo.choker.Start(sessionInfo)
+
+	// Let peers connect to us for this torrent
+	sessionInfo.client.registerSession(sessionInfo)
+
+	// Kick start announcer, peers got from tracker are handed over to peer mgr
+	sessionInfo.announcer.Start(sessionInfo)
+
+	// Look up peers on DHT too
+	sessionInfo.startDht()
+
 	return true
 }
 
+// Fetch metadata from peers got from magnet link and tracker. Download
+// starts once metadata is in.
+func (sessionInfo *TrntSessionInfo) startMetadata() bool {
+	sessionInfo.metadata.Start(sessionInfo)
+	sessionInfo.peerMgr.Start(sessionInfo)
+	sessionInfo.client.registerSession(sessionInfo)
+	sessionInfo.announcer.Start(sessionInfo)
+	sessionInfo.startDht()
+	sessionInfo.peerMgr.AddPeers(sessionInfo, sessionInfo.magnet.Peers)
+	return true
+}
+
+// Switch over to downloading torrent data, once metadata is fetched. Peers
+// are connected to again, so that they send their bitfields for pieces that
+// we now know of. Client's queueMutex must be held, and torrent running.
+func (sessionInfo *TrntSessionInfo) startDownload() bool {
+	info, ok := parseInfoDict(sessionInfo.metadata.getInfoBytes())
+	if !ok {
+		log.Println(DebugGetFuncName(), "Invalid info dictionary")
+		return false
+	}
+
+	// Drop peers, keeping their addresses
+	var peerIpPortList []string
+	for _, val := range sessionInfo.peerMgr.getPeers() {
+		peerIpPortList = append(peerIpPortList, val.Addr)
+	}
+	sessionInfo.client.unregisterSession(sessionInfo)
+	sessionInfo.metadata.Stop()
+	sessionInfo.peerMgr.Stop()
+
+	sessionInfo.infoMutex.Lock()
+	sessionInfo.metaInfo.Info = info
+	sessionInfo.infoMutex.Unlock()
+	atomic.StoreInt32(&sessionInfo.hasInfo, 1)
+	if sessionInfo.isPrivate() {
+		sessionInfo.stopDht()
+	}
+	debugPrintln(sessionInfo.cfg.DebugOutput,
+		DebugGetFuncName(), "Starting download:", info.Name)
+	if !sessionInfo.pieceMgr.Init(sessionInfo) {
+		return false
+	}
+	sessionInfo.peerMgr.Start(sessionInfo)
+	sessionInfo.pieceMgr.Start(sessionInfo)
+	sessionInfo.choker.Start(sessionInfo)
+	sessionInfo.client.registerSession(sessionInfo)
+	sessionInfo.peerMgr.AddPeers(sessionInfo, peerIpPortList)
+
+	// Save metainfo, so that magnet link isn't needed next time
+	return sessionInfo.SaveTorrentFile(filepath.Join(sessionInfo.dataDir, info.Name+".torrent"))
+}
+
 // Stop torrenting
 func (sessionInfo *TrntSessionInfo) Stop() bool {
 
+	// Don't take any more incoming peers
+	sessionInfo.client.unregisterSession(sessionInfo)
+
+	// Stop fetching metadata
+	sessionInfo.metadata.Stop()
+
+	// Stop looking up peers on DHT
+	sessionInfo.stopDht()
+
+	// Stop choker
+	sessionInfo.choker.Stop()
+
+	// Let tracker know that we're going away
+	sessionInfo.announcer.Stop()
+
 	// Stop peer mgr
 	sessionInfo.peerMgr.Stop()
 
 	// Stop piece mgr
-	sessionInfo.pieceMgr.Stop()
+	sessionInfo.pieceMgr.Stop(sessionInfo)
+
+	return true
+}
+
+// Open storage of torrent with client's storage opener, plain files by
+// default
+func (sessionInfo *TrntSessionInfo) openStorage() (Storage, error) {
+	openStorage := sessionInfo.cfg.NewStorage
+	if openStorage == nil {
+		openStorage = OpenFileStorage
+	}
+	return openStorage(&sessionInfo.metaInfo, sessionInfo.dataDir)
+}
+
+// Move torrent data and its resume state to another directory. Session must
+// be stopped.
+func (sessionInfo *TrntSessionInfo) moveStorage(dir string) bool {
+	// Nothing is downloaded till metadata is in
+	if !sessionInfo.hasMetaInfo() {
+		sessionInfo.dataDir = dir
+		return true
+	}
+
+	storage, er := sessionInfo.openStorage()
+	if er != nil {
+		log.Println(DebugGetFuncName(), er)
+		return false
+	}
+	er = storage.Move(dir)
+	storage.Close()
+	if er != nil {
+		log.Println(DebugGetFuncName(), er)
+		return false
+	}
+	oldResumeFilePath := getResumeFilePath(sessionInfo)
+	sessionInfo.dataDir = dir
+	if er := moveFile(oldResumeFilePath, getResumeFilePath(sessionInfo)); (er != nil) && !os.IsNotExist(er) {
+		log.Println(DebugGetFuncName(), er)
+	}
+	return true
+}
 
+// Look up peers on DHT periodically, unless torrent is private
+func (sessionInfo *TrntSessionInfo) startDht() bool {
+	dhtNode := &sessionInfo.client.dhtNode
+	if !dhtNode.IsRunning() || sessionInfo.isPrivate() || (sessionInfo.dhtQuit != nil) {
+		return false
+	}
+	sessionInfo.dhtQuit = make(chan bool)
+	go dhtNode.announceSession(sessionInfo, sessionInfo.dhtQuit)
 	return true
 }
+
+// Stop looking up peers on DHT
+func (sessionInfo *TrntSessionInfo) stopDht() {
+	if sessionInfo.dhtQuit != nil {
+		close(sessionInfo.dhtQuit)
+		sessionInfo.dhtQuit = nil
+	}
+}
+
+// Note that all pieces are in. Torrent now needs a seed slot rather than a
+// download slot, so queued torrents are looked at again.
+func (sessionInfo *TrntSessionInfo) setCompleted() {
+	sessionInfo.doneOnce.Do(func() {
+		close(sessionInfo.done)
+		go sessionInfo.client.scheduleTorrents()
+	})
+}
+
+// Check if all pieces are in
+func (sessionInfo *TrntSessionInfo) isCompleted() bool {
+	select {
+	case <-sessionInfo.done:
+		return true
+	default:
+		return false
+	}
+}
+
+// Check if we have info dictionary of torrent
+func (sessionInfo *TrntSessionInfo) hasMetaInfo() bool {
+	return atomic.LoadInt32(&sessionInfo.hasInfo) == 1
+}
+
+// Get name of torrent. Name of a magnet link may change once its metadata
+// is in.
+func (sessionInfo *TrntSessionInfo) getName() string {
+	sessionInfo.infoMutex.RLock()
+	defer sessionInfo.infoMutex.RUnlock()
+	return sessionInfo.metaInfo.Info.Name
+}
+
+// Check if torrent is private, peers of a private torrent come from its
+// tracker only
+func (sessionInfo *TrntSessionInfo) isPrivate() bool {
+	return sessionInfo.metaInfo.Info.Private == 1
+}
+
+// Get total length of all files in torrent
+func (sessionInfo *TrntSessionInfo) getTotalLength() int64 {
+	if len(sessionInfo.metaInfo.Info.Files) == 0 {
+		return sessionInfo.metaInfo.Info.Length
+	}
+	totalLen := int64(0)
+	for _, fileInfo := range sessionInfo.metaInfo.Info.Files {
+		totalLen += fileInfo.Length
+	}
+	return totalLen
+}
+
+// Get number of bytes that we're yet to download
+func (sessionInfo *TrntSessionInfo) getBytesLeft() uint64 {
+	// Size isn't known without metadata, but we aren't a seed either
+	if !sessionInfo.hasMetaInfo() {
+		return uint64(sessionInfo.cfg.PieceBlockLen)
+	}
+	bytesLeft := uint64(sessionInfo.getTotalLength())
+	sessionInfo.peerMgr.myInfo.BitField.ForEach(func(pieceIdx uint32) bool {
+		bytesLeft -= uint64(sessionInfo.getPieceLength(pieceIdx))
+		return true
+	})
+	return bytesLeft
+}
+
+// Get number of pieces in torrent
+func (sessionInfo *TrntSessionInfo) getNumPieces() uint32 {
+	return uint32(len(sessionInfo.metaInfo.Info.Pieces) / sha1.Size)
+}
+
+// Get length of a piece, last piece may be shorter than the rest
+func (sessionInfo *TrntSessionInfo) getPieceLength(pieceIdx uint32) uint32 {
+	pieceLen := sessionInfo.metaInfo.Info.PieceLength
+	if pieceIdx+1 == sessionInfo.getNumPieces() {
+		pieceLen = sessionInfo.getTotalLength() - (pieceLen * int64(pieceIdx))
+	}
+	return uint32(pieceLen)
+}
+
+// Get SHA-1 hash of a piece from metainfo
+func (sessionInfo *TrntSessionInfo) getPieceHash(pieceIdx uint32) (string, bool) {
+	if pieceIdx >= sessionInfo.getNumPieces() {
+		return "", false
+	}
+	begin := int(pieceIdx) * sha1.Size
+	return sessionInfo.metaInfo.Info.Pieces[begin : begin+sha1.Size], true
+}
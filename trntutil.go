@@ -1,7 +1,9 @@
-package main
+package gotrnt
 
 import (
+	"context"
 	"fmt"
+	"io"
 	"math/rand"
 	"net"
 	"os"
@@ -19,25 +21,102 @@ var goTrntHeaderLen byte = byte(len(goTrntHeader))
 type GoTorrentCfg struct {
 	Port               uint16        // Port on which we listen for new peers
 	PeerId             string        // Our peer id, randomly generated
-	WaitForListener    chan bool     // Todo
 	MyTCPAddr          *net.TCPAddr  // Our server port
 	PeerConnectTimeout time.Duration // Timeout in seconds, used while connecting to peers
+	HandshakeTimeout   time.Duration // Time within which a peer must send its handshake
 	PieceBlockLen      uint32        // Size of block in a piece, used while downloading a piece
+	DownloadDir        string        // Directory in which torrent data is stored
+	MaxPeerRequests    uint32        // Max number of block requests outstanding with a peer
+	RequestInterval    time.Duration // How often piece requester looks for blocks to request
+	RequestTimeout     time.Duration // Least time a peer gets to send a requested block, before it's requested again
+	SnubTimeout        time.Duration // Peer that sends no block for this long is snubbed
+	RandomFirstPieces  int           // Download random pieces till we have these many pieces
+	MaxRequestLen      uint32        // Largest block that a peer may request from us
+	MaxUploadQueue     uint32        // Max number of requests from a peer, waiting to be served
+	UploadSlots        int           // Number of peers unchoked for reciprocation, besides optimistic unchoke
+	ChokeInterval      time.Duration // How often choker picks peers to unchoke
+	OptimisticInterval time.Duration // How often optimistic unchoke moves to another peer
+	TrackerTimeout     time.Duration // Timeout for a request to tracker
+	AnnounceInterval   time.Duration // Announce interval, if tracker doesn't give one
+	AnnounceRetryWait  time.Duration // Time to wait before retrying a failed announce
+	ResumeSaveInterval time.Duration // How often fast resume state is saved
+	MetadataTimeout    time.Duration // Time after which a metadata piece is requested again
+	MaxMetadataSize    int           // Largest info dictionary that we fetch from peers
+	MaxPeers           int           // Don't connect to peers from candidate pool beyond these many peers
+	MaxCandidates      int           // Max number of peers kept in candidate pool
+	PexInterval        time.Duration // How often peer exchange msgs are sent to a peer
+	MaxPexPeers        int           // Max number of added or dropped peers in a peer exchange msg
+	DhtAddr            *net.UDPAddr  // Our DHT node address, DHT is turned off if nil
+	DhtBootstrap       []string      // host:port of nodes that we join DHT through
+	DhtNodesFile       string        // DHT routing table is saved in this file between runs
+	DhtTimeout         time.Duration // Timeout for a query to a DHT node
+	DhtInterval        time.Duration // How often a torrent's peers are looked up and announced on DHT
+	UdpTrackerTimeout  time.Duration // Timeout of first try of a UDP tracker request, doubled on each retry
+	UdpTrackerRetries  int           // Number of times a UDP tracker request is retried
+	AnnounceParallel   bool          // Announce to all tiers of trackers at once, rather than till one responds
+	TrackerAddr        string        // Address on which our tracker listens, when run as tracker
+	TrackerInterval    time.Duration // Announce interval that our tracker sends to peers
+	TrackerMinInterval time.Duration // Min announce interval that our tracker sends to peers
+	TrackerPeerExpiry  time.Duration // Our tracker drops a peer that doesn't announce for this long
+	MaxConnections     int           // Max number of peer connections of all torrents, 0 for no limit
+	MaxHalfOpen        int           // Max number of connections being dialed at once, 0 for no limit
+	MaxActiveDownloads int           // Max number of torrents downloading at once, others wait in queue; 0 for no limit
+	MaxActiveSeeds     int           // Max number of torrents seeding at once, others wait in queue; 0 for no limit
+	NewStorage         StorageOpener // Opens storage of a torrent, plain files if nil
+	DebugOutput        io.Writer     // Debug output of client goes here, stdout if nil
 }
 
-// Global containing GoTrnt specific data
-var trntCfg GoTorrentCfg
-
-// Initialize gotrnt app specific config
-func init() {
+// Get default gotrnt config, listening for peers and DHT nodes on given
+// port. Each config gets a new peer id.
+func DefaultGoTorrentCfg(port uint16) GoTorrentCfg {
+	var trntCfg GoTorrentCfg
 	trntCfg.PeerId = generatePeerId()
-	trntCfg.Port = 6882
-	trntCfg.WaitForListener = make(chan bool)
+	trntCfg.Port = port
 	str := fmt.Sprintf(":%d", trntCfg.Port)
 	trntCfg.MyTCPAddr, _ = net.ResolveTCPAddr("tcp", str)
 	trntCfg.PeerConnectTimeout = 2 * time.Second
+	trntCfg.HandshakeTimeout = 10 * time.Second
 	trntCfg.PieceBlockLen = 0x4000 // 16KB
-	fmt.Println(DebugGetFuncName(), "My address: ", trntCfg.MyTCPAddr)
+	trntCfg.DownloadDir = "."
+	trntCfg.MaxPeerRequests = 5
+	trntCfg.RequestInterval = 100 * time.Millisecond
+	trntCfg.RequestTimeout = 10 * time.Second
+	trntCfg.SnubTimeout = time.Minute
+	trntCfg.RandomFirstPieces = 4
+	trntCfg.MaxRequestLen = 0x20000 // 128KB
+	trntCfg.MaxUploadQueue = 250
+	trntCfg.UploadSlots = 4
+	trntCfg.ChokeInterval = 10 * time.Second
+	trntCfg.OptimisticInterval = 30 * time.Second
+	trntCfg.TrackerTimeout = 15 * time.Second
+	trntCfg.AnnounceInterval = 30 * time.Minute
+	trntCfg.AnnounceRetryWait = time.Minute
+	trntCfg.ResumeSaveInterval = time.Minute
+	trntCfg.MetadataTimeout = 10 * time.Second
+	trntCfg.MaxMetadataSize = 0x1000000 // 16MB
+	trntCfg.MaxPeers = 50
+	trntCfg.MaxCandidates = 1000
+	trntCfg.PexInterval = time.Minute
+	trntCfg.MaxPexPeers = 50
+	trntCfg.DhtAddr, _ = net.ResolveUDPAddr("udp", str)
+	trntCfg.DhtBootstrap = []string{"router.bittorrent.com:6881",
+		"dht.transmissionbt.com:6881", "router.utorrent.com:6881"}
+	trntCfg.DhtNodesFile = fmt.Sprintf("gotrnt-dht-%d.dat", trntCfg.Port)
+	trntCfg.DhtTimeout = 5 * time.Second
+	trntCfg.DhtInterval = 15 * time.Minute
+	trntCfg.UdpTrackerTimeout = 15 * time.Second
+	trntCfg.UdpTrackerRetries = 2
+	trntCfg.AnnounceParallel = false
+	trntCfg.TrackerAddr = ":6969"
+	trntCfg.TrackerInterval = 30 * time.Minute
+	trntCfg.TrackerMinInterval = 5 * time.Minute
+	trntCfg.TrackerPeerExpiry = 2*trntCfg.TrackerInterval + trntCfg.TrackerMinInterval
+	trntCfg.MaxConnections = 500
+	trntCfg.MaxHalfOpen = 50
+	trntCfg.MaxActiveDownloads = 5
+	trntCfg.MaxActiveSeeds = 0
+	trntCfg.NewStorage = OpenFileStorage
+	return trntCfg
 }
 
 // Generate a 20 byte peer id for us
@@ -47,6 +126,14 @@ func generatePeerId() string {
 	return peerId[0:20]
 }
 
+// Print debug output to w, formatted as fmt.Println does; stdout if w is nil
+func debugPrintln(w io.Writer, a ...interface{}) {
+	if w == nil {
+		w = os.Stdout
+	}
+	fmt.Fprintln(w, a...)
+}
+
 func DebugGetFuncName() string {
 	pc, _, _, ok := runtime.Caller(1)
 	if ok {
@@ -75,8 +162,16 @@ func getBytesFromUint32(num uint32) []byte {
 
 func getBytesFromUint16(num uint16) []byte {
 	var buf [2]byte
-	buf[0] = byte((num >> 8) | 0xff)
-	buf[1] = byte(num | 0xff)
+	buf[0] = byte((num >> 8) & 0xff)
+	buf[1] = byte(num & 0xff)
+	return buf[0:]
+}
+
+func getBytesFromUint64(num uint64) []byte {
+	var buf [8]byte
+	for i := 0; i < 8; i++ {
+		buf[i] = byte((num >> uint(56-(8*i))) & 0xff)
+	}
 	return buf[0:]
 }
 
@@ -94,3 +189,41 @@ func getUint32FromBytes(buf []byte) uint32 {
 	return ((uint32(buf[0]) << 24) | (uint32(buf[1]) << 16) |
 		(uint32(buf[2]) << 8) | uint32(buf[3]))
 }
+
+func getUint64FromBytes(buf []byte) uint64 {
+	if len(buf) < 8 {
+		return 0
+	}
+	return (uint64(getUint32FromBytes(buf[0:4])) << 32) | uint64(getUint32FromBytes(buf[4:8]))
+}
+
+// Check if a quit chan is closed, a nil chan never is
+func isClosed(quit chan bool) bool {
+	select {
+	case <-quit:
+		return true
+	default:
+		return false
+	}
+}
+
+// Get a context that's cancelled once quit is closed, or cancel is called
+func getQuitContext(quit chan bool) (context.Context, context.CancelFunc) {
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		select {
+		case <-quit:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+	return ctx, cancel
+}
+
+// Get a bool as 1 or 0, for flags that are updated atomically
+func getAtomicBool(b bool) int32 {
+	if b {
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,288 @@
+package gotrnt
+
+import (
+	"bytes"
+	"errors"
+	"math/rand"
+	"net"
+	"net/url"
+	"sync"
+	"time"
+)
+
+// UDP tracker protocol (BEP 15) constants
+const (
+	udpTrackerProtocolId = 0x41727101980 // Magic constant sent in connect request
+	udpConnIdLifetime    = time.Minute   // Connection id may be used for this long
+	udpMaxScrapeHashes   = 74            // Max number of infohashes in a scrape request
+)
+
+// UDP tracker actions
+const (
+	udpActionConnect = iota
+	udpActionAnnounce
+	udpActionScrape
+	udpActionError
+)
+
+// UDP tracker announce events
+var udpTrackerEvents = map[string]uint32{
+	AnnounceEventNone:      0,
+	AnnounceEventCompleted: 1,
+	AnnounceEventStarted:   2,
+	AnnounceEventStopped:   3,
+}
+
+// Connection id got from a UDP tracker
+type udpConnId struct {
+	id        uint64    // Connection id
+	expiresAt time.Time // Connection id can't be used after this
+}
+
+// Connection ids of UDP trackers, so that each request doesn't have to
+// connect first
+type udpConnIdCache struct {
+	connIds map[string]udpConnId // Map of tracker ip:port -> connection id
+	mutex   sync.Mutex           // Guards connIds
+}
+
+// Sent in announces, lets tracker tell us apart if our IP address changes
+var udpTrackerKey = rand.Uint32()
+
+// Error msg from tracker, it isn't worth retrying a request that failed so
+var errUdpTrackerFailure = errors.New("udp tracker failure")
+
+// Send announce to a UDP tracker. Closing quit cuts it short, it may be nil.
+func announceUdp(cfg *GoTorrentCfg, connIds *udpConnIdCache, announceUrl string,
+	req AnnounceRequest, quit chan bool) (AnnounceResponse, error) {
+	var resp AnnounceResponse
+	trackerAddr, er := getUdpTrackerAddr(announceUrl)
+	if er != nil {
+		return resp, er
+	}
+
+	var payload bytes.Buffer
+	payload.WriteString(req.InfoHash)
+	payload.WriteString(req.PeerId)
+	payload.Write(getBytesFromUint64(req.Downloaded))
+	payload.Write(getBytesFromUint64(req.Left))
+	payload.Write(getBytesFromUint64(req.Uploaded))
+	payload.Write(getBytesFromUint32(udpTrackerEvents[req.Event]))
+	payload.Write(getBytesFromUint32(0)) // IP address, tracker takes it from packet
+	payload.Write(getBytesFromUint32(udpTrackerKey))
+	payload.Write(getBytesFromUint32(0xffffffff)) // Number of peers wanted, default
+	payload.Write(getBytesFromUint16(req.Port))
+
+	// Don't hold up shutdown for long, on stopped event
+	maxRetries := cfg.UdpTrackerRetries
+	if req.Event == AnnounceEventStopped {
+		maxRetries = 0
+	}
+	buf, er := udpTrackerRequest(cfg, connIds, trackerAddr, udpActionAnnounce, payload.Bytes(),
+		maxRetries, quit)
+	if er != nil {
+		return resp, er
+	}
+	if len(buf) < 20 {
+		return resp, errors.New("invalid udp tracker response")
+	}
+
+	resp.Interval = cfg.AnnounceInterval
+	if interval := getUint32FromBytes(buf[8:12]); interval > 0 {
+		resp.Interval = time.Duration(interval) * time.Second
+	}
+	resp.Leechers = int64(getUint32FromBytes(buf[12:16]))
+	resp.Seeders = int64(getUint32FromBytes(buf[16:20]))
+
+	// Peers are of same address family as tracker
+	ipLen := net.IPv6len
+	if trackerAddr.IP.To4() != nil {
+		ipLen = net.IPv4len
+	}
+	resp.Peers = parseCompactPeers(string(buf[20:]), ipLen)
+	return resp, nil
+}
+
+// Get stats of torrents from a UDP tracker. Returns stats in the same order
+// as infohashes. Closing quit cuts it short, it may be nil.
+func scrapeUdp(cfg *GoTorrentCfg, connIds *udpConnIdCache, announceUrl string,
+	infoHashes []string, quit chan bool) ([]ScrapeInfo, error) {
+	// Sanity checks
+	if (len(infoHashes) == 0) || (len(infoHashes) > udpMaxScrapeHashes) {
+		return nil, errors.New("invalid number of infohashes")
+	}
+
+	trackerAddr, er := getUdpTrackerAddr(announceUrl)
+	if er != nil {
+		return nil, er
+	}
+	var payload bytes.Buffer
+	for _, val := range infoHashes {
+		payload.WriteString(val)
+	}
+	buf, er := udpTrackerRequest(cfg, connIds, trackerAddr, udpActionScrape, payload.Bytes(),
+		cfg.UdpTrackerRetries, quit)
+	if er != nil {
+		return nil, er
+	}
+	if len(buf) < 8+(12*len(infoHashes)) {
+		return nil, errors.New("invalid udp tracker response")
+	}
+
+	stats := make([]ScrapeInfo, len(infoHashes))
+	for i := range stats {
+		offset := 8 + (12 * i)
+		stats[i].Seeders = int64(getUint32FromBytes(buf[offset : offset+4]))
+		stats[i].Completed = int64(getUint32FromBytes(buf[offset+4 : offset+8]))
+		stats[i].Leechers = int64(getUint32FromBytes(buf[offset+8 : offset+12]))
+	}
+	return stats, nil
+}
+
+// Get ip:port of tracker from its udp:// URL
+func getUdpTrackerAddr(announceUrl string) (*net.UDPAddr, error) {
+	trackerUrl, er := url.Parse(announceUrl)
+	if er != nil {
+		return nil, er
+	}
+	return net.ResolveUDPAddr("udp", trackerUrl.Host)
+}
+
+// Send a request to UDP tracker and get its response. Connects first if we
+// don't have a valid connection id. Request is retried if tracker doesn't
+// respond, waiting UdpTrackerTimeout * 2^n for response to nth try. Closing
+// quit gives up on a request that's under way.
+func udpTrackerRequest(cfg *GoTorrentCfg, connIds *udpConnIdCache, trackerAddr *net.UDPAddr,
+	action uint32, payload []byte, maxRetries int, quit chan bool) ([]byte, error) {
+	conn, er := net.DialUDP("udp", nil, trackerAddr)
+	if er != nil {
+		return nil, er
+	}
+	defer conn.Close()
+
+	// Closing conn ends a wait for response
+	done := make(chan bool)
+	defer close(done)
+	go func() {
+		select {
+		case <-quit:
+			conn.Close()
+		case <-done:
+		}
+	}()
+	errCancelled := errors.New("udp tracker request cancelled")
+
+	for n := 0; n <= maxRetries; n++ {
+		timeout := cfg.UdpTrackerTimeout << uint(n)
+
+		// Get connection id
+		connId, ok := connIds.get(trackerAddr)
+		if !ok {
+			var req bytes.Buffer
+			req.Write(getBytesFromUint64(udpTrackerProtocolId))
+			req.Write(getBytesFromUint32(udpActionConnect))
+			req.Write(getBytesFromUint32(rand.Uint32())) // Transaction id
+			resp, er := udpTrackerTransact(conn, req.Bytes(), udpActionConnect, timeout)
+			if isClosed(quit) {
+				return nil, errCancelled
+			} else if isTimeout(er) {
+				continue
+			} else if er != nil {
+				return nil, er
+			}
+			if len(resp) < 16 {
+				return nil, errors.New("invalid udp tracker response")
+			}
+			connId = getUint64FromBytes(resp[8:16])
+			connIds.set(trackerAddr, connId)
+		}
+
+		// Send actual request
+		var req bytes.Buffer
+		req.Write(getBytesFromUint64(connId))
+		req.Write(getBytesFromUint32(action))
+		req.Write(getBytesFromUint32(rand.Uint32())) // Transaction id
+		req.Write(payload)
+		resp, er := udpTrackerTransact(conn, req.Bytes(), action, timeout)
+		if isClosed(quit) {
+			return nil, errCancelled
+		} else if isTimeout(er) {
+			continue
+		} else if er == errUdpTrackerFailure {
+			// Connection id may be the reason, get a new one next time
+			connIds.clear(trackerAddr)
+			return nil, errors.New("udp tracker failure: " + string(resp))
+		} else if er != nil {
+			return nil, er
+		}
+		return resp, nil
+	}
+	return nil, errors.New("udp tracker timed out")
+}
+
+// Send a request, and wait for response having same action and transaction
+// id. In case tracker sends an error, error msg is returned as response.
+func udpTrackerTransact(conn *net.UDPConn, req []byte, action uint32,
+	timeout time.Duration) ([]byte, error) {
+	if _, er := conn.Write(req); er != nil {
+		return nil, er
+	}
+	tid := req[12:16]
+
+	conn.SetReadDeadline(time.Now().Add(timeout))
+	buf := make([]byte, 0x10000)
+	for {
+		bytesRead, er := conn.Read(buf)
+		if er != nil {
+			return nil, er
+		}
+		resp := buf[:bytesRead]
+		if (len(resp) < 8) || !bytes.Equal(resp[4:8], tid) {
+			continue
+		}
+		if getUint32FromBytes(resp[0:4]) == udpActionError {
+			return resp[8:], errUdpTrackerFailure
+		}
+		if getUint32FromBytes(resp[0:4]) != action {
+			return nil, errors.New("invalid udp tracker response")
+		}
+		return resp, nil
+	}
+}
+
+// Get cached connection id of tracker, if it hasn't expired
+func (connIds *udpConnIdCache) get(trackerAddr *net.UDPAddr) (uint64, bool) {
+	connIds.mutex.Lock()
+	defer connIds.mutex.Unlock()
+	connId, ok := connIds.connIds[trackerAddr.String()]
+	if !ok || time.Now().After(connId.expiresAt) {
+		return 0, false
+	}
+	return connId.id, true
+}
+
+// Cache connection id got from tracker
+func (connIds *udpConnIdCache) set(trackerAddr *net.UDPAddr, id uint64) {
+	connIds.mutex.Lock()
+	defer connIds.mutex.Unlock()
+	if connIds.connIds == nil {
+		connIds.connIds = make(map[string]udpConnId)
+	}
+	var connId udpConnId
+	connId.id = id
+	connId.expiresAt = time.Now().Add(udpConnIdLifetime)
+	connIds.connIds[trackerAddr.String()] = connId
+}
+
+// Forget connection id of tracker
+func (connIds *udpConnIdCache) clear(trackerAddr *net.UDPAddr) {
+	connIds.mutex.Lock()
+	delete(connIds.connIds, trackerAddr.String())
+	connIds.mutex.Unlock()
+}
+
+// Check if a network error is a timeout
+func isTimeout(er error) bool {
+	netEr, ok := er.(net.Error)
+	return ok && netEr.Timeout()
+}
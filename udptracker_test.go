@@ -0,0 +1,231 @@
+package gotrnt
+
+import (
+	"bytes"
+	"net"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// Stand-in UDP tracker, answers requests as per BEP 15
+type testUdpTracker struct {
+	conn      *net.UDPConn
+	connId    uint64 // Connection id handed out to clients
+	connects  int32  // Number of connect requests, updated atomically
+	announces int32  // Number of announce requests, updated atomically
+	scrapes   int32  // Number of scrape requests, updated atomically
+	dropNext  int32  // Set to drop next announce without a response, updated atomically
+}
+
+// Start stand-in tracker on loopback, it stops with test
+func startTestUdpTracker(t *testing.T) *testUdpTracker {
+	conn, er := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if er != nil {
+		t.Fatal(er)
+	}
+	tracker := &testUdpTracker{conn: conn, connId: 0xabcdef}
+	t.Cleanup(func() { conn.Close() })
+	go tracker.run()
+	return tracker
+}
+
+// Get udp:// announce URL of tracker
+func (tracker *testUdpTracker) url() string {
+	return "udp://" + tracker.conn.LocalAddr().String() + "/announce"
+}
+
+func (tracker *testUdpTracker) run() {
+	buf := make([]byte, 2048)
+	for {
+		bytesRead, addr, er := tracker.conn.ReadFromUDP(buf)
+		if er != nil {
+			return
+		}
+		req := buf[:bytesRead]
+		if len(req) < 16 {
+			continue
+		}
+		connId := getUint64FromBytes(req[0:8])
+		action := getUint32FromBytes(req[8:12])
+		var resp bytes.Buffer
+		if action == udpActionConnect {
+			atomic.AddInt32(&tracker.connects, 1)
+			if connId != udpTrackerProtocolId {
+				continue
+			}
+			resp.Write(getBytesFromUint32(udpActionConnect))
+			resp.Write(req[12:16])
+			resp.Write(getBytesFromUint64(tracker.connId))
+			tracker.conn.WriteToUDP(resp.Bytes(), addr)
+			continue
+		}
+		if connId != tracker.connId {
+			resp.Write(getBytesFromUint32(udpActionError))
+			resp.Write(req[12:16])
+			resp.WriteString("bad connection id")
+			tracker.conn.WriteToUDP(resp.Bytes(), addr)
+			continue
+		}
+
+		switch action {
+		case udpActionAnnounce:
+			atomic.AddInt32(&tracker.announces, 1)
+			if atomic.CompareAndSwapInt32(&tracker.dropNext, 1, 0) || (len(req) != 98) {
+				continue
+			}
+			resp.Write(getBytesFromUint32(udpActionAnnounce))
+			resp.Write(req[12:16])
+			resp.Write(getBytesFromUint32(1800)) // Interval
+			resp.Write(getBytesFromUint32(3))    // Leechers
+			resp.Write(getBytesFromUint32(5))    // Seeders
+			resp.Write([]byte{10, 0, 0, 1, 0x1a, 0xe1, 10, 0, 0, 2, 0, 80})
+
+		case udpActionScrape:
+			atomic.AddInt32(&tracker.scrapes, 1)
+			resp.Write(getBytesFromUint32(udpActionScrape))
+			resp.Write(req[12:16])
+			for i := 16; i+20 <= len(req); i += 20 {
+				resp.Write(getBytesFromUint32(7)) // Seeders
+				resp.Write(getBytesFromUint32(8)) // Completed
+				resp.Write(getBytesFromUint32(9)) // Leechers
+			}
+		}
+		tracker.conn.WriteToUDP(resp.Bytes(), addr)
+	}
+}
+
+// Get config with short timeouts, for a tracker on loopback
+func getTestUdpTrackerCfg() *GoTorrentCfg {
+	cfg := DefaultGoTorrentCfg(6881)
+	cfg.UdpTrackerTimeout = 100 * time.Millisecond
+	cfg.UdpTrackerRetries = 2
+	return &cfg
+}
+
+// Get an announce request for a made up torrent
+func getTestAnnounceRequest() AnnounceRequest {
+	var req AnnounceRequest
+	req.InfoHash = strings.Repeat("a", 20)
+	req.PeerId = strings.Repeat("b", 20)
+	req.Port = 6881
+	req.Left = 1000
+	req.Event = AnnounceEventStarted
+	return req
+}
+
+func TestUdpTrackerAnnounceScrape(t *testing.T) {
+	cfg := getTestUdpTrackerCfg()
+	tracker := startTestUdpTracker(t)
+	req := getTestAnnounceRequest()
+	connIds := new(udpConnIdCache)
+
+	resp, er := announceUdp(cfg, connIds, tracker.url(), req, nil)
+	if er != nil {
+		t.Fatal(er)
+	}
+	if (resp.Interval != 1800*time.Second) || (resp.Seeders != 5) || (resp.Leechers != 3) {
+		t.Fatal("Wrong announce response:", resp)
+	}
+	if (len(resp.Peers) != 2) || (resp.Peers[0] != "10.0.0.1:6881") ||
+		(resp.Peers[1] != "10.0.0.2:80") {
+		t.Fatal("Wrong peers:", resp.Peers)
+	}
+
+	stats, er := scrapeUdp(cfg, connIds, tracker.url(), []string{req.InfoHash, strings.Repeat("c", 20)},
+		nil)
+	if er != nil {
+		t.Fatal(er)
+	}
+	if (len(stats) != 2) || (stats[1].Seeders != 7) || (stats[1].Completed != 8) ||
+		(stats[1].Leechers != 9) {
+		t.Fatal("Wrong scrape response:", stats)
+	}
+
+	// Scrape and a later announce use connection id got for first announce
+	if _, er := announceUdp(cfg, connIds, tracker.url(), req, nil); er != nil {
+		t.Fatal(er)
+	}
+	if n := atomic.LoadInt32(&tracker.connects); n != 1 {
+		t.Fatal("Connection id not reused, connects:", n)
+	}
+}
+
+func TestUdpTrackerError(t *testing.T) {
+	cfg := getTestUdpTrackerCfg()
+	tracker := startTestUdpTracker(t)
+	req := getTestAnnounceRequest()
+	connIds := new(udpConnIdCache)
+
+	// Tracker doesn't know this connection id, and says so
+	connIds.set(tracker.conn.LocalAddr().(*net.UDPAddr), 5)
+	_, er := announceUdp(cfg, connIds, tracker.url(), req, nil)
+	if (er == nil) || !strings.Contains(er.Error(), "bad connection id") {
+		t.Fatal("Expected tracker error, got:", er)
+	}
+	if n := atomic.LoadInt32(&tracker.connects); n != 0 {
+		t.Fatal("Error isn't retried, connects:", n)
+	}
+
+	// Bad connection id is forgotten, next announce connects again
+	if _, er := announceUdp(cfg, connIds, tracker.url(), req, nil); er != nil {
+		t.Fatal(er)
+	}
+	if n := atomic.LoadInt32(&tracker.connects); n != 1 {
+		t.Fatal("Didn't connect again, connects:", n)
+	}
+}
+
+func TestUdpTrackerRetry(t *testing.T) {
+	cfg := getTestUdpTrackerCfg()
+	tracker := startTestUdpTracker(t)
+	req := getTestAnnounceRequest()
+	connIds := new(udpConnIdCache)
+
+	// First announce is dropped, it's sent again once response times out
+	atomic.StoreInt32(&tracker.dropNext, 1)
+	resp, er := announceUdp(cfg, connIds, tracker.url(), req, nil)
+	if er != nil {
+		t.Fatal(er)
+	}
+	if len(resp.Peers) != 2 {
+		t.Fatal("Wrong peers:", resp.Peers)
+	}
+	if n := atomic.LoadInt32(&tracker.announces); n != 2 {
+		t.Fatal("Announce not retried, announces:", n)
+	}
+
+	// Stopped event isn't retried
+	atomic.StoreInt32(&tracker.dropNext, 1)
+	req.Event = AnnounceEventStopped
+	if _, er := announceUdp(cfg, connIds, tracker.url(), req, nil); er == nil {
+		t.Fatal("Dropped stopped event should time out")
+	}
+	if n := atomic.LoadInt32(&tracker.announces); n != 3 {
+		t.Fatal("Stopped event retried, announces:", n)
+	}
+}
+
+func TestUdpTrackerCancel(t *testing.T) {
+	cfg := getTestUdpTrackerCfg()
+	cfg.UdpTrackerTimeout = time.Minute
+	conn, er := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if er != nil {
+		t.Fatal(er)
+	}
+	defer conn.Close()
+
+	// Tracker never responds, closing quit ends the wait for response
+	quit := make(chan bool)
+	time.AfterFunc(100*time.Millisecond, func() { close(quit) })
+	start := time.Now()
+	_, er = announceUdp(cfg, new(udpConnIdCache), "udp://"+conn.LocalAddr().String(),
+		getTestAnnounceRequest(), quit)
+	if (er == nil) || !strings.Contains(er.Error(), "cancelled") {
+		t.Fatal("Expected cancelled, got:", er)
+	}
+	if time.Since(start) > 10*time.Second {
+		t.Fatal("Announce not cut short:", time.Since(start))
+	}
+}
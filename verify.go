@@ -0,0 +1,123 @@
+package gotrnt
+
+import (
+	"encoding/hex"
+	"github.com/swatkat/gotrntmetainfoparser"
+	"log"
+	"os"
+	"reflect"
+	"sync"
+)
+
+// A file whose size on disk doesn't match its length in metainfo
+type VerifyFileSize struct {
+	Path   string `json:"path"`   // File path on disk
+	Length int64  `json:"length"` // Length as per metainfo
+	Size   int64  `json:"size"`   // Size on disk
+}
+
+// Result of checking torrent data on disk against piece hashes
+type VerifyResult struct {
+	Name           string           `json:"name"`            // Torrent name
+	InfoHash       string           `json:"info_hash"`       // Infohash, in hex
+	Dir            string           `json:"dir"`             // Download directory that was checked
+	NumPieces      uint32           `json:"num_pieces"`      // Number of pieces
+	GoodPieces     uint32           `json:"good_pieces"`     // Pieces that match their hash
+	BadPieces      uint32           `json:"bad_pieces"`      // Pieces that don't match their hash, or can't be read
+	MissingFiles   []string         `json:"missing_files"`   // Files that aren't on disk
+	SizeMismatches []VerifyFileSize `json:"size_mismatches"` // Files that are on disk, but of wrong size
+	ResumeSaved    bool             `json:"resume_saved"`    // Resume state was rebuilt from good pieces
+	BitField       *Bitfield        `json:"-"`               // Good pieces
+}
+
+// Hash all pieces of torrent data, several pieces at once. Data files of
+// client's storage are read as they are, nothing on disk is created or
+// changed; storage that doesn't keep data in files known up front can't be
+// verified. Files that are missing or of wrong size are reported. Resume
+// state is rebuilt from good pieces. Session must be stopped.
+func (sessionInfo *TrntSessionInfo) verify(numWorkers int) (VerifyResult, bool) {
+	var result VerifyResult
+	// Sanity checks
+	if !sessionInfo.hasMetaInfo() {
+		log.Println(DebugGetFuncName(), "No metadata")
+		return result, false
+	}
+	files, ok := getDataFiles(sessionInfo.cfg.NewStorage, &sessionInfo.metaInfo,
+		sessionInfo.dataDir)
+	if !ok {
+		log.Println(DebugGetFuncName(), "Storage doesn't keep data in known files")
+		return result, false
+	}
+
+	result.Name = sessionInfo.metaInfo.Info.Name
+	result.InfoHash = hex.EncodeToString([]byte(sessionInfo.metaInfo.InfoHash))
+	result.Dir = sessionInfo.dataDir
+	result.NumPieces = sessionInfo.getNumPieces()
+	result.MissingFiles = make([]string, 0)
+	result.SizeMismatches = make([]VerifyFileSize, 0)
+
+	// Pieces of missing files can't be read, and are bad
+	var filePaths []string
+	for _, f := range files {
+		filePaths = append(filePaths, f.DiskPath)
+		fileInfo, er := os.Stat(f.DiskPath)
+		if er != nil {
+			result.MissingFiles = append(result.MissingFiles, f.DiskPath)
+		} else if fileInfo.Size() != f.Length {
+			result.SizeMismatches = append(result.SizeMismatches,
+				VerifyFileSize{Path: f.DiskPath, Length: f.Length, Size: fileInfo.Size()})
+		}
+	}
+
+	result.BitField = NewBitfield(result.NumPieces)
+	var mutex sync.Mutex
+	hashPieces(files, sessionInfo.metaInfo.Info.PieceLength, numWorkers,
+		sessionInfo.cfg.DebugOutput,
+		func(pieceIdx int, hash []byte, er error) {
+			pieceHash, _ := sessionInfo.getPieceHash(uint32(pieceIdx))
+			if (er != nil) || (string(hash) != pieceHash) {
+				return
+			}
+			mutex.Lock()
+			result.BitField.Set(uint32(pieceIdx))
+			mutex.Unlock()
+		})
+	result.GoodPieces = result.BitField.Count()
+	result.BadPieces = result.NumPieces - result.GoodPieces
+
+	result.ResumeSaved = sessionInfo.pieceMgr.rebuildResume(sessionInfo, filePaths,
+		result.BitField)
+	return result, true
+}
+
+// Get data files of storage that opener opens, without opening it. Files
+// laid out as in metainfo, or a single preallocated data file. Returns false
+// for any other storage.
+func getDataFiles(opener StorageOpener, metaInfo *gotrntmetainfoparser.MetaInfo,
+	baseDir string) ([]createFile, bool) {
+	var layout storageLayout
+	if !layout.init(metaInfo, baseDir) {
+		return nil, false
+	}
+	var files []createFile
+	switch getFuncId(opener) {
+	case getFuncId(nil), getFuncId(OpenFileStorage), getFuncId(OpenMmapStorage):
+		for _, f := range layout.Files {
+			files = append(files, createFile{DiskPath: f.Path, Length: f.Length})
+		}
+	case getFuncId(OpenPreallocStorage):
+		files = append(files, createFile{DiskPath: getPreallocPath(metaInfo, baseDir),
+			Length: layout.TotalLength})
+	default:
+		return nil, false
+	}
+	return files, true
+}
+
+// Get an id of a storage opener, openers can't be compared as funcs
+func getFuncId(opener StorageOpener) uintptr {
+	if opener == nil {
+		return 0
+	}
+	return reflect.ValueOf(opener).Pointer()
+}